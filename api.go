@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	s "strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+	apiDate         = "2006-01-02"
+)
+
+type (
+	// APITrip is a trip in /api/trips
+	APITrip struct {
+		Trip
+		Direction string `json:"direction"`
+		Weekday   string `json:"weekday"`
+		StopCount int    `json:"stop_count"`
+		// ObservedCount is number of stops seen in traces, the rest
+		// is estimated
+		ObservedCount int `json:"observed_count"`
+		// Confidence is the mean of its stop times
+		Confidence float64 `json:"confidence"`
+	}
+
+	// APITripList is a page of trips
+	APITripList struct {
+		Total  int       `json:"total"`
+		Limit  int       `json:"limit"`
+		Offset int       `json:"offset"`
+		Trips  []APITrip `json:"trips"`
+	}
+
+	// APIStopTimeList is stop_times of a trip
+	APIStopTimeList struct {
+		TripID    string        `json:"trip_id"`
+		StopTimes []StopTimeRaw `json:"stop_times"`
+	}
+)
+
+// TripListHandler gives extracted trips, filtered by
+// route (both directions) or direction, box_id, from and to
+// (YYYY-MM-DD, inclusive), weekday (Mon, Tue, ...) and paged by
+// limit and offset
+func (h *Handler) TripListHandler(c echo.Context) error {
+	filter, err := h.parseTripQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Result{Message: err.Error()})
+	}
+	total, err := h.store.CountTrips(filter)
+	if err != nil {
+		return err
+	}
+	stopTimes, err := h.store.StopTimes(filter)
+	if err != nil {
+		return err
+	}
+	trips, err := h.apiTrips(stopTimes)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, APITripList{Total: total, Limit: filter.Limit, Offset: filter.Offset, Trips: trips})
+}
+
+// TripStopTimesHandler gives stop_times of a trip in sequence
+func (h *Handler) TripStopTimesHandler(c echo.Context) error {
+	tripID := c.Param("trip_id")
+	stopTimes, err := h.store.StopTimes(StopTimeFilter{TripID: tripID})
+	if err != nil {
+		return err
+	}
+	if len(stopTimes) == 0 {
+		return c.JSON(http.StatusNotFound, Result{Message: fmt.Sprintf("trip %s not found", tripID)})
+	}
+	raws := stopTimeRaws(stopTimes)
+	sort.SliceStable(raws, func(i, j int) bool {
+		return raws[i].Sequence < raws[j].Sequence
+	})
+	return c.JSON(http.StatusOK, APIStopTimeList{TripID: tripID, StopTimes: raws})
+}
+
+// parseTripQuery reads filters and paging of /api/trips, dates are in
+// service timezone
+func (h *Handler) parseTripQuery(c echo.Context) (StopTimeFilter, error) {
+	filter := StopTimeFilter{
+		BoxID:   c.QueryParam("box_id"),
+		Weekday: c.QueryParam("weekday"),
+		Loc:     h.loc,
+		Limit:   apiDefaultLimit,
+	}
+	route := c.QueryParam("route")
+	if len(route) > 0 {
+		filter.Directions = []string{route, fmt.Sprintf("%s-rev", route)}
+	}
+	if direction := c.QueryParam("direction"); len(direction) > 0 {
+		if len(route) > 0 && direction != filter.Directions[0] && direction != filter.Directions[1] {
+			return filter, fmt.Errorf("direction %s is not of route %s", direction, route)
+		}
+		filter.Directions = nil
+		filter.Direction = direction
+	}
+	if len(filter.Weekday) > 0 {
+		if _, err := time.Parse("Mon", filter.Weekday); err != nil {
+			return filter, fmt.Errorf("weekday: %s is not Mon, Tue, ...", filter.Weekday)
+		}
+	}
+	var err error
+	if value := c.QueryParam("from"); len(value) > 0 {
+		if filter.From, err = time.ParseInLocation(apiDate, value, h.loc); err != nil {
+			return filter, fmt.Errorf("from: %s is not YYYY-MM-DD", value)
+		}
+	}
+	if value := c.QueryParam("to"); len(value) > 0 {
+		if filter.To, err = time.ParseInLocation(apiDate, value, h.loc); err != nil {
+			return filter, fmt.Errorf("to: %s is not YYYY-MM-DD", value)
+		}
+		// inclusive
+		filter.To = filter.To.AddDate(0, 0, 1)
+	}
+	if value := c.QueryParam("limit"); len(value) > 0 {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > apiMaxLimit {
+			return filter, fmt.Errorf("limit: 1 to %d", apiMaxLimit)
+		}
+	}
+	if value := c.QueryParam("offset"); len(value) > 0 {
+		if filter.Offset, err = strconv.Atoi(value); err != nil || filter.Offset < 0 {
+			return filter, fmt.Errorf("offset: %s is not a positive number", value)
+		}
+	}
+	return filter, nil
+}
+
+// apiTrips groups stop_times into trips ordered by start time,
+// stop_times without trip_id (before trip_id was kept) are left out
+func (h *Handler) apiTrips(stopTimes []StopTime) ([]APITrip, error) {
+	routeStops, err := h.store.RouteStops("", "ASC", false)
+	if err != nil {
+		return nil, err
+	}
+	stops := make(map[string]Stop)
+	for _, stop := range uniqueStops(routeStops) {
+		stops[stop.ID] = stop
+	}
+	trips := []APITrip{}
+	index := make(map[string]int)
+	first := make(map[string]StopTimeRaw)
+	last := make(map[string]StopTimeRaw)
+	for _, st := range stopTimeRaws(stopTimes) {
+		if len(st.TripID) == 0 {
+			continue
+		}
+		ind, ok := index[st.TripID]
+		if !ok {
+			ind = len(trips)
+			index[st.TripID] = ind
+			trips = append(trips, APITrip{
+				Trip:      Trip{ID: st.TripID, BoxID: st.BoxID},
+				Direction: st.Direction,
+			})
+			first[st.TripID], last[st.TripID] = st, st
+		}
+		trips[ind].StopCount++
+		if st.Source == sourceObserved {
+			trips[ind].ObservedCount++
+		}
+		trips[ind].Confidence += st.Confidence
+		if st.Sequence < first[st.TripID].Sequence {
+			first[st.TripID] = st
+		}
+		if st.Sequence > last[st.TripID].Sequence {
+			last[st.TripID] = st
+		}
+	}
+	// a full trip runs from the first to the last stop of its direction
+	lastSeq := make(map[string]int)
+	lastSequence := func(direction string) int {
+		if seq, ok := lastSeq[direction]; ok {
+			return seq
+		}
+		lastSeq[direction] = -1
+		stopDirection, _, err := h.routeDirections(s.TrimSuffix(direction, "-rev"), "")
+		if err == nil && len(stopDirection[direction]) > 0 {
+			lastSeq[direction] = len(stopDirection[direction]) - 1
+		}
+		return lastSeq[direction]
+	}
+	for ind, trip := range trips {
+		begin, end := first[trip.ID], last[trip.ID]
+		trips[ind].Start = begin.Arrival
+		trips[ind].End = end.Departure
+		trips[ind].BeginAt = stops[begin.StopID]
+		trips[ind].EndAt = stops[end.StopID]
+		start, _ := time.Parse(time.RFC3339, begin.Arrival)
+		trips[ind].Weekday = start.In(h.loc).Format("Mon")
+		trips[ind].Confidence = math.Round(trip.Confidence/float64(trip.StopCount)*100) / 100
+		if seq := lastSequence(trip.Direction); seq >= 0 && (begin.Sequence > 0 || end.Sequence < seq) {
+			trips[ind].Comment = tripPartial
+		}
+	}
+	sort.SliceStable(trips, func(i, j int) bool {
+		return arrivalBefore(trips[i].Start, trips[j].Start)
+	})
+	return trips, nil
+}
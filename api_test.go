@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// apiContext gives a context of a GET request to target
+func apiContext(target string) (echo.Context, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec), rec
+}
+
+func TestParseTripQuery(t *testing.T) {
+	h := &Handler{loc: time.UTC}
+	cases := []struct {
+		query      string
+		direction  string
+		directions int
+		limit      int
+		fails      bool
+	}{
+		{"", "", 0, apiDefaultLimit, false},
+		{"route=R1", "", 2, apiDefaultLimit, false},
+		{"route=R1&direction=R1-rev", "R1-rev", 0, apiDefaultLimit, false},
+		{"route=R1&direction=R2", "", 0, 0, true},
+		{"weekday=Fri&limit=10&offset=20", "", 0, 10, false},
+		{"weekday=Friday", "", 0, 0, true},
+		{"from=2024-01-05&to=2024-01-06", "", 0, apiDefaultLimit, false},
+		{"from=05/01/2024", "", 0, 0, true},
+		{"limit=0", "", 0, 0, true},
+		{"limit=1001", "", 0, 0, true},
+		{"offset=-1", "", 0, 0, true},
+	}
+	for _, c := range cases {
+		ctx, _ := apiContext("/api/trips?" + c.query)
+		filter, err := h.parseTripQuery(ctx)
+		if (err != nil) != c.fails {
+			t.Errorf("%q: error %v", c.query, err)
+			continue
+		}
+		if c.fails {
+			continue
+		}
+		if filter.Direction != c.direction || len(filter.Directions) != c.directions || filter.Limit != c.limit {
+			t.Errorf("%q: direction %q, directions %v, limit %d, want %q, %d, %d", c.query,
+				filter.Direction, filter.Directions, filter.Limit, c.direction, c.directions, c.limit)
+		}
+	}
+	// to is inclusive
+	ctx, _ := apiContext("/api/trips?to=2024-01-05")
+	filter, _ := h.parseTripQuery(ctx)
+	if want := time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC); !filter.To.Equal(want) {
+		t.Errorf("to = %v, want %v", filter.To, want)
+	}
+}
+
+func TestTripListHandler(t *testing.T) {
+	store, _ := newMemStore("")
+	h := &Handler{store: store, loc: time.UTC}
+	start, _ := time.Parse(time.RFC3339, "2024-01-05T08:00:00Z")
+	for trip := 0; trip < 3; trip++ {
+		for seq := 0; seq < 5; seq++ {
+			st := StopTime{
+				TripID:    fmt.Sprintf("R1__%d", trip+1),
+				BoxID:     "B1",
+				Direction: "R1",
+				StopID:    fmt.Sprintf("S%d", seq+1),
+				Sequence:  seq,
+				Arrival:   start.Add(time.Duration(trip*60+seq*5) * time.Minute).Format(time.RFC3339),
+				Source:    sourceObserved,
+			}
+			if err := h.store.InsertStopTime(st); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ctx, rec := apiContext("/api/trips?route=R1&limit=2&offset=1")
+	if err := h.TripListHandler(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var list APITripList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 3 || len(list.Trips) != 2 || list.Trips[0].ID != "R1__2" {
+		t.Fatalf("total %d, %d trips from %+v, want 3, 2 from R1__2", list.Total, len(list.Trips), list.Trips)
+	}
+	if trip := list.Trips[0]; trip.StopCount != 5 || trip.ObservedCount != 5 || trip.Weekday != "Fri" {
+		t.Errorf("trip %+v, want 5 observed stops on Fri", trip)
+	}
+
+	ctx, rec = apiContext("/api/trips/R1__9/stop_times")
+	ctx.SetParamNames("trip_id")
+	ctx.SetParamValues("R1__9")
+	if err := h.TripStopTimesHandler(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("stop_times of an unknown trip: %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAPITripsPartial(t *testing.T) {
+	h := newTestHandler(t)
+	start, _ := time.Parse(time.RFC3339, "2024-01-05T08:00:00Z")
+	rows := []StopTime{}
+	// a full trip at every stop, a short turn from S2 to S4 and a trip
+	// from S1 to S3
+	for _, trip := range []struct {
+		id    string
+		first int
+		last  int
+	}{{"R1__1", 0, 4}, {"R1__p1", 1, 3}, {"R1__p2", 0, 2}} {
+		for seq := trip.first; seq <= trip.last; seq++ {
+			rows = append(rows, StopTime{
+				TripID:    trip.id,
+				BoxID:     "B1",
+				Direction: "R1",
+				StopID:    fmt.Sprintf("S%d", seq+1),
+				Sequence:  seq,
+				Arrival:   start.Add(time.Duration(seq) * 5 * time.Minute).Format(time.RFC3339),
+				Source:    sourceObserved,
+			})
+		}
+	}
+	trips, err := h.apiTrips(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"R1__1": "", "R1__p1": tripPartial, "R1__p2": tripPartial}
+	if len(trips) != len(want) {
+		t.Fatalf("%d trips, want %d", len(trips), len(want))
+	}
+	for _, trip := range trips {
+		if trip.Comment != want[trip.ID] {
+			t.Errorf("comment of %s = %q, want %q", trip.ID, trip.Comment, want[trip.ID])
+		}
+	}
+}
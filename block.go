@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+	"github.com/labstack/echo"
+)
+
+const (
+	// blockLayover is a box waiting between trips at the stop its last
+	// trip ended
+	blockLayover = "layover"
+	// blockDeadhead is a box running out of service to another stop to
+	// start its next trip
+	blockDeadhead = "deadhead"
+)
+
+type (
+	// Block is trips a box ran one after another in a service day,
+	// a gap longer than block_max_gap ends it (out of service)
+	Block struct {
+		BlockID string      `json:"block_id"`
+		BoxID   string      `json:"box_id"`
+		Date    string      `json:"date"`
+		Start   string      `json:"start"`
+		End     string      `json:"end"`
+		TripIDs []string    `json:"trip_ids"`
+		Links   []BlockLink `json:"links"`
+	}
+
+	// BlockLink is what a box did (layover or deadhead) between a trip
+	// and the next one of a block, duration in second
+	BlockLink struct {
+		FromTripID string `json:"from_trip_id"`
+		ToTripID   string `json:"to_trip_id"`
+		FromStopID string `json:"from_stop_id"`
+		ToStopID   string `json:"to_stop_id"`
+		Kind       string `json:"kind"`
+		Duration   int    `json:"duration"`
+	}
+
+	// Duty is what a box did in a service day, durations in second.
+	// Revenue is time in trips, OutOfService is time between blocks.
+	Duty struct {
+		BoxID        string `json:"box_id"`
+		Date         string `json:"date"`
+		Weekday      string `json:"weekday"`
+		Start        string `json:"start"`
+		End          string `json:"end"`
+		Blocks       int    `json:"blocks"`
+		Trips        int    `json:"trips"`
+		Span         int    `json:"span"`
+		Revenue      int    `json:"revenue"`
+		Layover      int    `json:"layover"`
+		Deadhead     int    `json:"deadhead"`
+		OutOfService int    `json:"out_of_service"`
+	}
+
+	// DutyReport is blocks and duties of all boxes
+	DutyReport struct {
+		Blocks []Block `json:"blocks"`
+		Duties []Duty  `json:"duties"`
+	}
+)
+
+// buildBlocks chains trips of each box in order of departure across
+// directions and routes. A block is the trips of a box in a service day
+// until it is out of service for longer than block_max_gap, its id is
+// <box_id>_<YYYYMMDD>_<n>. A trip without box (planned) has no block,
+// nor a trip starting before the last one of the box ends.
+func (h *Handler) buildBlocks(trips []FeedTrip) ([]Block, error) {
+	routeStops, err := h.store.RouteStops("", "ASC", false)
+	if err != nil {
+		return nil, fmt.Errorf("blocks: %v", err)
+	}
+	stops := make(map[string]Stop)
+	for _, stop := range uniqueStops(routeStops) {
+		stops[stop.ID] = stop
+	}
+	byBox := make(map[string][]FeedTrip)
+	boxes := []string{}
+	for _, trip := range trips {
+		if len(trip.StopTimes) == 0 || len(trip.StopTimes[0].BoxID) == 0 {
+			continue
+		}
+		boxID := trip.StopTimes[0].BoxID
+		if _, ok := byBox[boxID]; !ok {
+			boxes = append(boxes, boxID)
+		}
+		byBox[boxID] = append(byBox[boxID], trip)
+	}
+	sort.Strings(boxes)
+
+	maxGap := int(h.stats.BlockMaxGap * 60)
+	blocks := []Block{}
+	for _, boxID := range boxes {
+		boxTrips := byBox[boxID]
+		sort.SliceStable(boxTrips, func(i, j int) bool {
+			return arrivalBefore(tripStart(boxTrips[i]), tripStart(boxTrips[j]))
+		})
+		perDate := make(map[string]int)
+		var block *Block
+		var prev FeedTrip
+		for _, trip := range boxTrips {
+			date := h.serviceDay(tripStart(trip)).Format(gtfsDate)
+			gap := int(durationBetween(tripEnd(prev), tripStart(trip)).Seconds())
+			if block != nil && gap < 0 {
+				// a box runs one trip at a time, e.g. a partial trip
+				// found in a trip of another route
+				h.LogPrint(fmt.Sprintf("%s overlaps %s of box %s, no block\n", trip.TripID, prev.TripID, boxID))
+				continue
+			}
+			if block == nil || gap > maxGap || date != block.Date {
+				if block != nil {
+					blocks = append(blocks, *block)
+				}
+				perDate[date]++
+				block = &Block{
+					BlockID: fmt.Sprintf("%s_%s_%d", boxID, date, perDate[date]),
+					BoxID:   boxID,
+					Date:    date,
+					Start:   tripStart(trip),
+					Links:   []BlockLink{},
+				}
+			} else {
+				block.Links = append(block.Links, h.blockLink(prev, trip, stops))
+			}
+			block.TripIDs = append(block.TripIDs, trip.TripID)
+			block.End = tripEnd(trip)
+			prev = trip
+		}
+		if block != nil {
+			blocks = append(blocks, *block)
+		}
+	}
+	return blocks, nil
+}
+
+// blockLink tells if a box stayed at the stop its trip ended (layover)
+// or ran to another stop (deadhead) for its next trip
+func (h *Handler) blockLink(from FeedTrip, to FeedTrip, stops map[string]Stop) BlockLink {
+	last := from.StopTimes[len(from.StopTimes)-1]
+	first := to.StopTimes[0]
+	link := BlockLink{
+		FromTripID: from.TripID,
+		ToTripID:   to.TripID,
+		FromStopID: last.StopID,
+		ToStopID:   first.StopID,
+		Kind:       blockDeadhead,
+		Duration:   int(durationBetween(tripEnd(from), tripStart(to)).Seconds()),
+	}
+	endAt, ok1 := stops[last.StopID]
+	beginAt, ok2 := stops[first.StopID]
+	if last.StopID == first.StopID ||
+		(ok1 && ok2 && h.atStop(beginAt, geo.NewPoint(endAt.Lat, endAt.Lon))) {
+		link.Kind = blockLayover
+	}
+	return link
+}
+
+// tripStart is departure from the first stop of a trip
+func tripStart(trip FeedTrip) string {
+	if len(trip.StopTimes) == 0 {
+		return ""
+	}
+	return trip.StopTimes[0].Departure
+}
+
+// tripEnd is arrival at the last stop of a trip
+func tripEnd(trip FeedTrip) string {
+	if len(trip.StopTimes) == 0 {
+		return ""
+	}
+	return trip.StopTimes[len(trip.StopTimes)-1].Arrival
+}
+
+// blockIDs gives block_id of each trip in blocks
+func blockIDs(blocks []Block) map[string]string {
+	ids := make(map[string]string)
+	for _, block := range blocks {
+		for _, tripID := range block.TripIDs {
+			ids[tripID] = block.BlockID
+		}
+	}
+	return ids
+}
+
+// duties sums blocks of each box by service day, weekday (Mon, Tue, ...)
+// filters them if it is not empty
+func (h *Handler) duties(blocks []Block, trips []FeedTrip, weekday string) []Duty {
+	byID := make(map[string]FeedTrip, len(trips))
+	for _, trip := range trips {
+		byID[trip.TripID] = trip
+	}
+	duties := []Duty{}
+	index := make(map[string]int)
+	for _, block := range blocks {
+		day, _ := time.ParseInLocation(gtfsDate, block.Date, h.loc)
+		if len(weekday) > 0 && day.Format("Mon") != weekday {
+			continue
+		}
+		key := fmt.Sprintf("%s %s", block.BoxID, block.Date)
+		ind, ok := index[key]
+		if !ok {
+			ind = len(duties)
+			index[key] = ind
+			duties = append(duties, Duty{
+				BoxID:   block.BoxID,
+				Date:    block.Date,
+				Weekday: day.Format("Mon"),
+				Start:   block.Start,
+			})
+		} else {
+			duties[ind].OutOfService += int(durationBetween(duties[ind].End, block.Start).Seconds())
+		}
+		duty := &duties[ind]
+		duty.End = block.End
+		duty.Blocks++
+		duty.Trips += len(block.TripIDs)
+		for _, tripID := range block.TripIDs {
+			trip := byID[tripID]
+			duty.Revenue += int(durationBetween(tripStart(trip), tripEnd(trip)).Seconds())
+		}
+		for _, link := range block.Links {
+			if link.Kind == blockLayover {
+				duty.Layover += link.Duration
+			} else {
+				duty.Deadhead += link.Duration
+			}
+		}
+		duty.Span = int(durationBetween(duty.Start, duty.End).Seconds())
+	}
+	return duties
+}
+
+// dutyReport builds blocks and duties from trips in stop_times
+func (h *Handler) dutyReport(weekday string) (DutyReport, error) {
+	stopTimes, err := h.store.StopTimes(StopTimeFilter{})
+	if err != nil {
+		return DutyReport{}, err
+	}
+	runs := observedRuns(stopTimes)
+	blocks, err := h.buildBlocks(runs)
+	if err != nil {
+		return DutyReport{}, err
+	}
+	report := DutyReport{Blocks: []Block{}, Duties: h.duties(blocks, runs, weekday)}
+	for _, block := range blocks {
+		day, _ := time.ParseInLocation(gtfsDate, block.Date, h.loc)
+		if len(weekday) == 0 || day.Format("Mon") == weekday {
+			report.Blocks = append(report.Blocks, block)
+		}
+	}
+	return report, nil
+}
+
+// DutyReporter prints duty of each box by service day and writes
+// blocks.csv and duties.csv into output directory
+func (h *Handler) DutyReporter() {
+	report, err := h.dutyReport(h.day)
+	CheckError("Cannot read stop_times ", err)
+	if len(report.Duties) == 0 {
+		fmt.Println("No stop_times with trip_id, run gen first")
+		return
+	}
+	fmt.Printf("  %-10s %-8s %-3s %-5s %-5s %6s %5s %7s %7s %7s %7s %7s\n",
+		"box_id", "date", "day", "start", "end", "blocks", "trips",
+		"span", "revenue", "layover", "deadhd", "off")
+	for _, duty := range report.Duties {
+		fmt.Printf("  %-10.10s %-8s %-3s %-5s %-5s %6d %5d %7s %7s %7s %7s %7s\n",
+			duty.BoxID, duty.Date, duty.Weekday, h.hhmm(duty.Start), h.hhmm(duty.End),
+			duty.Blocks, duty.Trips, secondsToHHMM(duty.Span), secondsToHHMM(duty.Revenue),
+			secondsToHHMM(duty.Layover), secondsToHHMM(duty.Deadhead), secondsToHHMM(duty.OutOfService))
+	}
+	for _, block := range report.Blocks {
+		h.LogPrint(fmt.Sprintf("\n%s %s -> %s\n", block.BlockID, h.hhmm(block.Start), h.hhmm(block.End)))
+		for ind, tripID := range block.TripIDs {
+			h.LogPrint(fmt.Sprintf("  %s\n", tripID))
+			if ind < len(block.Links) {
+				link := block.Links[ind]
+				h.LogPrint(fmt.Sprintf("    %s %s -> %s %d s\n", link.Kind, link.FromStopID, link.ToStopID, link.Duration))
+			}
+		}
+	}
+
+	// make sure we have "output"
+	_ = os.Mkdir(h.outputDir, 0755)
+	h.DutyExporter(report)
+	fmt.Printf("duty: %s/blocks.csv, %s/duties.csv\n", h.outputDir, h.outputDir)
+}
+
+// DutyExporter will give blocks.csv (a row per trip) and duties.csv
+func (h *Handler) DutyExporter(report DutyReport) {
+	file, err := os.Create(fmt.Sprintf("%s/blocks.csv", h.outputDir))
+	CheckError("cannot create file", err)
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+	// header
+	headerRow := []string{
+		"block_id", "box_id", "date", "trip_id", "next_trip_id", "link", "link_duration"}
+	err = writer.Write(headerRow)
+	CheckError("Cannot write to file [blk0] ", err)
+	for _, block := range report.Blocks {
+		for ind, tripID := range block.TripIDs {
+			row := []string{block.BlockID, block.BoxID, block.Date, tripID, "", "", ""}
+			if ind < len(block.Links) {
+				link := block.Links[ind]
+				row[4] = link.ToTripID
+				row[5] = link.Kind
+				row[6] = fmt.Sprintf("%d", link.Duration)
+			}
+			err = writer.Write(row)
+			CheckError("Cannot write to file [blk1] ", err)
+		}
+	}
+
+	dutyFile, err := os.Create(fmt.Sprintf("%s/duties.csv", h.outputDir))
+	CheckError("cannot create file", err)
+	defer dutyFile.Close()
+	dutyWriter := csv.NewWriter(dutyFile)
+	defer dutyWriter.Flush()
+	headerRow = []string{
+		"box_id", "date", "weekday", "start", "end", "blocks", "trips",
+		"span", "revenue", "layover", "deadhead", "out_of_service"}
+	err = dutyWriter.Write(headerRow)
+	CheckError("Cannot write to file [blk2] ", err)
+	for _, duty := range report.Duties {
+		row := []string{
+			duty.BoxID,
+			duty.Date,
+			duty.Weekday,
+			duty.Start,
+			duty.End,
+			fmt.Sprintf("%d", duty.Blocks),
+			fmt.Sprintf("%d", duty.Trips),
+			fmt.Sprintf("%d", duty.Span),
+			fmt.Sprintf("%d", duty.Revenue),
+			fmt.Sprintf("%d", duty.Layover),
+			fmt.Sprintf("%d", duty.Deadhead),
+			fmt.Sprintf("%d", duty.OutOfService),
+		}
+		err = dutyWriter.Write(row)
+		CheckError("Cannot write to file [blk3] ", err)
+	}
+}
+
+// DutyHandler gives blocks and duty of each box by service day,
+// filtered by weekday (Mon, Tue, ...)
+func (h *Handler) DutyHandler(c echo.Context) error {
+	weekday := c.QueryParam("weekday")
+	if len(weekday) > 0 {
+		if _, err := time.Parse("Mon", weekday); err != nil {
+			return c.JSON(http.StatusBadRequest, Result{Message: fmt.Sprintf("weekday: %s is not Mon, Tue, ...", weekday)})
+		}
+	}
+	report, err := h.dutyReport(weekday)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+// feedTrip gives a trip of box B1 from a stop to another one
+func feedTrip(tripID string, from string, start string, to string, end string) FeedTrip {
+	return FeedTrip{TripID: tripID, StopTimes: []StopTimeRaw{
+		{TripID: tripID, BoxID: "B1", StopID: from, Arrival: start, Departure: start},
+		{TripID: tripID, BoxID: "B1", StopID: to, Arrival: end, Departure: end},
+	}}
+}
+
+func TestBuildBlocks(t *testing.T) {
+	h := newTestHandler(t)
+	trips := []FeedTrip{
+		feedTrip("R1__1", "S1", "2024-01-05T22:00:00Z", "S5", "2024-01-05T22:30:00Z"),
+		// found again in R1__1, e.g. a partial trip
+		feedTrip("R1__p1", "S2", "2024-01-05T22:10:00Z", "S4", "2024-01-05T22:20:00Z"),
+		feedTrip("R1-rev__1", "S5", "2024-01-05T22:40:00Z", "S1", "2024-01-05T23:10:00Z"),
+		// the next service day within block_max_gap
+		feedTrip("R1__2", "S1", "2024-01-06T00:05:00Z", "S5", "2024-01-06T00:35:00Z"),
+	}
+	blocks, err := h.buildBlocks(trips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("%d blocks, want 2: %+v", len(blocks), blocks)
+	}
+	first, second := blocks[0], blocks[1]
+	if first.BlockID != "B1_20240105_1" || len(first.TripIDs) != 2 || first.TripIDs[1] != "R1-rev__1" {
+		t.Errorf("first block = %s %v, want B1_20240105_1 [R1__1 R1-rev__1]", first.BlockID, first.TripIDs)
+	}
+	if len(first.Links) != 1 || first.Links[0].Kind != blockLayover || first.Links[0].Duration != 600 {
+		t.Errorf("first block links = %+v, want a layover of 600 s", first.Links)
+	}
+	if second.BlockID != "B1_20240106_1" || len(second.TripIDs) != 1 {
+		t.Errorf("second block = %s %v, want B1_20240106_1 [R1__2]", second.BlockID, second.TripIDs)
+	}
+	for _, duty := range h.duties(blocks, trips, "") {
+		if duty.Layover < 0 || duty.Deadhead < 0 || duty.OutOfService < 0 {
+			t.Errorf("negative duty: %+v", duty)
+		}
+	}
+}
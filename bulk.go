@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	s "strings"
+	"time"
+
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+const (
+	// bulkBatchSize is number of rows loaded into store at once
+	bulkBatchSize = 5000
+	// bulkMaxMessage is number of line errors reported back
+	bulkMaxMessage = 100
+)
+
+var bulkValidator = validator.New()
+
+// csvRow gives value of a column by header name
+type csvRow func(column string) string
+
+// bulkResult collects per-line errors into Result
+type bulkResult struct {
+	Result
+	buffer  bytes.Buffer
+	skipped int
+}
+
+func (br *bulkResult) fail(line int, err error) {
+	br.Failed++
+	if br.Failed > bulkMaxMessage {
+		br.skipped++
+		return
+	}
+	if br.buffer.Len() > 0 {
+		br.buffer.WriteString(",")
+	}
+	br.buffer.WriteString(fmt.Sprintf("line %d: %v", line, err))
+}
+
+func (br *bulkResult) result() Result {
+	if br.skipped > 0 {
+		br.buffer.WriteString(fmt.Sprintf(",... %d more", br.skipped))
+	}
+	br.Message = br.buffer.String()
+	return br.Result
+}
+
+// readCSV streams CSV with header and calls fn for every line,
+// error from fn is reported as failure of the line
+func readCSV(r io.Reader, required []string, br *bulkResult, fn func(line int, row csvRow) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("cannot read header: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for ind, name := range header {
+		// strip BOM which some spreadsheets add
+		name = s.TrimPrefix(name, "\ufeff")
+		columns[s.ToLower(s.TrimSpace(name))] = ind
+	}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("column %s is required", name)
+		}
+	}
+	line := 1
+	for {
+		record, err := reader.Read()
+		line++
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				br.fail(line, err)
+				continue
+			}
+			return err
+		}
+		row := func(column string) string {
+			ind, ok := columns[column]
+			if !ok || ind >= len(record) {
+				return ""
+			}
+			return s.TrimSpace(record[ind])
+		}
+		if err := fn(line, row); err != nil {
+			br.fail(line, err)
+		}
+	}
+}
+
+func parseFloat(row csvRow, column string) (float64, error) {
+	value, err := strconv.ParseFloat(row(column), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", column, err)
+	}
+	return value, nil
+}
+
+// TraceCSVLoader loads traces from CSV with box_id, timestamp, lat, lon columns
+func (h *Handler) TraceCSVLoader(r io.Reader) (Result, error) {
+	br := &bulkResult{}
+	batch := make([]Trace, 0, bulkBatchSize)
+	lines := make([]int, 0, bulkBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := h.store.InsertTraces(batch); err != nil {
+			// one by one to tell which lines are bad
+			for ind := range batch {
+				if err := h.store.InsertTrace(batch[ind]); err != nil {
+					br.fail(lines[ind], err)
+				} else {
+					br.Success++
+				}
+			}
+		} else {
+			br.Success += len(batch)
+		}
+		batch = batch[:0]
+		lines = lines[:0]
+	}
+	required := []string{"box_id", "timestamp", "lat", "lon"}
+	err := readCSV(r, required, br, func(line int, row csvRow) error {
+		trace := Trace{BoxID: row("box_id")}
+		t, err := time.Parse(time.RFC3339, row("timestamp"))
+		if err != nil {
+			return fmt.Errorf("timestamp: %v", err)
+		}
+		trace.Timestamp = t.Format(time.RFC3339)
+		if trace.Lat, err = parseFloat(row, "lat"); err != nil {
+			return err
+		}
+		if trace.Lon, err = parseFloat(row, "lon"); err != nil {
+			return err
+		}
+		if len(row("bearing")) > 0 {
+			bearing, err := parseFloat(row, "bearing")
+			if err != nil {
+				return err
+			}
+			trace.Bearing = &bearing
+		}
+		if len(row("speed")) > 0 {
+			speed, err := parseFloat(row, "speed")
+			if err != nil {
+				return err
+			}
+			trace.Speed = &speed
+		}
+		if err := bulkValidator.Struct(trace); err != nil {
+			return err
+		}
+		batch = append(batch, trace)
+		lines = append(lines, line)
+		if len(batch) >= bulkBatchSize {
+			flush()
+		}
+		return nil
+	})
+	flush()
+	return br.result(), err
+}
+
+// StopCSVLoader loads stops from CSV as in GTFS stops.txt
+func (h *Handler) StopCSVLoader(r io.Reader) (Result, error) {
+	br := &bulkResult{}
+	batch := make([]Stop, 0, bulkBatchSize)
+	lines := make([]int, 0, bulkBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := h.store.InsertStops(batch); err != nil {
+			// one by one to tell which lines are bad
+			for ind := range batch {
+				if err := h.store.InsertStop(batch[ind]); err != nil {
+					br.fail(lines[ind], err)
+				} else {
+					br.Success++
+				}
+			}
+		} else {
+			br.Success += len(batch)
+		}
+		batch = batch[:0]
+		lines = lines[:0]
+	}
+	required := []string{"stop_id", "stop_lat", "stop_lon"}
+	err := readCSV(r, required, br, func(line int, row csvRow) error {
+		var err error
+		stop := Stop{
+			ID:            row("stop_id"),
+			Name:          row("stop_name"),
+			ParentStation: row("parent_station"),
+		}
+		if stop.Lat, err = parseFloat(row, "stop_lat"); err != nil {
+			return err
+		}
+		if stop.Lon, err = parseFloat(row, "stop_lon"); err != nil {
+			return err
+		}
+		if value := row("location_type"); len(value) > 0 {
+			if stop.LocationType, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("location_type: %v", err)
+			}
+		}
+		if value := row("radius"); len(value) > 0 {
+			if stop.Radius, err = parseFloat(row, "radius"); err != nil {
+				return err
+			}
+		}
+		if err := bulkValidator.Struct(stop); err != nil {
+			return err
+		}
+		batch = append(batch, stop)
+		lines = append(lines, line)
+		if len(batch) >= bulkBatchSize {
+			flush()
+		}
+		return nil
+	})
+	flush()
+	return br.result(), err
+}
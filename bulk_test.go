@@ -0,0 +1,34 @@
+package main
+
+import (
+	s "strings"
+	"testing"
+)
+
+func TestStopCSVLoaderBadLines(t *testing.T) {
+	store, _ := newMemStore("")
+	h := &Handler{store: store}
+	csv := `stop_id,stop_name,stop_lat,stop_lon,parent_station
+S1,First,13.75,100.50,ST1
+S2,Second,13.75,north,
+S1,Again,13.75,100.51,
+S3,Third,13.75,100.52,
+`
+	result, err := h.StopCSVLoader(s.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Success != 2 || result.Failed != 2 {
+		t.Errorf("success %d, failed %d, want 2, 2", result.Success, result.Failed)
+	}
+	if !s.Contains(result.Message, "line 3:") || !s.Contains(result.Message, "line 4:") {
+		t.Errorf("message %q does not tell lines 3 and 4", result.Message)
+	}
+	stops, _ := store.MissingStops([]string{"S1", "S3"})
+	if len(stops) > 0 {
+		t.Errorf("good lines are not added: %v", stops)
+	}
+	if store.data.Stops["S1"].ParentStation != "ST1" {
+		t.Errorf("parent_station = %q, want ST1", store.data.Stops["S1"].ParentStation)
+	}
+}
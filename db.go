@@ -3,79 +3,120 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	s "strings"
-	"time"
 
 	pq "github.com/lib/pq"
 )
 
-type (
-	// Stop is to store all info about stop we need
-	// to know to create trip
-	Stop struct {
-		ID            string  `json:"stop_id" validate:"required"`
-		Name          string  `json:"stop_name"`
-		Lat           float64 `json:"stop_lat" validate:"required"`
-		Lon           float64 `json:"stop_lon" validate:"required"`
-		Sequence      int     `json:"sequence" validate:"gte=0"`
-		IsTerminal    bool    `json:"is_terminal"`
-		LocationType  int     `json:"location_type"`
-		ParentStation string  `json:"parent_station"`
-	}
-
-	// Trace is to keep all GPS data
-	Trace struct {
-		BoxID     string  `json:"box_id" db:"box_id" validate:"required"`
-		Timestamp string  `json:"timestamp" db:"timestamp" validate:"required"`
-		Lat       float64 `json:"lat" db:"lat" validate:"required"`
-		Lon       float64 `json:"lon" db:"lon" validate:"required"`
-	}
-
-	// StopTime is a arrival time for each stopm including stop duration
-	StopTime struct {
-		BoxID        string `json:"box_id" db:"box_id" validate:"required"`
-		StopID       string `json:"stop_id" validate:"required"`
-		Direction    string `json:"direction" validate:"required"`
-		Sequence     int    `json:"sequence" validate:"gte=0"`
-		Arrival      string `json:"arrival" db:"arrival" validate:"required"`
-		StopDuration int    `json:"stop_duration" db:"stop_duration" validate:"required"`
+// pgStore keeps everything in postgreSQL + postgis
+type pgStore struct {
+	db *sql.DB
+}
+
+func newPGStore(conn string) (*pgStore, error) {
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		return nil, err
 	}
-)
+	p := &pgStore{db: db}
+	if err := p.upgradeTables(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
 
-func (h *Handler) truncateTables() error {
+// upgradeTables adds columns which tables created by older version lack
+func (p *pgStore) upgradeTables() error {
+	// routes sharing a stop may pass it at the same time
+	sq := `ALTER TABLE IF EXISTS stop_times ADD COLUMN IF NOT EXISTS trip_id char(150);
+		ALTER TABLE IF EXISTS stop_times ADD COLUMN IF NOT EXISTS source char(20);
+		ALTER TABLE IF EXISTS stop_times ADD COLUMN IF NOT EXISTS confidence numeric;
+		ALTER TABLE IF EXISTS stop_times DROP CONSTRAINT IF EXISTS stop_times_box_id_stop_id_arrival_key;
+		DO $$ BEGIN
+			IF to_regclass('stop_times') IS NOT NULL THEN
+				CREATE UNIQUE INDEX IF NOT EXISTS stop_times_box_id_stop_id_arrival_direction_key
+					ON stop_times (box_id, stop_id, arrival, direction);
+			END IF;
+		END $$;
+		ALTER TABLE IF EXISTS stops ADD COLUMN IF NOT EXISTS radius numeric;
+		ALTER TABLE IF EXISTS traces ADD COLUMN IF NOT EXISTS bearing numeric;
+		ALTER TABLE IF EXISTS traces ADD COLUMN IF NOT EXISTS speed numeric;
+		ALTER TABLE IF EXISTS stops ADD COLUMN IF NOT EXISTS geofence geometry(Polygon,4326);
+		-- parent_station is a stop_id as in GTFS
+		DO $$ BEGIN
+			IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'stops'
+					AND column_name = 'parent_station' AND data_type = 'integer') THEN
+				ALTER TABLE stops ALTER COLUMN parent_station TYPE char(150) USING parent_station::text;
+			END IF;
+		END $$;
+		CREATE TABLE IF NOT EXISTS route_paths (
+			route_id char(150),
+			sequence int,
+			lat numeric,
+			lon numeric,
+			UNIQUE(route_id, sequence)
+		);
+		CREATE TABLE IF NOT EXISTS segment_profiles (
+			direction char(150),
+			sequence int,
+			travel numeric,
+			travel_samples int,
+			dwell numeric,
+			dwell_samples int,
+			UNIQUE(direction, sequence)
+		);`
+	_, err := p.db.Exec(sq)
+	return err
+}
+
+// Close the connection
+func (p *pgStore) Close() error {
+	return p.db.Close()
+}
+
+// Truncate removes all stops, traces and stop_times
+func (p *pgStore) Truncate() error {
 	sq := `TRUNCATE TABLE stops;
 		TRUNCATE TABLE traces;`
-	_, err := h.db.Exec(sq)
+	_, err := p.db.Exec(sq)
 	if err != nil {
 		return err
 	}
-	err = h.truncateStopTimeTable()
+	err = p.TruncateStopTimes()
 	return err
 }
 
-func (h *Handler) truncateStopTimeTable() error {
+// TruncateStopTimes removes all stop_times
+func (p *pgStore) TruncateStopTimes() error {
 	sq := `TRUNCATE TABLE stop_times;`
-	_, err := h.db.Exec(sq)
+	_, err := p.db.Exec(sq)
 	return err
 }
 
-func (h *Handler) createStopTable() error {
+// DeleteStopTimes removes stop_times of directions
+func (p *pgStore) DeleteStopTimes(directions []string) error {
+	_, err := p.db.Exec(`DELETE FROM stop_times WHERE direction = ANY($1::text[])`, pq.Array(directions))
+	return err
+}
+
+func (p *pgStore) createStopTable() error {
 	sq := `CREATE TABLE stops (
 		stop_id char(150),
 		stop_name char(250),
 		stop_lat numeric,
 		stop_lon numeric,
 		location_type int,
-		parent_station int,
+		parent_station char(150),
+		radius numeric,
 		geom geometry(Point,4326),
+		geofence geometry(Polygon,4326),
 		UNIQUE(stop_id)
 		)`
-	_, err := h.db.Exec(sq)
+	_, err := p.db.Exec(sq)
 	return err
 }
 
-func (h *Handler) createStopRouteTable() error {
+func (p *pgStore) createStopRouteTable() error {
 	sq := `CREATE TABLE stop_and_route (
 		route_id char(150),
 		stop_id char(150),
@@ -83,148 +124,351 @@ func (h *Handler) createStopRouteTable() error {
 		is_terminal bool,
 		UNIQUE(route_id, stop_id)
 		)`
-	_, err := h.db.Exec(sq)
+	_, err := p.db.Exec(sq)
+	return err
+}
+
+func (p *pgStore) createRoutePathTable() error {
+	cq := `CREATE TABLE route_paths (
+		route_id char(150),
+		sequence int,
+		lat numeric,
+		lon numeric,
+		UNIQUE(route_id, sequence)
+		)`
+	_, err := p.db.Exec(cq)
+	return err
+}
+
+func (p *pgStore) createSegmentProfileTable() error {
+	cq := `CREATE TABLE segment_profiles (
+		direction char(150),
+		sequence int,
+		travel numeric,
+		travel_samples int,
+		dwell numeric,
+		dwell_samples int,
+		UNIQUE(direction, sequence)
+		)`
+	_, err := p.db.Exec(cq)
 	return err
 }
 
-func (h *Handler) createTraceTable() error {
+func (p *pgStore) createTraceTable() error {
 	cq := `CREATE TABLE traces (
 		box_id char(150),
 		timestamp timestamptz,
 		lat	numeric,
 		lon numeric,
+		bearing numeric,
+		speed numeric,
 		geom geometry(Point,4326),
 		UNIQUE(box_id, timestamp)
 		)`
-	_, err := h.db.Exec(cq)
+	_, err := p.db.Exec(cq)
 	return err
 }
 
-func (h *Handler) createStopTimeTable() error {
+func (p *pgStore) createStopTimeTable() error {
 	cq := `CREATE TABLE stop_times (
+		trip_id char(150),
 		box_id char(150),
 		stop_id char(150),
 		direction char(30),
 		sequence int,
 		arrival timestamptz,
 		stop_duration int,
-		UNIQUE(box_id, stop_id, arrival)
+		source char(20),
+		confidence numeric,
+		UNIQUE(box_id, stop_id, arrival, direction)
 		)`
-	_, err := h.db.Exec(cq)
+	_, err := p.db.Exec(cq)
 	return err
 }
 
-func (h *Handler) insertStopTime(st StopTimeRaw) error {
-	bkk, _ := time.LoadLocation("Asia/Bangkok")
-
+// InsertStopTime adds a stop_times row
+func (p *pgStore) InsertStopTime(st StopTime) error {
 	insertQuery := `INSERT INTO stop_times
-	(box_id, stop_id, direction, sequence, arrival, stop_duration)
-	values ($1,$2,$3,$4,$5,$6);`
+	(trip_id, box_id, stop_id, direction, sequence, arrival, stop_duration, source, confidence)
+	values ($1,$2,$3,$4,$5,$6,$7,$8,$9);`
+	_, err := p.db.Exec(insertQuery, st.TripID, st.BoxID, st.StopID, st.Direction,
+		st.Sequence, st.Arrival, st.StopDuration, st.Source, st.Confidence)
+	return err
+}
+
+// InsertStop adds a stop
+func (p *pgStore) InsertStop(stop Stop) error {
+	insertQuery := `INSERT INTO stops (stop_id, stop_name, stop_lat, stop_lon, location_type, parent_station,
+	radius, geom, geofence) VALUES ($1, $2, $3, $4, $5, $6, $7, ST_GeomFromEWKT($8), ST_GeomFromEWKT($9))`
+	_, err := p.db.Exec(insertQuery, stop.ID, stop.Name, stop.Lat, stop.Lon, stop.LocationType,
+		stop.ParentStation, stop.Radius, ewkt(stop.Lat, stop.Lon), ewktPolygon(stop.Geofence))
+	return err
+}
+
+// InsertTrace adds a GPS trace
+func (p *pgStore) InsertTrace(trace Trace) error {
+	insertQuery := `INSERT INTO traces (box_id, timestamp, lat, lon, bearing, speed, geom)
+	VALUES ($1, $2, $3, $4, $5, $6, ST_GeomFromEWKT($7))`
+	_, err := p.db.Exec(insertQuery, trace.BoxID, trace.Timestamp, trace.Lat, trace.Lon,
+		trace.Bearing, trace.Speed, ewkt(trace.Lat, trace.Lon))
+	return err
+}
 
-	stmt, err := h.db.Prepare(insertQuery)
+// InsertStops adds stops with COPY
+func (p *pgStore) InsertStops(stops []Stop) error {
+	columns := []string{"stop_id", "stop_name", "stop_lat", "stop_lon", "location_type", "parent_station",
+		"radius", "geom", "geofence"}
+	return p.copyIn("stops", columns,
+		len(stops), func(ind int) []interface{} {
+			stop := stops[ind]
+			return []interface{}{stop.ID, stop.Name, stop.Lat, stop.Lon, stop.LocationType,
+				stop.ParentStation, stop.Radius, ewkt(stop.Lat, stop.Lon), ewktPolygon(stop.Geofence)}
+		})
+}
+
+// InsertTraces adds traces with COPY
+func (p *pgStore) InsertTraces(traces []Trace) error {
+	return p.copyIn("traces", []string{"box_id", "timestamp", "lat", "lon", "bearing", "speed", "geom"},
+		len(traces), func(ind int) []interface{} {
+			trace := traces[ind]
+			return []interface{}{trace.BoxID, trace.Timestamp, trace.Lat, trace.Lon,
+				trace.Bearing, trace.Speed, ewkt(trace.Lat, trace.Lon)}
+		})
+}
+
+// copyIn loads n rows into table with COPY in a transaction
+func (p *pgStore) copyIn(table string, columns []string, n int, row func(ind int) []interface{}) error {
+	tx, err := p.db.Begin()
 	if err != nil {
 		return err
 	}
-	t2, _ := time.Parse(time.RFC3339, st.Departure)
-	t1, _ := time.Parse(time.RFC3339, st.Arrival)
-	duration := t2.Sub(t1)
-	_, err = stmt.Exec(st.BoxID, st.StopID, st.Direction,
-		st.Sequence, t1.In(bkk).Format(time.RFC3339), int(duration.Seconds()))
-	return err
+	stmt, err := tx.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for ind := 0; ind < n; ind++ {
+		if _, err := stmt.Exec(row(ind)...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ewkt gives point geometry text which postgis accepts as input
+func ewkt(lat float64, lon float64) string {
+	return fmt.Sprintf("SRID=4326;POINT(%f %f)", lon, lat)
+}
+
+// MissingStops returns stop_id(s) which are not in stops table
+func (p *pgStore) MissingStops(ids []string) ([]string, error) {
+	rows, err := p.db.Query(`SELECT stop_id FROM stops WHERE stop_id = ANY($1::text[])`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := make(map[string]bool, len(ids))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[s.TrimSpace(id)] = true
+	}
+	missing := []string{}
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing, rows.Err()
+}
+
+// UpsertRouteStops replaces stop pattern of a route in stop_and_route.
+// Sequence starts from 1 as in the order of given stops.
+func (p *pgStore) UpsertRouteStops(route string, stops []RouteStopInput) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(stops))
+	for ind, ele := range stops {
+		ids[ind] = ele.StopID
+	}
+	old, err := routeStopInputs(tx, route)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !sameRouteStops(old, stops) {
+		// the reverse is made from the route if it has no stops
+		_, err = tx.Exec(`DELETE FROM segment_profiles WHERE direction = ANY($1::text[])`,
+			pq.Array([]string{route, fmt.Sprintf("%s-rev", route)}))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// drop stops which are no longer in this route
+	_, err = tx.Exec(`DELETE FROM stop_and_route
+		WHERE route_id = $1 AND NOT (stop_id = ANY($2::text[]))`, route, pq.Array(ids))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	upsertQuery := `INSERT INTO stop_and_route (route_id, stop_id, sequence, is_terminal)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (route_id, stop_id)
+		DO UPDATE SET sequence = EXCLUDED.sequence, is_terminal = EXCLUDED.is_terminal`
+	for ind, ele := range stops {
+		_, err = tx.Exec(upsertQuery, route, ele.StopID, ind+1, ele.IsTerminal)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
+// routeStopInputs gives stop pattern of a route in order
+func routeStopInputs(tx *sql.Tx, route string) ([]RouteStopInput, error) {
+	rows, err := tx.Query(`SELECT stop_id, COALESCE(is_terminal,false) FROM stop_and_route
+		WHERE route_id = $1 ORDER BY sequence ASC`, route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stops []RouteStopInput
+	for rows.Next() {
+		var stop RouteStopInput
+		if err := rows.Scan(&stop.StopID, &stop.IsTerminal); err != nil {
+			return nil, err
+		}
+		stop.StopID = s.TrimSpace(stop.StopID)
+		stops = append(stops, stop)
+	}
+	return stops, rows.Err()
 }
 
-// FlushDatabase - to regenerate GEOM from lat, lon to work with POSTGIS
-func (h *Handler) FlushDatabase() error {
-	updateQuery := `DROP TABLE stops; DROP TABLE stop_and_route; DROP TABLE traces; DROP TABLE stop_times;`
-	_, err := h.db.Exec(updateQuery)
+// Flush - to drop all and create new tables
+func (p *pgStore) Flush() error {
+	updateQuery := `DROP TABLE stops; DROP TABLE stop_and_route; DROP TABLE traces; DROP TABLE stop_times;
+		DROP TABLE IF EXISTS route_paths; DROP TABLE IF EXISTS segment_profiles;`
+	_, err := p.db.Exec(updateQuery)
 	CheckError("Flush 01", err)
-	err = h.createStopTable()
+	err = p.createStopTable()
 	CheckError("Flush 02", err)
-	err = h.createStopRouteTable()
+	err = p.createStopRouteTable()
 	CheckError("Flush 03", err)
-	err = h.createTraceTable()
+	err = p.createTraceTable()
 	CheckError("Flush 04", err)
-	err = h.createStopTimeTable()
+	err = p.createStopTimeTable()
 	CheckError("Flush 05", err)
+	err = p.createRoutePathTable()
+	CheckError("Flush 06", err)
+	err = p.createSegmentProfileTable()
+	CheckError("Flush 07", err)
 	return err
 }
 
 // GeomRegenerate - to regenerate GEOM from lat, lon to work with POSTGIS
-func (h *Handler) GeomRegenerate() error {
+func (p *pgStore) GeomRegenerate() error {
 	updateQuery := `UPDATE traces SET geom = ST_SETSRID(ST_MakePoint(lon, lat), 4326);
 		UPDATE stops SET geom = ST_SETSRID(ST_MakePoint(stop_lon, stop_lat), 4326);`
-	_, err := h.db.Exec(updateQuery)
+	_, err := p.db.Exec(updateQuery)
 	return err
 }
 
-// InitDB - to ensure if tables are created
-func (h *Handler) InitDB() error {
+// Init - to ensure if tables are created
+func (p *pgStore) Init() error {
 
-	_, err := h.db.Exec("CREATE EXTENSION postgis")
+	_, err := p.db.Exec("CREATE EXTENSION postgis")
 	CheckError("Create POSTGIS extension error", err)
-	err = h.createStopTable()
-	successTable := 4
+	err = p.createStopTable()
+	successTable := 6
 	if err != nil {
 		successTable--
 		fmt.Print("stops table: ", err)
 	}
-	err = h.createStopRouteTable()
+	err = p.createStopRouteTable()
 	if err != nil {
 		successTable--
 		fmt.Print("stop_and_route table: ", err)
 	}
-	err = h.createTraceTable()
+	err = p.createTraceTable()
 	if err != nil {
 		successTable--
 		fmt.Print("traces table: ", err)
 	}
-	err = h.createStopTimeTable()
+	err = p.createStopTimeTable()
 	if err != nil {
 		successTable--
 		fmt.Print("stop_times table: ", err)
 	}
+	err = p.createRoutePathTable()
+	if err != nil {
+		successTable--
+		fmt.Print("route_paths table: ", err)
+	}
+	err = p.createSegmentProfileTable()
+	if err != nil {
+		successTable--
+		fmt.Print("segment_profiles table: ", err)
+	}
 	if successTable == 0 {
 		return err
 	}
 	return nil
 }
 
-// ItemCount is a shorthand for counting item in asking table
-func (h *Handler) ItemCount(tbl string) (int, string) {
+// Count is a shorthand for counting item in asking table
+func (p *pgStore) Count(tbl string) (int, error) {
 	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", tbl)
 	var count int
-	err := h.db.QueryRow(query).Scan(&count)
+	err := p.db.QueryRow(query).Scan(&count)
 	if err, ok := err.(*pq.Error); ok {
 		if err.Code.Name() == "undefined_table" {
 			// it is not yet created
 			if tbl == "stops" {
-				err := h.createStopTable()
+				err := p.createStopTable()
 				CheckError("create DB error", err)
-				err = h.createStopRouteTable()
+				err = p.createStopRouteTable()
 				CheckError("create DB error", err)
 			} else if tbl == "traces" {
-				err := h.createTraceTable()
+				err := p.createTraceTable()
 				CheckError("create DB error", err)
 			} else if tbl == "stop_times" {
-				err := h.createStopTimeTable()
+				err := p.createStopTimeTable()
 				CheckError("create DB error", err)
 			}
-			return -10, "undefined_table"
+			return 0, errUndefinedTable
 		}
-		return -1, "db error"
+		return 0, err
 	}
-	return count, "ok"
+	return count, err
 }
 
-// queryStops return stops in order mannerly
-func (h *Handler) queryStops(route string, order string, onlyTerminal bool) (rows *sql.Rows, err error) {
+// RouteStops return stops in order mannerly
+func (p *pgStore) RouteStops(route string, order string, onlyTerminal bool) ([]Stop, error) {
 	if order != "ASC" {
 		order = "DESC"
 	}
 	where := []string{}
+	args := []interface{}{}
 	if len(route) > 0 {
-		where = append(where, fmt.Sprintf("route_id = '%s'", route))
+		args = append(args, route)
+		where = append(where, fmt.Sprintf("route_id = $%d", len(args)))
 	}
 	if onlyTerminal {
 		where = append(where, "is_terminal=TRUE")
@@ -233,56 +477,319 @@ func (h *Handler) queryStops(route string, order string, onlyTerminal bool) (row
 	if len(where) > 0 {
 		whereStmt = fmt.Sprintf("WHERE %s", s.Join(where, " AND "))
 	}
-	fieldOrder := `sr.stop_id,sr.sequence,s.stop_name,s.stop_lat,s.stop_lon,sr.is_terminal,s.location_type,s.parent_station`
+	fieldOrder := `sr.stop_id,sr.sequence,COALESCE(s.stop_name,''),s.stop_lat,s.stop_lon,sr.is_terminal,
+		COALESCE(s.location_type,0),COALESCE(s.parent_station::text,''),
+		COALESCE(s.radius,0),COALESCE(ST_AsGeoJSON(s.geofence),'')`
 	query := fmt.Sprintf(`SELECT %s FROM stop_and_route sr
 		LEFT JOIN stops s ON sr.stop_id = s.stop_id
 		%s
 		ORDER BY sr.sequence %s`, fieldOrder, whereStmt, order)
-	return h.db.Query(query)
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stops []Stop
+	for rows.Next() {
+		var (
+			stop     Stop
+			geofence string
+		)
+		err := rows.Scan(&stop.ID, &stop.Sequence, &stop.Name, &stop.Lat, &stop.Lon,
+			&stop.IsTerminal, &stop.LocationType, &stop.ParentStation, &stop.Radius, &geofence)
+		if err != nil {
+			return nil, err
+		}
+		if stop.Geofence, err = geoJSONPolygon(geofence); err != nil {
+			return nil, err
+		}
+		stop.ID = s.TrimSpace(stop.ID)
+		stop.Name = s.TrimSpace(stop.Name)
+		stops = append(stops, stop)
+	}
+	return stops, rows.Err()
 }
 
-// queryTraces return stops in order mannerly
-func (h *Handler) queryTraces(where string, order string) (rows *sql.Rows, err error) {
-	if order != "DESC" {
-		order = "ASC"
+// TracesNear returns traces inside the sphere (or geofence) of any stop
+func (p *pgStore) TracesNear(stops []Stop, radius float64) ([]Trace, error) {
+	tmpl := "ST_DistanceSphere(geom, ST_MakePoint(%f,%f)) <= %d"
+	whereArr := make([]string, len(stops))
+	for ind, stop := range stops {
+		if polygon := ewktPolygon(stop.Geofence); polygon != nil {
+			whereArr[ind] = fmt.Sprintf("ST_Within(geom, ST_GeomFromEWKT('%s'))", polygon)
+			continue
+		}
+		distance := int(radius * 1000)
+		if stop.Radius > 0 {
+			distance = int(stop.Radius)
+		}
+		whereArr[ind] = fmt.Sprintf(tmpl, stop.Lon, stop.Lat, distance)
 	}
-	if len(where) > 0 && s.Index(where, "WHERE") == -1 {
+	return p.queryTraces(s.Join(whereArr, " OR "))
+}
+
+// TracesBetween returns traces of a box in the period
+func (p *pgStore) TracesBetween(boxID string, start string, end string) ([]Trace, error) {
+	return p.queryTraces("box_id = $1 AND timestamp >= $2 AND timestamp <= $3", boxID, start, end)
+}
+
+// queryTraces return traces in order of box and time
+func (p *pgStore) queryTraces(where string, args ...interface{}) ([]Trace, error) {
+	if len(where) > 0 {
 		where = fmt.Sprintf("WHERE %s", where)
 	}
-	fields := `box_id,timestamp,lat,lon`
-	quertStmt := `SELECT %s FROM traces %s ORDER BY box_id ASC, timestamp %s`
-	query := fmt.Sprintf(quertStmt, fields, where, order)
-	return h.db.Query(query)
+	fields := `box_id,timestamp,lat,lon,bearing,speed`
+	quertStmt := `SELECT %s FROM traces %s ORDER BY box_id ASC, timestamp ASC`
+	query := fmt.Sprintf(quertStmt, fields, where)
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var traces []Trace
+	for rows.Next() {
+		var (
+			trace          Trace
+			bearing, speed sql.NullFloat64
+		)
+		if err := rows.Scan(&trace.BoxID, &trace.Timestamp, &trace.Lat, &trace.Lon, &bearing, &speed); err != nil {
+			return nil, err
+		}
+		if bearing.Valid {
+			trace.Bearing = &bearing.Float64
+		}
+		if speed.Valid {
+			trace.Speed = &speed.Float64
+		}
+		trace.BoxID = s.TrimSpace(trace.BoxID)
+		traces = append(traces, trace)
+	}
+	return traces, rows.Err()
 }
 
-func (h *Handler) queryStopTime(where string, order string) (rows *sql.Rows, err error) {
-	if order != "DESC" {
-		order = "ASC"
+// StopTimes return stop_times ordered by direction and arrival
+func (p *pgStore) StopTimes(filter StopTimeFilter) ([]StopTime, error) {
+	args := &sqlArgs{}
+	where := stopTimeConditions(filter, args)
+	if len(filter.StopID) > 0 {
+		where = append(where, fmt.Sprintf("stop_id = %s", args.add(filter.StopID)))
 	}
-	if len(where) > 0 && s.Index(where, "WHERE") == -1 {
-		where = fmt.Sprintf("WHERE %s", where)
+	if len(filter.Source) > 0 {
+		where = append(where, fmt.Sprintf("source = %s", args.add(filter.Source)))
+	}
+	if filter.byTrip() {
+		where = append(where, fmt.Sprintf("trip_id IN (%s)", tripQuery(filter, args, true)))
+	}
+	whereStmt := ""
+	if len(where) > 0 {
+		whereStmt = fmt.Sprintf("WHERE %s", s.Join(where, " AND "))
+	}
+	fieldOrder := `COALESCE(trip_id,''),box_id,stop_id,direction,sequence,arrival,stop_duration,
+		COALESCE(source,''),COALESCE(confidence,0)`
+	query := fmt.Sprintf(`SELECT %s FROM stop_times %s ORDER BY direction ASC, arrival ASC`, fieldOrder, whereStmt)
+	rows, err := p.db.Query(query, *args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []StopTime
+	for rows.Next() {
+		var st StopTime
+		err := rows.Scan(&st.TripID, &st.BoxID, &st.StopID, &st.Direction,
+			&st.Sequence, &st.Arrival, &st.StopDuration, &st.Source, &st.Confidence)
+		if err != nil {
+			return nil, err
+		}
+		st.TripID = s.TrimSpace(st.TripID)
+		st.BoxID = s.TrimSpace(st.BoxID)
+		st.StopID = s.TrimSpace(st.StopID)
+		st.Direction = s.TrimSpace(st.Direction)
+		st.Source = s.TrimSpace(st.Source)
+		result = append(result, st)
 	}
-	fieldOrder := `box_id,stop_id,direction,sequence,arrival,stop_duration`
-	query := fmt.Sprintf(`SELECT %s FROM stop_times %s ORDER BY direction ASC, arrival %s`, fieldOrder, where, order)
-	return h.db.Query(query)
+	return result, rows.Err()
 }
 
-func (h *Handler) getDistinctDirection() []string {
-	var directions []string
-	query := fmt.Sprintf("SELECT DISTINCT(direction) FROM stop_times ORDER BY direction ASC")
-	rows, err := h.db.Query(query)
+// CountTrips returns number of trips in stop_times
+func (p *pgStore) CountTrips(filter StopTimeFilter) (int, error) {
+	args := &sqlArgs{}
+	query := fmt.Sprintf("SELECT count(*) FROM (%s) AS trips", tripQuery(filter, args, false))
+	count := 0
+	err := p.db.QueryRow(query, *args...).Scan(&count)
+	return count, err
+}
+
+// sqlArgs are arguments of a query
+type sqlArgs []interface{}
+
+// add gives placeholder of a new argument
+func (a *sqlArgs) add(value interface{}) string {
+	*a = append(*a, value)
+	return fmt.Sprintf("$%d", len(*a))
+}
+
+// stopTimeConditions gives conditions on stop_times rows of trips,
+// stop_id is not one of them as a trip has many stops
+func stopTimeConditions(filter StopTimeFilter, args *sqlArgs) []string {
+	where := []string{}
+	add := func(field string, value string) {
+		if len(value) > 0 {
+			where = append(where, fmt.Sprintf("%s = %s", field, args.add(value)))
+		}
+	}
+	add("direction", filter.Direction)
+	add("box_id", filter.BoxID)
+	add("trip_id", filter.TripID)
+	if len(filter.Directions) > 0 {
+		where = append(where, fmt.Sprintf("direction = ANY(%s::text[])", args.add(pq.Array(filter.Directions))))
+	}
+	return where
+}
+
+// tripQuery gives trip_id of trips of the filter ordered by start,
+// a page of them if paged
+func tripQuery(filter StopTimeFilter, args *sqlArgs, paged bool) string {
+	where := append([]string{"trip_id <> ''"}, stopTimeConditions(filter, args)...)
+	having := []string{"true"}
+	if !filter.From.IsZero() {
+		having = append(having, fmt.Sprintf("min(arrival) >= %s", args.add(filter.From)))
+	}
+	if !filter.To.IsZero() {
+		having = append(having, fmt.Sprintf("min(arrival) < %s", args.add(filter.To)))
+	}
+	if len(filter.Weekday) > 0 {
+		having = append(having, fmt.Sprintf("to_char(min(arrival) AT TIME ZONE %s, 'Dy') = %s",
+			args.add(filter.location().String()), args.add(filter.Weekday)))
+	}
+	query := fmt.Sprintf(`SELECT trip_id FROM stop_times WHERE %s
+		GROUP BY trip_id HAVING %s ORDER BY min(arrival) ASC, trip_id ASC`,
+		s.Join(where, " AND "), s.Join(having, " AND "))
+	if paged && filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %s", args.add(filter.Limit))
+	}
+	if paged && filter.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %s", args.add(filter.Offset))
+	}
+	return query
+}
+
+// Routes returns distinct route_id in stop_and_route
+func (p *pgStore) Routes() ([]string, error) {
+	var routes []string
+	rows, err := p.db.Query("SELECT DISTINCT(route_id) FROM stop_and_route ORDER BY route_id ASC")
 	if err != nil {
-		log.Fatal("get distinct direction error", err)
+		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var direction string
-		rows.Scan(&direction)
-		directions = append(directions, direction)
+		var route string
+		if err := rows.Scan(&route); err != nil {
+			return nil, err
+		}
+		routes = append(routes, s.TrimSpace(route))
 	}
-	return directions
+	return routes, rows.Err()
 }
 
-func (h *Handler) getStopTimes(where string, order string) []StopTime {
-	var result []StopTime
-	return result
+// RoutePath returns path of a route in order
+func (p *pgStore) RoutePath(route string) ([]ShapePoint, error) {
+	rows, err := p.db.Query(`SELECT lat, lon FROM route_paths
+		WHERE route_id = $1 ORDER BY sequence ASC`, route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var points []ShapePoint
+	for rows.Next() {
+		var pnt ShapePoint
+		if err := rows.Scan(&pnt.Lat, &pnt.Lon); err != nil {
+			return nil, err
+		}
+		points = append(points, pnt)
+	}
+	return points, rows.Err()
+}
+
+// UpsertRoutePath replaces path of a route
+func (p *pgStore) UpsertRoutePath(route string, points []ShapePoint) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM route_paths WHERE route_id = $1`, route)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for ind, pnt := range points {
+		_, err = tx.Exec(`INSERT INTO route_paths (route_id, sequence, lat, lon)
+			VALUES ($1, $2, $3, $4)`, route, ind+1, pnt.Lat, pnt.Lon)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SegmentProfiles returns profile of a direction ordered by sequence
+func (p *pgStore) SegmentProfiles(direction string) ([]SegmentProfile, error) {
+	rows, err := p.db.Query(`SELECT sequence, travel, travel_samples, dwell, dwell_samples
+		FROM segment_profiles WHERE direction = $1 ORDER BY sequence ASC`, direction)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var profiles []SegmentProfile
+	for rows.Next() {
+		profile := SegmentProfile{Direction: direction}
+		if err := rows.Scan(&profile.Sequence, &profile.Travel, &profile.TravelSamples,
+			&profile.Dwell, &profile.DwellSamples); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
+
+// UpsertSegmentProfiles replaces profile of a direction
+func (p *pgStore) UpsertSegmentProfiles(direction string, profiles []SegmentProfile) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM segment_profiles WHERE direction = $1`, direction)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, profile := range profiles {
+		_, err = tx.Exec(`INSERT INTO segment_profiles
+			(direction, sequence, travel, travel_samples, dwell, dwell_samples)
+			VALUES ($1, $2, $3, $4, $5, $6)`, direction, profile.Sequence,
+			profile.Travel, profile.TravelSamples, profile.Dwell, profile.DwellSamples)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Directions returns distinct direction in stop_times
+func (p *pgStore) Directions() ([]string, error) {
+	var directions []string
+	rows, err := p.db.Query("SELECT DISTINCT(direction) FROM stop_times ORDER BY direction ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var direction string
+		if err := rows.Scan(&direction); err != nil {
+			return nil, err
+		}
+		directions = append(directions, s.TrimSpace(direction))
+	}
+	return directions, rows.Err()
 }
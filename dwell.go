@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	dwellTerminal  = "terminal"
+	dwellPassenger = "passenger"
+	// dwellMaxLayover (second) at a terminal, the box is off duty if
+	// its next trip starts later than this
+	dwellMaxLayover = 3600
+)
+
+type (
+	// StopDwell is dwell time (second) at a stop of a direction in an
+	// hour band, dwell at the first and last stop is terminal layover
+	StopDwell struct {
+		Direction string `json:"direction"`
+		Sequence  int    `json:"sequence"`
+		StopID    string `json:"stop_id"`
+		Band      string `json:"band"`
+		Kind      string `json:"kind"`
+		DurationStats
+	}
+
+	// LongDwell is a passenger stop longer than long_dwell
+	LongDwell struct {
+		TripID    string `json:"trip_id"`
+		BoxID     string `json:"box_id"`
+		Direction string `json:"direction"`
+		Sequence  int    `json:"sequence"`
+		StopID    string `json:"stop_id"`
+		Arrival   string `json:"arrival"`
+		Dwell     int    `json:"dwell"`
+	}
+
+	// DwellReport is dwell time of all stops
+	DwellReport struct {
+		Stops      []StopDwell `json:"stops"`
+		LongDwells []LongDwell `json:"long_dwells"`
+	}
+)
+
+// dwellStats computes distribution of stop_duration by stop and hour
+// band of arrival. Empty direction or weekday means all.
+func (h *Handler) dwellStats(direction string, weekday string) (DwellReport, error) {
+	report := DwellReport{Stops: []StopDwell{}, LongDwells: []LongDwell{}}
+	// all directions as the next trip of a box is often the reverse one
+	stopTimes, err := h.store.StopTimes(StopTimeFilter{})
+	if err != nil {
+		return report, err
+	}
+	// the last stop of each direction is a terminal too
+	lastSequence := make(map[string]int)
+	for _, st := range stopTimes {
+		if st.Sequence > lastSequence[st.Direction] {
+			lastSequence[st.Direction] = st.Sequence
+		}
+	}
+	// layover at the last stop is until the next trip of the box
+	// departs from there, stop_duration only covers the last fix. The
+	// first stop of the next trip is in that layover, so it is not
+	// counted again.
+	layovers, followed := layoverAfter(observedRuns(stopTimes))
+	samples := make(map[StopDwell][]float64)
+	for _, st := range stopTimes {
+		// stop_duration of an estimated stop is not a dwell
+		if (len(direction) > 0 && st.Direction != direction) || st.Source != sourceObserved {
+			continue
+		}
+		if st.Sequence == 0 && followed[st.TripID] {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, st.Arrival)
+		if err != nil {
+			continue
+		}
+		t = t.In(h.loc)
+		if len(weekday) > 0 && h.serviceDay(st.Arrival).Format("Mon") != weekday {
+			continue
+		}
+		key := StopDwell{
+			Direction: st.Direction,
+			Sequence:  st.Sequence + 1,
+			StopID:    st.StopID,
+			Band:      h.hourBand(t),
+			Kind:      dwellPassenger,
+		}
+		if st.Sequence == 0 || st.Sequence == lastSequence[st.Direction] {
+			key.Kind = dwellTerminal
+		} else if st.StopDuration > h.stats.LongDwell {
+			report.LongDwells = append(report.LongDwells, LongDwell{
+				TripID:    st.TripID,
+				BoxID:     st.BoxID,
+				Direction: st.Direction,
+				Sequence:  st.Sequence + 1,
+				StopID:    st.StopID,
+				Arrival:   t.Format(time.RFC3339),
+				Dwell:     st.StopDuration,
+			})
+		}
+		dwell := float64(st.StopDuration)
+		if layover, ok := layovers[st.TripID]; ok && key.Kind == dwellTerminal && st.Sequence > 0 {
+			dwell = float64(layover)
+		}
+		samples[key] = append(samples[key], dwell)
+	}
+	for key, values := range samples {
+		stop := key
+		stop.DurationStats = durationStats(values)
+		report.Stops = append(report.Stops, stop)
+	}
+	sort.Slice(report.Stops, func(i, j int) bool {
+		a, b := report.Stops[i], report.Stops[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.Sequence != b.Sequence {
+			return a.Sequence < b.Sequence
+		}
+		return a.Band < b.Band
+	})
+	sort.SliceStable(report.LongDwells, func(i, j int) bool {
+		return arrivalBefore(report.LongDwells[i].Arrival, report.LongDwells[j].Arrival)
+	})
+	return report, nil
+}
+
+// layoverAfter gives seconds from arrival at the last stop of a trip to
+// departure of the next trip of the same box from the same stop, and
+// the next trips which start in such a layover
+func layoverAfter(runs []FeedTrip) (map[string]int, map[string]bool) {
+	byBox := make(map[string][]FeedTrip)
+	for _, run := range runs {
+		byBox[run.StopTimes[0].BoxID] = append(byBox[run.StopTimes[0].BoxID], run)
+	}
+	layovers := make(map[string]int)
+	followed := make(map[string]bool)
+	for _, boxRuns := range byBox {
+		sort.Slice(boxRuns, func(i, j int) bool {
+			return arrivalBefore(boxRuns[i].StopTimes[0].Arrival, boxRuns[j].StopTimes[0].Arrival)
+		})
+		for ind := 1; ind < len(boxRuns); ind++ {
+			prev := boxRuns[ind-1].StopTimes[len(boxRuns[ind-1].StopTimes)-1]
+			next := boxRuns[ind].StopTimes[0]
+			if prev.StopID != next.StopID || prev.Source != sourceObserved || next.Source != sourceObserved {
+				continue
+			}
+			layover := int(durationBetween(prev.Arrival, next.Departure).Seconds())
+			if layover >= 0 && layover <= dwellMaxLayover {
+				layovers[boxRuns[ind-1].TripID] = layover
+				followed[boxRuns[ind].TripID] = true
+			}
+		}
+	}
+	return layovers, followed
+}
+
+// DwellReporter prints dwell time of each stop and writes dwell.csv
+// and long_dwells.csv into output directory
+func (h *Handler) DwellReporter(direction string) {
+	report, err := h.dwellStats(direction, h.day)
+	CheckError("Cannot read stop_times ", err)
+	if len(report.Stops) == 0 {
+		fmt.Println("No stop_times, run gen first")
+		return
+	}
+	prev := ""
+	for _, stop := range report.Stops {
+		if stop.Direction != prev {
+			prev = stop.Direction
+			fmt.Printf("\n%s\n", stop.Direction)
+			fmt.Printf("  %-3s %-10s %-11s %-9s %4s %6s %6s %6s %6s %6s\n",
+				"#", "stop_id", "band", "kind", "n", "mean", "median", "p95", "min", "max")
+		}
+		fmt.Printf("  %-3d %-10.10s %-11s %-9s %4d %6.0f %6.0f %6.0f %6.0f %6.0f\n",
+			stop.Sequence, stop.StopID, stop.Band, stop.Kind, stop.Count,
+			stop.Mean, stop.Median, stop.P95, stop.Min, stop.Max)
+	}
+	fmt.Printf("\n%d dwell(s) longer than %d s\n", len(report.LongDwells), h.stats.LongDwell)
+	for _, dwell := range report.LongDwells {
+		h.LogPrint(fmt.Sprintf("  %s %s #%d %s %s %d s\n", dwell.Direction, dwell.TripID,
+			dwell.Sequence, dwell.StopID, h.hhmm(dwell.Arrival), dwell.Dwell))
+	}
+
+	// make sure we have "output"
+	_ = os.Mkdir(h.outputDir, 0755)
+	h.DwellExporter(report)
+	fmt.Printf("dwell time: %s/dwell.csv, %s/long_dwells.csv\n", h.outputDir, h.outputDir)
+}
+
+// DwellExporter will give dwell.csv and long_dwells.csv
+func (h *Handler) DwellExporter(report DwellReport) {
+	file, err := os.Create(fmt.Sprintf("%s/dwell.csv", h.outputDir))
+	CheckError("cannot create file", err)
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+	// header
+	headerRow := []string{
+		"direction", "stop_sequence", "stop_id", "band", "kind", "count",
+		"mean", "median", "p85", "p95", "min", "max"}
+	err = writer.Write(headerRow)
+	CheckError("Cannot write to file [dwe0] ", err)
+	for _, stop := range report.Stops {
+		row := []string{
+			stop.Direction,
+			fmt.Sprintf("%d", stop.Sequence),
+			stop.StopID,
+			stop.Band,
+			stop.Kind,
+			fmt.Sprintf("%d", stop.Count),
+			fmt.Sprintf("%.1f", stop.Mean),
+			fmt.Sprintf("%.1f", stop.Median),
+			fmt.Sprintf("%.1f", stop.P85),
+			fmt.Sprintf("%.1f", stop.P95),
+			fmt.Sprintf("%.0f", stop.Min),
+			fmt.Sprintf("%.0f", stop.Max),
+		}
+		err = writer.Write(row)
+		CheckError("Cannot write to file [dwe1] ", err)
+	}
+
+	longFile, err := os.Create(fmt.Sprintf("%s/long_dwells.csv", h.outputDir))
+	CheckError("cannot create file", err)
+	defer longFile.Close()
+	longWriter := csv.NewWriter(longFile)
+	defer longWriter.Flush()
+	headerRow = []string{
+		"trip_id", "box_id", "direction", "stop_sequence", "stop_id",
+		"arrival", "dwell"}
+	err = longWriter.Write(headerRow)
+	CheckError("Cannot write to file [dwe2] ", err)
+	for _, dwell := range report.LongDwells {
+		row := []string{
+			dwell.TripID,
+			dwell.BoxID,
+			dwell.Direction,
+			fmt.Sprintf("%d", dwell.Sequence),
+			dwell.StopID,
+			dwell.Arrival,
+			fmt.Sprintf("%d", dwell.Dwell),
+		}
+		err = longWriter.Write(row)
+		CheckError("Cannot write to file [dwe3] ", err)
+	}
+}
+
+// DwellStatsHandler gives dwell time statistics, filtered by direction
+// and weekday (Mon, Tue, ...)
+func (h *Handler) DwellStatsHandler(c echo.Context) error {
+	weekday := c.QueryParam("weekday")
+	if len(weekday) > 0 {
+		if _, err := time.Parse("Mon", weekday); err != nil {
+			return c.JSON(http.StatusBadRequest, Result{Message: fmt.Sprintf("weekday: %s is not Mon, Tue, ...", weekday)})
+		}
+	}
+	report, err := h.dwellStats(c.QueryParam("direction"), weekday)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	s "strings"
+	"time"
+)
+
+type (
+	// FeedFrequency is a row of frequencies.txt, times are seconds
+	// since the service day
+	FeedFrequency struct {
+		TripID      string
+		StartTime   int
+		EndTime     int
+		HeadwaySecs int
+		ExactTimes  bool
+	}
+
+	// headwayPeriod is consecutive time bands of regular headway
+	headwayPeriod struct {
+		firstBand int
+		lastBand  int
+		headways  []int
+		// runs are indexes of runs in the group making the headways
+		runs map[int]bool
+	}
+)
+
+// synthesizeFrequencies turns observed runs into template trips of
+// periods with regular headway and planned trips (as -mode timetable)
+// for the runs left over
+func (h *Handler) synthesizeFrequencies(runs []FeedTrip) ([]FeedTrip, []FeedFrequency) {
+	groupKeys, groups := h.groupRuns(runs)
+	numDates := countServiceDates(groups)
+	planned := []FeedTrip{}
+	frequencies := []FeedFrequency{}
+	seenIDs := make(map[string]int)
+	for _, key := range groupKeys {
+		group := groups[key]
+		covered := make([]bool, len(group))
+		groupFrequencies := []FeedFrequency{}
+		for _, period := range h.headwayPeriods(group) {
+			cluster := []timetableRun{}
+			for ind := range group {
+				// a run between 2 periods belongs to the first one
+				if period.runs[ind] && !covered[ind] {
+					covered[ind] = true
+					cluster = append(cluster, group[ind])
+				}
+			}
+			if len(cluster) < 2 {
+				continue
+			}
+			headway := medianInt(period.headways)
+			if headway >= 60 {
+				headway = (headway + 30) / 60 * 60
+			}
+			start, perDate := periodStart(cluster)
+			trip := templateTrip(cluster, start)
+			trip.TripID = uniqueTripID(fmt.Sprintf("%s__%s_F%s",
+				trip.StopTimes[0].Direction, trip.ServiceID,
+				s.Replace(secondsToHHMM(start), ":", "", 1)), seenIDs)
+			for ind := range trip.StopTimes {
+				trip.StopTimes[ind].TripID = trip.TripID
+			}
+			planned = append(planned, trip)
+			groupFrequencies = append(groupFrequencies, FeedFrequency{
+				TripID:      trip.TripID,
+				StartTime:   start,
+				EndTime:     start + perDate*headway,
+				HeadwaySecs: headway,
+				ExactTimes:  h.gtfs.FrequencyExactTimes,
+			})
+		}
+		// periods of a direction and service can't overlap
+		sort.Slice(groupFrequencies, func(i, j int) bool {
+			return groupFrequencies[i].StartTime < groupFrequencies[j].StartTime
+		})
+		for ind := 1; ind < len(groupFrequencies); ind++ {
+			if prev := &groupFrequencies[ind-1]; prev.EndTime > groupFrequencies[ind].StartTime {
+				prev.EndTime = groupFrequencies[ind].StartTime
+			}
+		}
+		for _, freq := range groupFrequencies {
+			h.LogPrint(fmt.Sprintf("frequency %s: %s-%s every %ds\n", freq.TripID,
+				secondsToHHMM(freq.StartTime), secondsToHHMM(freq.EndTime), freq.HeadwaySecs))
+		}
+		frequencies = append(frequencies, groupFrequencies...)
+
+		rest := []timetableRun{}
+		for ind, run := range group {
+			if !covered[ind] {
+				rest = append(rest, run)
+			}
+		}
+		planned = append(planned, h.plannedTrips(rest, numDates[serviceKey(key)], seenIDs)...)
+	}
+	return planned, frequencies
+}
+
+// headwayPeriods finds time bands where headways between runs of the
+// same day are regular enough and merges neighbour bands of about the
+// same headway. A headway belongs to the band of the later run.
+func (h *Handler) headwayPeriods(group []timetableRun) []headwayPeriod {
+	bandSecs := int(h.gtfs.FrequencyBand * 60)
+	if bandSecs <= 0 {
+		bandSecs = 3600
+	}
+	bands := make(map[int]*headwayPeriod)
+	lastOfDate := make(map[string]int)
+	for ind, run := range group {
+		prev, ok := lastOfDate[run.date]
+		lastOfDate[run.date] = ind
+		if !ok {
+			continue
+		}
+		band := run.departure / bandSecs
+		if bands[band] == nil {
+			bands[band] = &headwayPeriod{firstBand: band, lastBand: band, runs: make(map[int]bool)}
+		}
+		bands[band].headways = append(bands[band].headways, run.departure-group[prev].departure)
+		bands[band].runs[prev] = true
+		bands[band].runs[ind] = true
+	}
+	bandIDs := []int{}
+	for band, period := range bands {
+		if len(period.headways) >= h.gtfs.FrequencyMinHeadways &&
+			coefficientOfVariation(period.headways) <= h.gtfs.FrequencyMaxCV {
+			bandIDs = append(bandIDs, band)
+		}
+	}
+	sort.Ints(bandIDs)
+
+	periods := []headwayPeriod{}
+	for _, band := range bandIDs {
+		period := bands[band]
+		if len(periods) > 0 {
+			last := &periods[len(periods)-1]
+			a, b := float64(medianInt(last.headways)), float64(medianInt(period.headways))
+			if last.lastBand == band-1 && math.Abs(a-b) <= h.gtfs.FrequencyMaxCV*math.Min(a, b) {
+				last.lastBand = band
+				last.headways = append(last.headways, period.headways...)
+				for ind := range period.runs {
+					last.runs[ind] = true
+				}
+				continue
+			}
+		}
+		periods = append(periods, *period)
+	}
+	return periods
+}
+
+// periodStart gives the median first departure of the days and the
+// median number of runs per day
+func periodStart(cluster []timetableRun) (int, int) {
+	firsts := make(map[string]int)
+	counts := make(map[string]int)
+	for _, run := range cluster {
+		if first, ok := firsts[run.date]; !ok || run.departure < first {
+			firsts[run.date] = run.departure
+		}
+		counts[run.date]++
+	}
+	starts, perDate := []int{}, []int{}
+	for date, first := range firsts {
+		starts = append(starts, first)
+		perDate = append(perDate, counts[date])
+	}
+	return medianInt(starts), medianInt(perDate)
+}
+
+// templateTrip is the median trip of runs moved to depart at start
+func templateTrip(cluster []timetableRun, start int) FeedTrip {
+	trip := medianTrip(cluster)
+	serviceDay := cluster[0].serviceDay
+	first, _ := time.Parse(time.RFC3339, trip.StopTimes[0].Departure)
+	shift := serviceDay.Add(time.Duration(start) * time.Second).Sub(first)
+	for ind, st := range trip.StopTimes {
+		arrival, _ := time.Parse(time.RFC3339, st.Arrival)
+		departure, _ := time.Parse(time.RFC3339, st.Departure)
+		trip.StopTimes[ind].Arrival = arrival.Add(shift).Format(time.RFC3339)
+		trip.StopTimes[ind].Departure = departure.Add(shift).Format(time.RFC3339)
+	}
+	return trip
+}
+
+// coefficientOfVariation is standard deviation over mean, 0 is perfectly regular
+func coefficientOfVariation(values []int) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	mean := 0.0
+	for _, v := range values {
+		mean += float64(v)
+	}
+	mean /= float64(len(values))
+	if mean == 0 {
+		return 0
+	}
+	variance := 0.0
+	for _, v := range values {
+		variance += (float64(v) - mean) * (float64(v) - mean)
+	}
+	return math.Sqrt(variance/float64(len(values))) / mean
+}
+
+// secondsToGTFSTime gives HH:MM:SS which can be over 24:00:00
+func secondsToGTFSTime(secs int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs%3600/60, secs%60)
+}
+
+// FrequencyExporter will give frequencies.txt
+func (h *Handler) FrequencyExporter(frequencies []FeedFrequency) error {
+	file, err := os.Create(fmt.Sprintf("%s/frequencies.txt", h.outputDir))
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	// header
+	headerRow := []string{
+		"trip_id", "start_time", "end_time", "headway_secs", "exact_times"}
+	err = writer.Write(headerRow)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [fqe0]: %v", err)
+	}
+
+	for _, freq := range frequencies {
+		row := make([]string, len(headerRow))
+		row[0] = freq.TripID
+		row[1] = secondsToGTFSTime(freq.StartTime)
+		row[2] = secondsToGTFSTime(freq.EndTime)
+		row[3] = fmt.Sprintf("%d", freq.HeadwaySecs)
+		row[4] = "0"
+		if freq.ExactTimes {
+			row[4] = "1"
+		}
+		err = writer.Write(row)
+		if err != nil {
+			return fmt.Errorf("cannot write to file [fqe1]: %v", err)
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
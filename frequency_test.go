@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCoefficientOfVariation(t *testing.T) {
+	cases := []struct {
+		values []int
+		want   float64
+	}{
+		{nil, 0},
+		{[]int{600, 600, 600}, 0},
+		{[]int{0, 0}, 0},
+		{[]int{300, 900}, 0.5},
+	}
+	for _, c := range cases {
+		if got := coefficientOfVariation(c.values); math.Abs(got-c.want) > 0.001 {
+			t.Errorf("coefficientOfVariation(%v) = %.3f, want %.3f", c.values, got, c.want)
+		}
+	}
+}
+
+func TestSynthesizeFrequencies(t *testing.T) {
+	h := &Handler{loc: time.UTC, gtfs: defaultGTFSConfig()}
+	runs := []FeedTrip{}
+	// every 10 min from 07:00 to 08:50 on 2 days, then a run at noon
+	for _, day := range []string{"05", "06"} {
+		for ind := 0; ind < 12; ind++ {
+			departure := fmt.Sprintf("%sT%02d:%02d", day, 7+ind/6, ind%6*10)
+			runs = append(runs, observedRun(fmt.Sprintf("R1__%s%d", day, ind), departure))
+		}
+		runs = append(runs, observedRun("R1__"+day+"noon", day+"T12:00"))
+	}
+	planned, frequencies := h.synthesizeFrequencies(runs)
+	if len(frequencies) != 1 {
+		t.Fatalf("frequencies %+v, want 1", frequencies)
+	}
+	freq := frequencies[0]
+	if freq.TripID != "R1__WD_F0700" || freq.StartTime != 7*3600 || freq.EndTime != 9*3600 || freq.HeadwaySecs != 600 {
+		t.Errorf("frequency %+v, want R1__WD_F0700 07:00-09:00 every 600 s", freq)
+	}
+	// the template trip and the run left over
+	want := []string{"R1__WD_F0700", "R1__WD_1200"}
+	if len(planned) != len(want) {
+		t.Fatalf("%d planned trips, want %v", len(planned), want)
+	}
+	for ind, tripID := range want {
+		if planned[ind].TripID != tripID {
+			t.Errorf("trip %d = %s, want %s", ind, planned[ind].TripID, tripID)
+		}
+	}
+	if first := planned[0].StopTimes[0]; first.Departure != "2024-01-05T07:00:00Z" {
+		t.Errorf("template trip departs %s, want 2024-01-05T07:00:00Z", first.Departure)
+	}
+}
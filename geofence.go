@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	s "strings"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+// stopContains tells if a point is at the stop, inside its geofence if
+// it has one or within its radius, radius (km) if the stop has none
+func stopContains(stop Stop, radius float64, pnt *geo.Point) bool {
+	if len(stop.Geofence) >= 3 {
+		return insidePolygon(stop.Geofence, pnt.Lng(), pnt.Lat())
+	}
+	if stop.Radius > 0 {
+		radius = stop.Radius / 1000
+	}
+	return geo.NewPoint(stop.Lat, stop.Lon).GreatCircleDistance(pnt) <= radius
+}
+
+// atStop tells if a point is at the stop, range_km_within_stop (or
+// -radius) is for a stop without its own radius nor geofence
+func (h *Handler) atStop(stop Stop, pnt *geo.Point) bool {
+	return stopContains(stop, h.rangeWithinStop, pnt)
+}
+
+// stopRadius (km) of a stop, for a geofence it is the farthest corner
+func (h *Handler) stopRadius(stop Stop) float64 {
+	if len(stop.Geofence) >= 3 {
+		stopPoint := geo.NewPoint(stop.Lat, stop.Lon)
+		farthest := 0.0
+		for _, corner := range stop.Geofence {
+			farthest = math.Max(farthest, stopPoint.GreatCircleDistance(geo.NewPoint(corner[1], corner[0])))
+		}
+		return farthest
+	}
+	if stop.Radius > 0 {
+		return stop.Radius / 1000
+	}
+	return h.rangeWithinStop
+}
+
+// insidePolygon tells if (x, y) is inside polygon of [x, y] by ray casting
+func insidePolygon(polygon [][2]float64, x float64, y float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := polygon[i][0], polygon[i][1]
+		xj, yj := polygon[j][0], polygon[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// checkGeofence tells why a geofence is not a polygon, nil if it is or
+// the stop has none. A closed ring repeats the first corner at the end.
+func checkGeofence(polygon [][2]float64) error {
+	if len(polygon) == 0 {
+		return nil
+	}
+	corners := make(map[[2]float64]bool, len(polygon))
+	for _, corner := range polygon {
+		corners[corner] = true
+	}
+	if len(corners) < 3 {
+		return fmt.Errorf("geofence needs at least 3 distinct corners, got %d", len(corners))
+	}
+	return nil
+}
+
+// ewktPolygon gives geofence as EWKT for PostGIS, nil (NULL) if the
+// stop has no geofence
+func ewktPolygon(polygon [][2]float64) interface{} {
+	if len(polygon) < 3 {
+		return nil
+	}
+	corners := make([]string, 0, len(polygon)+1)
+	for _, corner := range polygon {
+		corners = append(corners, fmt.Sprintf("%f %f", corner[0], corner[1]))
+	}
+	// a ring is closed in WKT
+	if polygon[0] != polygon[len(polygon)-1] {
+		corners = append(corners, corners[0])
+	}
+	return fmt.Sprintf("SRID=4326;POLYGON((%s))", s.Join(corners, ","))
+}
+
+// geoJSONPolygon gives the outer ring of a GeoJSON polygon from PostGIS,
+// nil if it is empty
+func geoJSONPolygon(geoJSON string) ([][2]float64, error) {
+	if len(geoJSON) == 0 {
+		return nil, nil
+	}
+	var polygon struct {
+		Coordinates [][][2]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal([]byte(geoJSON), &polygon); err != nil {
+		return nil, fmt.Errorf("geofence: %v", err)
+	}
+	if len(polygon.Coordinates) == 0 {
+		return nil, nil
+	}
+	return polygon.Coordinates[0], nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestInsidePolygon(t *testing.T) {
+	square := [][2]float64{{0, 0}, {2, 0}, {2, 2}, {0, 2}}
+	// a U open to the north
+	concave := [][2]float64{{0, 0}, {3, 0}, {3, 3}, {2, 3}, {2, 1}, {1, 1}, {1, 3}, {0, 3}}
+	cases := []struct {
+		name    string
+		polygon [][2]float64
+		x, y    float64
+		want    bool
+	}{
+		{"square center", square, 1, 1, true},
+		{"square east", square, 3, 1, false},
+		{"square north", square, 1, 2.5, false},
+		{"U bottom", concave, 1.5, 0.5, true},
+		{"U arm", concave, 0.5, 2, true},
+		{"U gap", concave, 1.5, 2, false},
+		{"closed ring", append(square, square[0]), 1, 1, true},
+	}
+	for _, c := range cases {
+		if got := insidePolygon(c.polygon, c.x, c.y); got != c.want {
+			t.Errorf("%s: insidePolygon(%v, %v) = %v, want %v", c.name, c.x, c.y, got, c.want)
+		}
+	}
+}
+
+func TestCheckGeofence(t *testing.T) {
+	cases := []struct {
+		polygon [][2]float64
+		valid   bool
+	}{
+		{nil, true},
+		{[][2]float64{{0, 0}, {1, 0}, {1, 1}}, true},
+		{[][2]float64{{0, 0}, {1, 0}, {1, 1}, {0, 0}}, true},
+		{[][2]float64{{0, 0}, {1, 0}, {0, 0}}, false},
+		{[][2]float64{{0, 0}, {1, 0}, {1, 0}, {0, 0}}, false},
+	}
+	for _, c := range cases {
+		if err := checkGeofence(c.polygon); (err == nil) != c.valid {
+			t.Errorf("checkGeofence(%v) = %v, want valid %v", c.polygon, err, c.valid)
+		}
+	}
+}
@@ -1,13 +1,92 @@
 package main
 
 import (
+	"archive/zip"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	s "strings"
 	"time"
 )
 
+type (
+	// GTFSConfig is [gtfs] section in my.ini
+	GTFSConfig struct {
+		AgencyID          string  `ini:"agency_id"`
+		AgencyName        string  `ini:"agency_name"`
+		AgencyURL         string  `ini:"agency_url"`
+		AgencyLang        string  `ini:"agency_lang"`
+		AgencyPhone       string  `ini:"agency_phone"`
+		RouteType         int     `ini:"route_type"`
+		ServiceID         string  `ini:"service_id"`
+		StartDate         string  `ini:"start_date"`
+		EndDate           string  `ini:"end_date"`
+		ExcludeDates      string  `ini:"exclude_dates"`
+		FeedPublisherName string  `ini:"feed_publisher_name"`
+		FeedPublisherURL  string  `ini:"feed_publisher_url"`
+		FeedLang          string  `ini:"feed_lang"`
+		FeedVersion       string  `ini:"feed_version"`
+		ShapeTolerance    float64 `ini:"shape_tolerance"`
+		// ServiceSimilarity is how similar (0..1) trips of weekdays have
+		// to be to share a service_id
+		ServiceSimilarity     float64 `ini:"service_similarity"`
+		RemoveUnobservedDates bool    `ini:"remove_unobserved_dates"`
+		// TimetableGap (minute) splits observed departures into planned trips
+		TimetableGap float64 `ini:"timetable_gap"`
+		// TimetableSupport is the least fraction of observed days a planned
+		// trip has to run
+		TimetableSupport float64 `ini:"timetable_support"`
+		// FrequencyBand (minute) is the time band headways are checked
+		FrequencyBand float64 `ini:"frequency_band"`
+		// FrequencyMaxCV is the largest coefficient of variation of
+		// headways in a band to be published as frequency
+		FrequencyMaxCV       float64 `ini:"frequency_max_cv"`
+		FrequencyMinHeadways int     `ini:"frequency_min_headways"`
+		FrequencyExactTimes  bool    `ini:"frequency_exact_times"`
+		Zip                  string  `ini:"zip"`
+	}
+
+	// FeedTrip is a row of trips.txt with its stop_times
+	FeedTrip struct {
+		RouteID     string
+		ServiceID   string
+		TripID      string
+		DirectionID int
+		ShapeID     string
+		BlockID     string
+		StopTimes   []StopTimeRaw
+		// ShapeDists is shape_dist_traveled of stops by sequence
+		ShapeDists []float64
+		// Runs is number of observed runs a planned trip stands for
+		Runs int
+	}
+)
+
+// gtfsDate is date format in GTFS
+const gtfsDate = "20060102"
+
+// defaultGTFSConfig is used for whatever not in my.ini
+func defaultGTFSConfig() GTFSConfig {
+	return GTFSConfig{
+		AgencyID:   "1",
+		AgencyName: "Trip Extractor",
+		AgencyURL:  "http://localhost/",
+		RouteType:  3,
+		FeedLang:   "en",
+		// meter
+		ShapeTolerance:    10,
+		ServiceSimilarity: 0.7,
+		TimetableGap:      5,
+		TimetableSupport:  0.5,
+		// minute
+		FrequencyBand:        60,
+		FrequencyMaxCV:       0.2,
+		FrequencyMinHeadways: 3,
+	}
+}
+
 func makeRange(size int, ascending bool) []int {
 	a := make([]int, size)
 	for i := range a {
@@ -20,142 +99,544 @@ func makeRange(size int, ascending bool) []int {
 	return a
 }
 
-// GTFSExporter - export what we can
-// * stop_times.txt
-// * stops.txt
-// * trips.txt (route_id, service_id, trip_id) only trip_id; the rest is dummy
-// * routes.txt - now we have route
-func (h *Handler) GTFSExporter(route string, routeRev string) {
+// GTFSExporter - export a complete feed of all routes
+// * agency.txt
+// * stops.txt - stops of all routes
+// * routes.txt - the routes, reverse route is direction 1 of its route
+// * trips.txt
+// * stop_times.txt - every observed run or planned trips (-mode timetable)
+// * frequencies.txt - periods of regular headway (-mode frequency)
+// * calendar.txt - service patterns from observed days
+// * calendar_dates.txt - exclude_dates, unobserved or observed days
+// * feed_info.txt
+// * shapes.txt - from GPS traces
+// and zip them all if [gtfs] zip is set
+func (h *Handler) GTFSExporter(pairs []routePair) error {
 	// make sure we have "output"
 	_ = os.Mkdir(h.outputDir, 0755)
-	stops := h.getStops("", "ASC", false)
-	h.StopExporter(stops)
-	h.RouteExporter()
-	trips := h.StopTimesExporter(route, routeRev)
-	h.TripExporter(trips)
-	// TODO: add route to trip somehow
+	// stop_times of the routes are extracted again, estimated times
+	// depend on segment profiles learnt so far and would not replace
+	// the old ones
+	extracted, err := h.RouteExtractor(pairs)
+	if err != nil {
+		return err
+	}
+	return h.exportFeed(pairs, extracted)
+}
+
+// exportFeed writes the feed of stop_times extracted for each route
+// into output directory
+func (h *Handler) exportFeed(pairs []routePair, extracted [][]StopTimeRaw) error {
+	trips := []FeedTrip{}
+	shapes := []Shape{}
+	routes := make([]string, len(pairs))
+	for ind, pair := range pairs {
+		stopDirection, _, err := h.routeDirections(pair.route, pair.routeRev)
+		if err != nil {
+			return err
+		}
+		routeTrips := h.buildFeedTrips(extracted[ind], pair.route)
+		routeShapes, err := h.buildShapes(routeTrips, stopDirection)
+		if err != nil {
+			return err
+		}
+		shapes = append(shapes, routeShapes...)
+		trips = append(trips, routeTrips...)
+		routes[ind] = pair.route
+	}
+	blocks, err := h.buildBlocks(trips)
+	if err != nil {
+		return err
+	}
+	blockIDs := blockIDs(blocks)
+	for ind := range trips {
+		trips[ind].BlockID = blockIDs[trips[ind].TripID]
+	}
+	startDate, endDate := h.serviceDateRange(trips)
+	var (
+		patterns    []ServicePattern
+		frequencies []FeedFrequency
+	)
+	switch h.mode {
+	case "timetable":
+		patterns = h.derivePatterns(trips, startDate, endDate)
+		trips = h.synthesizeTimetable(trips)
+	case "frequency":
+		patterns = h.derivePatterns(trips, startDate, endDate)
+		trips, frequencies = h.synthesizeFrequencies(trips)
+	default:
+		patterns = h.observedServices(trips)
+	}
+	stops, err := h.store.RouteStops("", "ASC", false)
+	if err != nil {
+		return err
+	}
+	files := []string{
+		"agency.txt", "stops.txt", "routes.txt", "trips.txt", "stop_times.txt",
+		"calendar.txt", "calendar_dates.txt", "feed_info.txt"}
+	exporters := []func() error{
+		h.AgencyExporter,
+		func() error { return h.StopExporter(uniqueStops(stops)) },
+		func() error { return h.RouteExporter(routes) },
+		func() error { return h.TripExporter(trips) },
+		func() error { return h.StopTimesExporter(trips) },
+		func() error { return h.CalendarExporter(patterns, startDate, endDate) },
+		func() error { return h.CalendarDatesExporter(patterns) },
+		func() error { return h.FeedInfoExporter(startDate, endDate) },
+	}
+	if len(shapes) > 0 {
+		exporters = append(exporters, func() error { return h.ShapeExporter(shapes) })
+		files = append(files, "shapes.txt")
+	}
+	if len(frequencies) > 0 {
+		exporters = append(exporters, func() error { return h.FrequencyExporter(frequencies) })
+		files = append(files, "frequencies.txt")
+	}
+
+	fmt.Printf("exporting: GTFS feed\n")
+	for _, exporter := range exporters {
+		if err := exporter(); err != nil {
+			return err
+		}
+	}
+	if len(h.gtfs.Zip) > 0 {
+		if err := h.zipFeed(h.gtfs.Zip, files); err != nil {
+			return fmt.Errorf("cannot zip GTFS feed: %v", err)
+		}
+		fmt.Printf("GTFS feed: %s\n", h.gtfs.Zip)
+	}
+	return nil
+}
+
+// buildFeedTrips groups stop_times into trips, trip of route is
+// direction 0 and the rest (reverse route) is direction 1
+func (h *Handler) buildFeedTrips(stopTimeRaws []StopTimeRaw, route string) []FeedTrip {
+	trips := []FeedTrip{}
+	index := make(map[string]int)
+	for _, ele := range stopTimeRaws {
+		// stop which cannot be found nor interpolated
+		if len(ele.StopID) == 0 || len(ele.Arrival) == 0 {
+			continue
+		}
+		ind, ok := index[ele.TripID]
+		if !ok {
+			directionID := 1
+			if ele.Direction == route {
+				directionID = 0
+			}
+			ind = len(trips)
+			index[ele.TripID] = ind
+			trips = append(trips, FeedTrip{
+				RouteID:     route,
+				TripID:      ele.TripID,
+				DirectionID: directionID,
+				Runs:        1,
+			})
+		}
+		trips[ind].StopTimes = append(trips[ind].StopTimes, ele)
+	}
+	return trips
+}
+
+// serviceDateRange gives start_date and end_date from [gtfs] or
+// the first and last day of trips if not specified
+func (h *Handler) serviceDateRange(trips []FeedTrip) (string, string) {
+	startDate, endDate := h.gtfs.StartDate, h.gtfs.EndDate
+	for _, trip := range trips {
+		day := h.serviceDay(trip.StopTimes[0].Arrival).Format(gtfsDate)
+		if len(h.gtfs.StartDate) == 0 && (len(startDate) == 0 || day < startDate) {
+			startDate = day
+		}
+		if len(h.gtfs.EndDate) == 0 && day > endDate {
+			endDate = day
+		}
+	}
+	today := time.Now().In(h.loc).Format(gtfsDate)
+	if len(startDate) == 0 {
+		startDate = today
+	}
+	if len(endDate) == 0 {
+		endDate = startDate
+	}
+	return startDate, endDate
+}
+
+// serviceDay gives midnight of the day in service timezone
+func (h *Handler) serviceDay(timestamp string) time.Time {
+	t, _ := time.Parse(time.RFC3339, timestamp)
+	t = t.In(h.loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, h.loc)
+}
+
+// gtfsTime gives HH:MM:SS since the service day which can be over 24:00:00
+func gtfsTime(timestamp string, serviceDay time.Time) string {
+	t, _ := time.Parse(time.RFC3339, timestamp)
+	secs := int(t.Sub(serviceDay).Seconds())
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs%3600/60, secs%60)
+}
+
+// uniqueStops drops stop appearing again in another route
+func uniqueStops(stops []Stop) []Stop {
+	seen := make(map[string]bool, len(stops))
+	result := []Stop{}
+	for _, stop := range stops {
+		if !seen[stop.ID] {
+			seen[stop.ID] = true
+			result = append(result, stop)
+		}
+	}
+	return result
+}
+
+// AgencyExporter will give agency.txt
+func (h *Handler) AgencyExporter() error {
+	file, err := os.Create(fmt.Sprintf("%s/agency.txt", h.outputDir))
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	// header
+	headerRow := []string{
+		"agency_id", "agency_name", "agency_url", "agency_timezone",
+		"agency_lang", "agency_phone"}
+	err = writer.Write(headerRow)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [ae0]: %v", err)
+	}
+
+	row := make([]string, len(headerRow))
+	row[0] = h.gtfs.AgencyID
+	row[1] = h.gtfs.AgencyName
+	row[2] = h.gtfs.AgencyURL
+	row[3] = h.loc.String()
+	row[4] = h.gtfs.AgencyLang
+	row[5] = h.gtfs.AgencyPhone
+	err = writer.Write(row)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [ae1]: %v", err)
+	}
+	writer.Flush()
+	return writer.Error()
 }
 
 // StopExporter will give stops.txt
-func (h *Handler) StopExporter(stops []Stop) {
+func (h *Handler) StopExporter(stops []Stop) error {
 	file, err := os.Create(fmt.Sprintf("%s/stops.txt", h.outputDir))
-	CheckError("cannot create file", err)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
 	defer file.Close()
 	writer := csv.NewWriter(file)
-	defer writer.Flush()
 	// header
 	headerRow := []string{
 		"stop_id", "stop_code", "stop_name", "stop_desc", "stop_lat",
-		"stop_lon", "zone_id", "stop_url", "location_type", "parent_station",
-		"direction", "position"}
+		"stop_lon", "zone_id", "stop_url", "location_type", "parent_station"}
 	err = writer.Write(headerRow)
-	CheckError("Cannot write to file [se0] ", err)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [se0]: %v", err)
+	}
 
 	for _, stop := range stops {
 		row := make([]string, len(headerRow))
 		row[0] = s.TrimSpace(stop.ID)
 		row[1] = s.TrimSpace(stop.ID)
 		row[2] = s.TrimSpace(stop.Name)
+		if len(row[2]) == 0 {
+			row[2] = row[0]
+		}
 		row[4] = fmt.Sprintf("%f", stop.Lat)
 		row[5] = fmt.Sprintf("%f", stop.Lon)
+		row[8] = fmt.Sprintf("%d", stop.LocationType)
+		row[9] = s.TrimSpace(stop.ParentStation)
 		err = writer.Write(row)
-		CheckError("Cannot write to file [se1] ", err)
+		if err != nil {
+			return fmt.Errorf("cannot write to file [se1]: %v", err)
+		}
 	}
+	writer.Flush()
+	return writer.Error()
 }
 
 // RouteExporter will give routes.txt
-func (h *Handler) RouteExporter() {
+func (h *Handler) RouteExporter(routes []string) error {
 	file, err := os.Create(fmt.Sprintf("%s/routes.txt", h.outputDir))
-	CheckError("cannot create file", err)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
 	defer file.Close()
 	writer := csv.NewWriter(file)
-	defer writer.Flush()
 	// header
 	headerRow := []string{
 		"route_id", "agency_id", "route_short_name", "route_long_name",
 		"route_desc", "route_type", "route_url", "route_color",
 		"route_text_color"}
 	err = writer.Write(headerRow)
-	CheckError("Cannot write to file [re0] ", err)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [re0]: %v", err)
+	}
 
-	routes := h.getDistinctDirection()
 	for _, route := range routes {
 		row := make([]string, len(headerRow))
 		row[0] = s.TrimSpace(route)
+		row[1] = h.gtfs.AgencyID
+		row[2] = s.TrimSpace(route)
+		row[5] = fmt.Sprintf("%d", h.gtfs.RouteType)
 		err = writer.Write(row)
-		CheckError("Cannot write to file [re1] ", err)
+		if err != nil {
+			return fmt.Errorf("cannot write to file [re1]: %v", err)
+		}
 	}
+	writer.Flush()
+	return writer.Error()
 }
 
 // TripExporter will give trips.txt
-func (h *Handler) TripExporter(trips []string) {
-	// route_id,service_id,trip_id,direction_id,block_id,shape_id,trip_type
+func (h *Handler) TripExporter(trips []FeedTrip) error {
 	file, err := os.Create(fmt.Sprintf("%s/trips.txt", h.outputDir))
-	CheckError("cannot create file", err)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
 	defer file.Close()
 	writer := csv.NewWriter(file)
-	defer writer.Flush()
 	// header
 	headerRow := []string{
 		"route_id", "service_id", "trip_id", "direction_id",
-		"block_id", "shape_id", "trip_type"}
+		"block_id", "shape_id"}
 	err = writer.Write(headerRow)
-	CheckError("Cannot write to file [te0] ", err)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [te0]: %v", err)
+	}
 
 	for _, trip := range trips {
 		row := make([]string, len(headerRow))
-		ss := s.Split(trip, "__")
-		row[0] = ss[0]
-		row[2] = trip
+		row[0] = trip.RouteID
+		row[1] = trip.ServiceID
+		row[2] = trip.TripID
+		row[3] = fmt.Sprintf("%d", trip.DirectionID)
+		row[4] = trip.BlockID
+		row[5] = trip.ShapeID
 		err = writer.Write(row)
-		CheckError("Cannot write to file [te1] ", err)
+		if err != nil {
+			return fmt.Errorf("cannot write to file [te1]: %v", err)
+		}
 	}
+	writer.Flush()
+	return writer.Error()
 }
 
 // StopTimesExporter - to export all data generated for gtfs feed
-// return generated trips (tripID)
-func (h *Handler) StopTimesExporter(r string, rrv string) []string {
+func (h *Handler) StopTimesExporter(trips []FeedTrip) error {
 	// file columns
 	// trip_id,arrival_time,departure_time,stop_id,stop_sequence,
 	// stop_headsign,pickup_type,drop_off_type,shape_dist_traveled,
 	// timepoint,continuous_drop_off,continuous_pickup
-	bkk, _ := time.LoadLocation("Asia/Bangkok")
-	tripIDs := []string{}
-	stopTimeRaws := h.ExtractTripWithRoute(r, rrv)
-
 	fmt.Printf("exporting: stop_times\n")
 
 	file, err := os.Create(fmt.Sprintf("%s/stop_times.txt", h.outputDir))
-	CheckError("cannot create file", err)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
 	defer file.Close()
 
 	writer := csv.NewWriter(file)
-	defer writer.Flush()
 	// header
 	headerRow := []string{
 		"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence",
 		"stop_headsign", "pickup_type", "drop_off_type", "shape_dist_traveled",
 		"timepoint", "continuous_drop_off", "continuous_pickup"}
 	err = writer.Write(headerRow)
-	CheckError("Cannot write to file", err)
+	if err != nil {
+		return fmt.Errorf("cannot write to file: %v", err)
+	}
 
-	hhmm := "15:04:05"
-	currTripID := ""
-	for _, ele := range stopTimeRaws {
-		if currTripID != ele.TripID {
-			currTripID = ele.TripID
-			tripIDs = append(tripIDs, currTripID)
-		}
-		one := make([]string, len(headerRow))
-		t1, _ := time.Parse(time.RFC3339, ele.Arrival)
-		t2, _ := time.Parse(time.RFC3339, ele.Departure)
-		one[0] = fmt.Sprintf("%+v", ele.TripID)
-		one[1] = t1.In(bkk).Format(hhmm)
-		one[2] = t2.In(bkk).Format(hhmm)
-		one[3] = s.TrimSpace(ele.StopID)
-		one[4] = fmt.Sprintf("%d", ele.Sequence+1)
-		err = writer.Write(one)
-		CheckError("Cannot write to file", err)
-	}
-	return tripIDs
+	for _, trip := range trips {
+		serviceDay := h.serviceDay(trip.StopTimes[0].Arrival)
+		for _, ele := range trip.StopTimes {
+			one := make([]string, len(headerRow))
+			one[0] = fmt.Sprintf("%+v", ele.TripID)
+			one[1] = gtfsTime(ele.Arrival, serviceDay)
+			one[2] = gtfsTime(ele.Departure, serviceDay)
+			one[3] = s.TrimSpace(ele.StopID)
+			one[4] = fmt.Sprintf("%d", ele.Sequence+1)
+			if ele.Sequence < len(trip.ShapeDists) {
+				one[8] = fmt.Sprintf("%.1f", trip.ShapeDists[ele.Sequence])
+			}
+			// only times seen in traces are exact
+			one[9] = "0"
+			if ele.Source == sourceObserved {
+				one[9] = "1"
+			}
+			err = writer.Write(one)
+			if err != nil {
+				return fmt.Errorf("cannot write to file: %v", err)
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// CalendarExporter will give calendar.txt
+func (h *Handler) CalendarExporter(patterns []ServicePattern, startDate string, endDate string) error {
+	file, err := os.Create(fmt.Sprintf("%s/calendar.txt", h.outputDir))
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	// header
+	headerRow := []string{
+		"service_id", "monday", "tuesday", "wednesday", "thursday",
+		"friday", "saturday", "sunday", "start_date", "end_date"}
+	err = writer.Write(headerRow)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [ce0]: %v", err)
+	}
+
+	for _, pattern := range patterns {
+		// a service of some days only is in calendar_dates.txt
+		if len(pattern.Dates) > 0 {
+			continue
+		}
+		row := append([]string{pattern.ID}, weekdayFlags(pattern.Days)...)
+		row = append(row, startDate, endDate)
+		err = writer.Write(row)
+		if err != nil {
+			return fmt.Errorf("cannot write to file [ce1]: %v", err)
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// CalendarDatesExporter will give calendar_dates.txt with
+// exclude_dates removed from every service, unobserved dates
+// removed from their service and days of a service by dates added
+func (h *Handler) CalendarDatesExporter(patterns []ServicePattern) error {
+	file, err := os.Create(fmt.Sprintf("%s/calendar_dates.txt", h.outputDir))
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	// header
+	headerRow := []string{"service_id", "date", "exception_type"}
+	err = writer.Write(headerRow)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [cde0]: %v", err)
+	}
+
+	excluded := []string{}
+	for _, date := range s.Split(h.gtfs.ExcludeDates, ",") {
+		date = s.TrimSpace(date)
+		if len(date) == 0 {
+			continue
+		}
+		_, err := time.Parse(gtfsDate, date)
+		if err != nil {
+			return fmt.Errorf("exclude_dates: %s is not YYYYMMDD: %v", date, err)
+		}
+		excluded = append(excluded, date)
+	}
+	for _, pattern := range patterns {
+		seen := make(map[string]bool)
+		if len(pattern.Dates) > 0 {
+			for _, date := range excluded {
+				seen[date] = true
+			}
+			for _, date := range pattern.Dates {
+				if seen[date] {
+					continue
+				}
+				seen[date] = true
+				// 1 - service has been added for the date
+				err = writer.Write([]string{pattern.ID, date, "1"})
+				if err != nil {
+					return fmt.Errorf("cannot write to file [cde1]: %v", err)
+				}
+			}
+			continue
+		}
+		for _, date := range append(excluded, pattern.RemovedDates...) {
+			if seen[date] {
+				continue
+			}
+			seen[date] = true
+			// 2 - service has been removed for the date
+			err = writer.Write([]string{pattern.ID, date, "2"})
+			if err != nil {
+				return fmt.Errorf("cannot write to file [cde1]: %v", err)
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// FeedInfoExporter will give feed_info.txt
+func (h *Handler) FeedInfoExporter(startDate string, endDate string) error {
+	file, err := os.Create(fmt.Sprintf("%s/feed_info.txt", h.outputDir))
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	// header
+	headerRow := []string{
+		"feed_publisher_name", "feed_publisher_url", "feed_lang",
+		"feed_start_date", "feed_end_date", "feed_version"}
+	err = writer.Write(headerRow)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [fe0]: %v", err)
+	}
+
+	row := make([]string, len(headerRow))
+	row[0] = h.gtfs.FeedPublisherName
+	if len(row[0]) == 0 {
+		row[0] = h.gtfs.AgencyName
+	}
+	row[1] = h.gtfs.FeedPublisherURL
+	if len(row[1]) == 0 {
+		row[1] = h.gtfs.AgencyURL
+	}
+	row[2] = h.gtfs.FeedLang
+	row[3] = startDate
+	row[4] = endDate
+	row[5] = h.gtfs.FeedVersion
+	if len(row[5]) == 0 {
+		row[5] = time.Now().In(h.loc).Format("20060102150405")
+	}
+	err = writer.Write(row)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [fe1]: %v", err)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// zipFeed packs files in output directory into a zip file
+func (h *Handler) zipFeed(zipPath string, names []string) error {
+	file, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for _, name := range names {
+		writer, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		txt, err := os.Open(filepath.Join(h.outputDir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, txt)
+		txt.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
 }
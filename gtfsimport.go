@@ -0,0 +1,372 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	s "strings"
+)
+
+type (
+	// gtfsTripInfo is what we need from trips.txt
+	gtfsTripInfo struct {
+		RouteID     string
+		DirectionID string
+		ShapeID     string
+	}
+
+	// gtfsStopAt is a stop of a trip from stop_times.txt
+	gtfsStopAt struct {
+		Sequence int
+		StopID   string
+	}
+)
+
+// openGTFSFiles gives access to *.txt inside a feed zip by its base name
+func openGTFSFiles(feed string) (*zip.ReadCloser, map[string]*zip.File, error) {
+	archive, err := zip.OpenReader(feed)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		files[path.Base(file.Name)] = file
+	}
+	return archive, files, nil
+}
+
+// readGTFSFile streams a file in the feed with readCSV
+func readGTFSFile(files map[string]*zip.File, name string, required []string, br *bulkResult, fn func(line int, row csvRow) error) error {
+	file, ok := files[name]
+	if !ok {
+		return fmt.Errorf("%s is not in the feed", name)
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := readCSV(reader, required, br, fn); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// gtfsPatternRouteID gives route_id in stop_and_route for a route direction,
+// direction 1 is kept as "<route>-rev" like the reverse made by gen
+func gtfsPatternRouteID(routeID string, directionID string) string {
+	if directionID == "1" {
+		return fmt.Sprintf("%s-rev", routeID)
+	}
+	return routeID
+}
+
+// GTFSImporter reads stops and route patterns from a GTFS feed (zip)
+// into stops and stop_and_route so gen can run against observed traces
+func (h *Handler) GTFSImporter(feed string) error {
+	archive, files, err := openGTFSFiles(feed)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	// stops.txt: only the new ones are added
+	var stops []Stop
+	br := &bulkResult{}
+	err = readGTFSFile(files, "stops.txt", []string{"stop_id", "stop_lat", "stop_lon"}, br,
+		func(line int, row csvRow) error {
+			var err error
+			stop := Stop{
+				ID:            row("stop_id"),
+				Name:          row("stop_name"),
+				ParentStation: row("parent_station"),
+			}
+			if stop.Lat, err = parseFloat(row, "stop_lat"); err != nil {
+				return err
+			}
+			if stop.Lon, err = parseFloat(row, "stop_lon"); err != nil {
+				return err
+			}
+			if value := row("location_type"); len(value) > 0 {
+				if stop.LocationType, err = strconv.Atoi(value); err != nil {
+					return fmt.Errorf("location_type: %v", err)
+				}
+			}
+			stops = append(stops, stop)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if err := h.importNewStops(stops); err != nil {
+		return err
+	}
+
+	// routes.txt: to know which routes there are
+	routeIDs := make(map[string]bool)
+	err = readGTFSFile(files, "routes.txt", []string{"route_id"}, br,
+		func(line int, row csvRow) error {
+			routeIDs[row("route_id")] = true
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	// trips.txt
+	trips := make(map[string]gtfsTripInfo)
+	err = readGTFSFile(files, "trips.txt", []string{"route_id", "trip_id"}, br,
+		func(line int, row csvRow) error {
+			if !routeIDs[row("route_id")] {
+				return fmt.Errorf("unknown route_id %s", row("route_id"))
+			}
+			trips[row("trip_id")] = gtfsTripInfo{
+				RouteID:     row("route_id"),
+				DirectionID: row("direction_id"),
+				ShapeID:     row("shape_id"),
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	// stop_times.txt
+	tripStops := make(map[string][]gtfsStopAt, len(trips))
+	err = readGTFSFile(files, "stop_times.txt", []string{"trip_id", "stop_id", "stop_sequence"}, br,
+		func(line int, row csvRow) error {
+			if _, ok := trips[row("trip_id")]; !ok {
+				return fmt.Errorf("unknown trip_id %s", row("trip_id"))
+			}
+			seq, err := strconv.Atoi(row("stop_sequence"))
+			if err != nil {
+				return fmt.Errorf("stop_sequence: %v", err)
+			}
+			tripStops[row("trip_id")] = append(tripStops[row("trip_id")], gtfsStopAt{seq, row("stop_id")})
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	// shapes.txt: only shapes of the patterns
+	patterns := gtfsMostCommonPatterns(trips, tripStops)
+	patternShapes := gtfsPatternShapes(trips, tripStops, patterns)
+	shapes, err := readGTFSShapes(files, patternShapes, br)
+	if err != nil {
+		return err
+	}
+	if br.Failed > 0 {
+		fmt.Printf("skipped %d line(s): %s\n", br.Failed, br.result().Message)
+	}
+
+	patternIDs := make([]string, 0, len(patterns))
+	for patternID := range patterns {
+		patternIDs = append(patternIDs, patternID)
+	}
+	sort.Strings(patternIDs)
+	for _, patternID := range patternIDs {
+		pattern := patterns[patternID]
+		if len(pattern) < 2 {
+			fmt.Printf("%s: skipped, less than 2 stops\n", patternID)
+			continue
+		}
+		// a loop is kept without its last stop, the first stop as the
+		// only terminal
+		loop := len(pattern) > 2 && pattern[0] == pattern[len(pattern)-1]
+		if loop {
+			pattern = pattern[:len(pattern)-1]
+		}
+		routeStops := make([]RouteStopInput, len(pattern))
+		for ind, stopID := range pattern {
+			routeStops[ind] = RouteStopInput{
+				StopID:     stopID,
+				IsTerminal: ind == 0 || (ind == len(pattern)-1 && !loop),
+			}
+		}
+		if err := h.store.UpsertRouteStops(patternID, routeStops); err != nil {
+			return fmt.Errorf("%s: %v", patternID, err)
+		}
+		fmt.Printf("%s: %d stops (%s -> %s)\n", patternID, len(pattern), pattern[0], pattern[len(pattern)-1])
+		// shape of the pattern is its path for map-matching
+		if points := shapes[patternShapes[patternID]]; len(points) >= 2 {
+			if err := h.store.UpsertRoutePath(patternID, points); err != nil {
+				return fmt.Errorf("%s: %v", patternID, err)
+			}
+			fmt.Printf("%s: path of %d points (shape %s)\n", patternID, len(points), patternShapes[patternID])
+		}
+	}
+	return nil
+}
+
+// readGTFSShapes gives points in order of shapes in use, shapes.txt
+// is optional
+func readGTFSShapes(files map[string]*zip.File, patternShapes map[string]string, br *bulkResult) (map[string][]ShapePoint, error) {
+	shapes := make(map[string][]ShapePoint)
+	if _, ok := files["shapes.txt"]; !ok || len(patternShapes) == 0 {
+		return shapes, nil
+	}
+	inUse := make(map[string]bool, len(patternShapes))
+	for _, shapeID := range patternShapes {
+		inUse[shapeID] = true
+	}
+	type seqPoint struct {
+		seq int
+		pnt ShapePoint
+	}
+	points := make(map[string][]seqPoint)
+	required := []string{"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence"}
+	err := readGTFSFile(files, "shapes.txt", required, br,
+		func(line int, row csvRow) error {
+			if !inUse[row("shape_id")] {
+				return nil
+			}
+			var (
+				pnt ShapePoint
+				err error
+			)
+			if pnt.Lat, err = parseFloat(row, "shape_pt_lat"); err != nil {
+				return err
+			}
+			if pnt.Lon, err = parseFloat(row, "shape_pt_lon"); err != nil {
+				return err
+			}
+			seq, err := strconv.Atoi(row("shape_pt_sequence"))
+			if err != nil {
+				return fmt.Errorf("shape_pt_sequence: %v", err)
+			}
+			points[row("shape_id")] = append(points[row("shape_id")], seqPoint{seq, pnt})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	for shapeID, seqPoints := range points {
+		sort.Slice(seqPoints, func(i, j int) bool {
+			return seqPoints[i].seq < seqPoints[j].seq
+		})
+		shapes[shapeID] = make([]ShapePoint, len(seqPoints))
+		for ind, sp := range seqPoints {
+			shapes[shapeID][ind] = sp.pnt
+		}
+	}
+	return shapes, nil
+}
+
+// importNewStops adds stops which are not in the store yet
+func (h *Handler) importNewStops(stops []Stop) error {
+	ids := make([]string, len(stops))
+	for ind, stop := range stops {
+		ids[ind] = stop.ID
+	}
+	missing, err := h.store.MissingStops(ids)
+	if err != nil {
+		return err
+	}
+	isMissing := make(map[string]bool, len(missing))
+	for _, id := range missing {
+		isMissing[id] = true
+	}
+	newStops := []Stop{}
+	for _, stop := range stops {
+		if isMissing[stop.ID] {
+			newStops = append(newStops, stop)
+			// in case of duplicate stop_id in stops.txt
+			isMissing[stop.ID] = false
+		}
+	}
+	for start := 0; start < len(newStops); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(newStops) {
+			end = len(newStops)
+		}
+		if err := h.store.InsertStops(newStops[start:end]); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("stops: %d added, %d existed\n", len(newStops), len(stops)-len(newStops))
+	return nil
+}
+
+// gtfsTripPattern gives stop_id of a trip in order, a stop visited
+// again is dropped unless it closes a loop
+func gtfsTripPattern(stopAts []gtfsStopAt) []string {
+	sort.Slice(stopAts, func(i, j int) bool {
+		return stopAts[i].Sequence < stopAts[j].Sequence
+	})
+	seen := make(map[string]bool, len(stopAts))
+	pattern := make([]string, 0, len(stopAts))
+	for ind, stopAt := range stopAts {
+		// a loop ends at the stop it starts
+		loopEnd := ind == len(stopAts)-1 && len(pattern) > 1 && stopAt.StopID == pattern[0]
+		if seen[stopAt.StopID] && !loopEnd {
+			continue
+		}
+		seen[stopAt.StopID] = true
+		pattern = append(pattern, stopAt.StopID)
+	}
+	return pattern
+}
+
+// gtfsPatternShapes picks shape_id most trips of each pattern go with
+func gtfsPatternShapes(trips map[string]gtfsTripInfo, tripStops map[string][]gtfsStopAt, patterns map[string][]string) map[string]string {
+	counts := make(map[string]map[string]int)
+	for tripID, stopAts := range tripStops {
+		trip := trips[tripID]
+		if len(trip.ShapeID) == 0 {
+			continue
+		}
+		patternID := gtfsPatternRouteID(trip.RouteID, trip.DirectionID)
+		if s.Join(gtfsTripPattern(stopAts), "\n") != s.Join(patterns[patternID], "\n") {
+			continue
+		}
+		if counts[patternID] == nil {
+			counts[patternID] = make(map[string]int)
+		}
+		counts[patternID][trip.ShapeID]++
+	}
+	result := make(map[string]string, len(counts))
+	for patternID, shapeCounts := range counts {
+		best, bestCount := "", 0
+		for shapeID, count := range shapeCounts {
+			if count > bestCount || (count == bestCount && shapeID < best) {
+				best, bestCount = shapeID, count
+			}
+		}
+		result[patternID] = best
+	}
+	return result
+}
+
+// gtfsMostCommonPatterns picks the most common ordered stop list of
+// each route direction. A stop visited again later in the same trip
+// is dropped as stop_and_route keeps a stop once per route.
+func gtfsMostCommonPatterns(trips map[string]gtfsTripInfo, tripStops map[string][]gtfsStopAt) map[string][]string {
+	counts := make(map[string]map[string]int)
+	for tripID, stopAts := range tripStops {
+		pattern := gtfsTripPattern(stopAts)
+		trip := trips[tripID]
+		patternID := gtfsPatternRouteID(trip.RouteID, trip.DirectionID)
+		if counts[patternID] == nil {
+			counts[patternID] = make(map[string]int)
+		}
+		// stop_id can't have a new line so it's safe as a separator
+		counts[patternID][s.Join(pattern, "\n")]++
+	}
+	result := make(map[string][]string, len(counts))
+	for patternID, patternCounts := range counts {
+		best, bestCount := "", 0
+		for pattern, count := range patternCounts {
+			// prefer the longer one, then the smaller in order on tie
+			if count > bestCount ||
+				(count == bestCount && len(pattern) > len(best)) ||
+				(count == bestCount && len(pattern) == len(best) && pattern < best) {
+				best, bestCount = pattern, count
+			}
+		}
+		result[patternID] = s.Split(best, "\n")
+	}
+	return result
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	s "strings"
+	"testing"
+)
+
+// writeTestFeed zips the files into feed.zip in a temporary directory
+func writeTestFeed(t *testing.T, files map[string]string) string {
+	feed := filepath.Join(t.TempDir(), "feed.zip")
+	out, err := os.Create(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	archive := zip.NewWriter(out)
+	for name, content := range files {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func TestGTFSTripPattern(t *testing.T) {
+	cases := []struct {
+		name    string
+		stopAts []gtfsStopAt
+		want    string
+	}{
+		{"in sequence", []gtfsStopAt{{3, "C"}, {1, "A"}, {2, "B"}}, "A B C"},
+		{"loop", []gtfsStopAt{{1, "A"}, {2, "B"}, {3, "C"}, {4, "A"}}, "A B C A"},
+		{"visited again", []gtfsStopAt{{1, "A"}, {2, "B"}, {3, "A"}, {4, "C"}}, "A B C"},
+		{"back and forth", []gtfsStopAt{{1, "A"}, {2, "A"}}, "A"},
+	}
+	for _, c := range cases {
+		if got := s.Join(gtfsTripPattern(c.stopAts), " "); got != c.want {
+			t.Errorf("%s: pattern %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestGTFSMostCommonPatterns(t *testing.T) {
+	trips := map[string]gtfsTripInfo{
+		"T1": {RouteID: "R1", DirectionID: "0"},
+		"T2": {RouteID: "R1", DirectionID: "0"},
+		"T3": {RouteID: "R1", DirectionID: "0"},
+		"T4": {RouteID: "R1", DirectionID: "1"},
+	}
+	tripStops := map[string][]gtfsStopAt{
+		"T1": {{1, "A"}, {2, "B"}, {3, "C"}},
+		"T2": {{1, "A"}, {2, "B"}, {3, "C"}},
+		// a short turn
+		"T3": {{1, "A"}, {2, "B"}},
+		"T4": {{1, "C"}, {2, "B"}, {3, "A"}},
+	}
+	patterns := gtfsMostCommonPatterns(trips, tripStops)
+	want := map[string]string{"R1": "A B C", "R1-rev": "C B A"}
+	if len(patterns) != len(want) {
+		t.Errorf("patterns %v, want %v", patterns, want)
+	}
+	for patternID, pattern := range want {
+		if got := s.Join(patterns[patternID], " "); got != pattern {
+			t.Errorf("pattern of %s = %s, want %s", patternID, got, pattern)
+		}
+	}
+}
+
+func TestGTFSImporter(t *testing.T) {
+	store, _ := newMemStore("")
+	h := &Handler{store: store}
+	feed := writeTestFeed(t, map[string]string{
+		"stops.txt": `stop_id,stop_name,stop_lat,stop_lon,location_type
+A,Stop A,13.75,100.50,0
+B,Stop B,13.75,100.51,
+C,Stop C,13.75,100.52,0
+X,Bad,13.75,100.53,station
+`,
+		"routes.txt": "route_id\nR1\n",
+		"trips.txt":  "route_id,trip_id,direction_id\nR1,T1,0\nR1,T2,1\n",
+		"stop_times.txt": `trip_id,stop_id,stop_sequence
+T1,A,1
+T1,B,2
+T1,C,3
+T2,C,1
+T2,B,2
+T2,A,3
+`,
+	})
+	if err := h.GTFSImporter(feed); err != nil {
+		t.Fatal(err)
+	}
+	// a bad location_type leaves the line out
+	missing, _ := store.MissingStops([]string{"A", "B", "C", "X"})
+	if len(missing) != 1 || missing[0] != "X" {
+		t.Errorf("missing stops %v, want [X]", missing)
+	}
+	for route, want := range map[string]string{"R1": "A B C", "R1-rev": "C B A"} {
+		stops, err := store.RouteStops(route, "ASC", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(stops))
+		for ind, stop := range stops {
+			ids[ind] = stop.ID
+		}
+		if got := s.Join(ids, " "); got != want {
+			t.Errorf("stops of %s = %s, want %s", route, got, want)
+		}
+		if len(stops) == 3 && (!stops[0].IsTerminal || stops[1].IsTerminal || !stops[2].IsTerminal) {
+			t.Errorf("terminals of %s are not its ends: %+v", route, stops)
+		}
+	}
+}
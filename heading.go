@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+const (
+	// headingMinMove (m) a box has to move between fixes around to
+	// have a heading computed
+	headingMinMove = 5
+	// headingMinSpeed (m/s) under which a box is standing and the
+	// bearing of its device is not used
+	headingMinSpeed = 1
+	// headingPathSpan (m) along the path before and after a stop gives
+	// direction of the route at the stop
+	headingPathSpan = 20
+)
+
+// traceHeadings gives heading (degree from north) of a box at each fix,
+// bearing of the fix if the device gives one or from the fix before to
+// the fix after it. NaN is a box standing still.
+func traceHeadings(traces []Trace) []float64 {
+	headings := make([]float64, len(traces))
+	for ind, trace := range traces {
+		headings[ind] = math.NaN()
+		if trace.Bearing != nil {
+			if trace.Speed == nil || *trace.Speed >= headingMinSpeed {
+				headings[ind] = *trace.Bearing
+			}
+			continue
+		}
+		from, to := trace, trace
+		if ind > 0 {
+			from = traces[ind-1]
+		}
+		if ind < len(traces)-1 {
+			to = traces[ind+1]
+		}
+		fromPoint := geo.NewPoint(from.Lat, from.Lon)
+		toPoint := geo.NewPoint(to.Lat, to.Lon)
+		if fromPoint.GreatCircleDistance(toPoint)*1000 < headingMinMove {
+			continue
+		}
+		headings[ind] = normalizeBearing(fromPoint.BearingTo(toPoint))
+	}
+	return headings
+}
+
+// stopBearings gives direction (degree from north) of the route at each
+// stop, of the path around the stop if there is a path or from the stop
+// before to the stop after it
+func stopBearings(stops []Stop, path *Shape) []float64 {
+	bearings := make([]float64, len(stops))
+	for ind := range stops {
+		var fromPoint, toPoint *geo.Point
+		if path != nil && len(path.StopDists) == len(stops) {
+			from := path.pointAt(path.StopDists[ind] - headingPathSpan)
+			to := path.pointAt(path.StopDists[ind] + headingPathSpan)
+			fromPoint = geo.NewPoint(from.Lat, from.Lon)
+			toPoint = geo.NewPoint(to.Lat, to.Lon)
+		} else {
+			from, to := ind-1, ind+1
+			if from < 0 {
+				from = 0
+			}
+			if to > len(stops)-1 {
+				to = len(stops) - 1
+			}
+			fromPoint = geo.NewPoint(stops[from].Lat, stops[from].Lon)
+			toPoint = geo.NewPoint(stops[to].Lat, stops[to].Lon)
+		}
+		bearings[ind] = normalizeBearing(fromPoint.BearingTo(toPoint))
+	}
+	return bearings
+}
+
+// headingAgrees tells if heading of a box is within heading_tolerance
+// of the route direction, unknown heading agrees with any direction
+func (h *Handler) headingAgrees(heading float64, bearing float64) bool {
+	if h.trip.HeadingTolerance <= 0 || math.IsNaN(heading) {
+		return true
+	}
+	diff := math.Mod(math.Abs(heading-bearing), 360)
+	return math.Min(diff, 360-diff) <= h.trip.HeadingTolerance
+}
+
+// normalizeBearing gives bearing in [0, 360)
+func normalizeBearing(bearing float64) float64 {
+	bearing = math.Mod(bearing, 360)
+	if bearing < 0 {
+		bearing += 360
+	}
+	return bearing
+}
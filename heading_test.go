@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStopBearingsOnPath(t *testing.T) {
+	// the path goes east then north, S2 is on the north side
+	stops := []Stop{
+		{ID: "S1", Lat: 13.75, Lon: 100.50},
+		{ID: "S2", Lat: 13.752, Lon: 100.5046},
+		{ID: "S3", Lat: 13.7545, Lon: 100.5046},
+	}
+	path := Shape{Points: withDistance([]ShapePoint{
+		{Lat: 13.75, Lon: 100.50},
+		{Lat: 13.75, Lon: 100.5046},
+		{Lat: 13.7545, Lon: 100.5046},
+	})}
+	path.StopDists = path.stopDistances(stops)
+	near := func(got float64, want float64) bool {
+		diff := math.Mod(math.Abs(got-want), 360)
+		return math.Min(diff, 360-diff) < 5
+	}
+	bearings := stopBearings(stops, &path)
+	for ind, want := range []float64{90, 0, 0} {
+		if !near(bearings[ind], want) {
+			t.Errorf("bearing at %s = %.0f, want %.0f along the path", stops[ind].ID, bearings[ind], want)
+		}
+	}
+	// from S1 to S3 in a straight line without the path
+	if bearings = stopBearings(stops, nil); near(bearings[1], 0) {
+		t.Errorf("bearing at S2 without path = %.0f, want from S1 to S3", bearings[1])
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	headwayBunching = "bunching"
+	headwayGap      = "gap"
+)
+
+type (
+	// HeadwayEvent is an arrival too soon (bunching) or too late (gap)
+	// after the previous one at the stop
+	HeadwayEvent struct {
+		Kind      string `json:"kind"`
+		StopID    string `json:"stop_id"`
+		Arrival   string `json:"arrival"`
+		BoxID     string `json:"box_id"`
+		PrevBoxID string `json:"prev_box_id"`
+		Headway   int    `json:"headway"`
+	}
+
+	// StopHeadway is headway (second) at a stop of a direction
+	StopHeadway struct {
+		Sequence int     `json:"sequence"`
+		StopID   string  `json:"stop_id"`
+		Count    int     `json:"count"`
+		Mean     float64 `json:"mean"`
+		Median   int     `json:"median"`
+		Min      int     `json:"min"`
+		Max      int     `json:"max"`
+		// CV is coefficient of variation, 0 is perfectly regular
+		CV       float64 `json:"cv"`
+		Bunching int     `json:"bunching"`
+		Gaps     int     `json:"gaps"`
+	}
+
+	// DirectionHeadway is headway of all stops of a direction
+	DirectionHeadway struct {
+		Direction string         `json:"direction"`
+		Stops     []StopHeadway  `json:"stops"`
+		Events    []HeadwayEvent `json:"events"`
+	}
+)
+
+// headwayStats computes headway between arrivals of the same service
+// day at each stop. A headway under bunching_fraction of the median
+// of the stop is bunching, over gap_factor times of it is a gap.
+// Empty direction or weekday means all.
+func (h *Handler) headwayStats(direction string, weekday string) ([]DirectionHeadway, error) {
+	stopTimes, err := h.store.StopTimes(StopTimeFilter{Direction: direction, Source: sourceObserved})
+	if err != nil {
+		return nil, err
+	}
+	type arrival struct {
+		at    time.Time
+		boxID string
+	}
+	// direction -> sequence -> date -> arrivals
+	arrivals := make(map[string]map[int]map[string][]arrival)
+	stopIDs := make(map[string]map[int]string)
+	for _, st := range stopTimes {
+		t, err := time.Parse(time.RFC3339, st.Arrival)
+		if err != nil {
+			continue
+		}
+		day := h.serviceDay(st.Arrival)
+		if len(weekday) > 0 && day.Format("Mon") != weekday {
+			continue
+		}
+		if arrivals[st.Direction] == nil {
+			arrivals[st.Direction] = make(map[int]map[string][]arrival)
+			stopIDs[st.Direction] = make(map[int]string)
+		}
+		if arrivals[st.Direction][st.Sequence] == nil {
+			arrivals[st.Direction][st.Sequence] = make(map[string][]arrival)
+		}
+		date := day.Format(gtfsDate)
+		arrivals[st.Direction][st.Sequence][date] = append(arrivals[st.Direction][st.Sequence][date], arrival{t, st.BoxID})
+		stopIDs[st.Direction][st.Sequence] = st.StopID
+	}
+
+	directions := make([]string, 0, len(arrivals))
+	for dir := range arrivals {
+		directions = append(directions, dir)
+	}
+	sort.Strings(directions)
+	result := make([]DirectionHeadway, len(directions))
+	for ind, dir := range directions {
+		result[ind] = DirectionHeadway{Direction: dir, Stops: []StopHeadway{}, Events: []HeadwayEvent{}}
+		sequences := make([]int, 0, len(arrivals[dir]))
+		for seq := range arrivals[dir] {
+			sequences = append(sequences, seq)
+		}
+		sort.Ints(sequences)
+		for _, seq := range sequences {
+			stop := StopHeadway{Sequence: seq + 1, StopID: stopIDs[dir][seq]}
+			headways := []int{}
+			events := []HeadwayEvent{}
+			for _, byDate := range arrivals[dir][seq] {
+				sort.Slice(byDate, func(i, j int) bool {
+					return byDate[i].at.Before(byDate[j].at)
+				})
+				for k := 1; k < len(byDate); k++ {
+					headway := int(byDate[k].at.Sub(byDate[k-1].at).Seconds())
+					headways = append(headways, headway)
+					events = append(events, HeadwayEvent{
+						StopID:    stop.StopID,
+						Arrival:   byDate[k].at.In(h.loc).Format(time.RFC3339),
+						BoxID:     byDate[k].boxID,
+						PrevBoxID: byDate[k-1].boxID,
+						Headway:   headway,
+					})
+				}
+			}
+			if len(headways) == 0 {
+				continue
+			}
+			stop.Count = len(headways)
+			stop.Median = medianInt(headways)
+			stop.Min, stop.Max = headways[0], headways[0]
+			sum := 0
+			for _, headway := range headways {
+				sum += headway
+				if headway < stop.Min {
+					stop.Min = headway
+				}
+				if headway > stop.Max {
+					stop.Max = headway
+				}
+			}
+			stop.Mean = float64(sum) / float64(len(headways))
+			stop.CV = coefficientOfVariation(headways)
+			for _, event := range events {
+				switch {
+				case float64(event.Headway) < h.stats.BunchingFraction*float64(stop.Median):
+					event.Kind = headwayBunching
+					stop.Bunching++
+				case float64(event.Headway) > h.stats.GapFactor*float64(stop.Median):
+					event.Kind = headwayGap
+					stop.Gaps++
+				default:
+					continue
+				}
+				result[ind].Events = append(result[ind].Events, event)
+			}
+			result[ind].Stops = append(result[ind].Stops, stop)
+		}
+		events := result[ind].Events
+		sort.SliceStable(events, func(i, j int) bool {
+			return arrivalBefore(events[i].Arrival, events[j].Arrival)
+		})
+	}
+	return result, nil
+}
+
+// HeadwayReporter prints headway at each stop in minute, and bunching
+// and gaps in verbose mode
+func (h *Handler) HeadwayReporter(direction string) {
+	stats, err := h.headwayStats(direction, h.day)
+	CheckError("Cannot read stop_times ", err)
+	if len(stats) == 0 {
+		fmt.Println("No stop_times, run gen first")
+		return
+	}
+	for _, stat := range stats {
+		fmt.Printf("\n%s\n", stat.Direction)
+		fmt.Printf("  %-3s %-10s %4s %6s %6s %6s %6s %5s %8s %4s\n",
+			"#", "stop_id", "n", "mean", "median", "min", "max", "cv", "bunching", "gaps")
+		for _, stop := range stat.Stops {
+			fmt.Printf("  %-3d %-10.10s %4d %6.1f %6.1f %6.1f %6.1f %5.2f %8d %4d\n",
+				stop.Sequence, stop.StopID, stop.Count, stop.Mean/60,
+				float64(stop.Median)/60, float64(stop.Min)/60, float64(stop.Max)/60,
+				stop.CV, stop.Bunching, stop.Gaps)
+		}
+		for _, event := range stat.Events {
+			h.LogPrint(fmt.Sprintf("  %-8s %s %s %s %.1f min after %s\n",
+				event.Kind, event.StopID, h.hhmm(event.Arrival), event.BoxID,
+				float64(event.Headway)/60, event.PrevBoxID))
+		}
+	}
+}
+
+// HeadwayStatsHandler gives headway statistics, filtered by direction
+// and weekday (Mon, Tue, ...)
+func (h *Handler) HeadwayStatsHandler(c echo.Context) error {
+	weekday := c.QueryParam("weekday")
+	if len(weekday) > 0 {
+		if _, err := time.Parse("Mon", weekday); err != nil {
+			return c.JSON(http.StatusBadRequest, Result{Message: fmt.Sprintf("weekday: %s is not Mon, Tue, ...", weekday)})
+		}
+	}
+	stats, err := h.headwayStats(c.QueryParam("direction"), weekday)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, stats)
+}
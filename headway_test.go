@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHeadwayStats(t *testing.T) {
+	// 2024-01-05 is friday, 2024-01-06 saturday
+	cases := []struct {
+		name     string
+		arrivals []string
+		weekday  string
+		count    int
+		median   int
+		cv       float64
+		bunching int
+		gaps     int
+	}{
+		{"regular", []string{"05T08:00", "05T08:10", "05T08:20", "05T08:30"}, "", 3, 600, 0, 0, 0},
+		// 120 s is under half of the median, 1680 s over twice of it
+		{"bunching and gap", []string{"05T08:00", "05T08:10", "05T08:20", "05T08:22", "05T08:50"}, "", 4, 600, 0.762, 1, 1},
+		{"per service day", []string{"05T08:00", "05T08:10", "06T08:05", "06T08:15"}, "", 2, 600, 0, 0, 0},
+		{"weekday", []string{"05T08:00", "05T08:10", "06T08:05", "06T08:25"}, "Sat", 1, 1200, 0, 0, 0},
+	}
+	for _, c := range cases {
+		h := newTestHandler(t)
+		for ind, arrival := range c.arrivals {
+			at, _ := time.Parse(time.RFC3339, "2024-01-"+arrival+":00Z")
+			st := StopTime{
+				TripID:    fmt.Sprintf("R1__%d", ind+1),
+				BoxID:     fmt.Sprintf("B%d", ind+1),
+				Direction: "R1",
+				StopID:    "S1",
+				Arrival:   at.Format(time.RFC3339),
+				Source:    sourceObserved,
+			}
+			if err := h.store.InsertStopTime(st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// an estimated arrival is not a headway
+		st := StopTime{TripID: "R1__9", BoxID: "B9", Direction: "R1", StopID: "S1",
+			Arrival: "2024-01-05T08:01:00Z", Source: sourceInterpolated}
+		if err := h.store.InsertStopTime(st); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := h.headwayStats("R1", c.weekday)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) != 1 || len(stats[0].Stops) != 1 {
+			t.Errorf("%s: stats %+v, want a stop of R1", c.name, stats)
+			continue
+		}
+		stop := stats[0].Stops[0]
+		if stop.Count != c.count || stop.Median != c.median || stop.Bunching != c.bunching || stop.Gaps != c.gaps {
+			t.Errorf("%s: n %d, median %d, bunching %d, gaps %d, want %d, %d, %d, %d", c.name,
+				stop.Count, stop.Median, stop.Bunching, stop.Gaps, c.count, c.median, c.bunching, c.gaps)
+		}
+		if math.Abs(stop.CV-c.cv) > 0.001 {
+			t.Errorf("%s: cv %.3f, want %.3f", c.name, stop.CV, c.cv)
+		}
+		if len(stats[0].Events) != c.bunching+c.gaps {
+			t.Errorf("%s: %d events, want %d", c.name, len(stats[0].Events), c.bunching+c.gaps)
+		}
+	}
+}
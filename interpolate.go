@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+// Source of a stop time
+const (
+	// sourceObserved is a stop the box was seen at (or passed by on the path)
+	sourceObserved = "observed"
+	// sourceInterpolated is a stop between 2 observed stops
+	sourceInterpolated = "interpolated"
+	// sourceExtrapolated is a stop before the first or after the last
+	// observed stop of a trip
+	sourceExtrapolated = "extrapolated"
+)
+
+// Confidence of an estimated stop time is the factor to the power of
+// number of stops to the nearest observed one, an observed one is 1
+const (
+	interpolatedConfidence = 0.8
+	extrapolatedConfidence = 0.5
+)
+
+// profileMaxSamples caps weight of history in a segment profile
+const profileMaxSamples = 100
+
+// segmentProfile is SegmentProfile of a direction by sequence
+type segmentProfile map[int]SegmentProfile
+
+// segmentProfile gives profile of a direction learnt by extractions so far
+func (h *Handler) segmentProfile(direction string) (segmentProfile, error) {
+	profiles, err := h.store.SegmentProfiles(direction)
+	if err != nil {
+		return nil, fmt.Errorf("segment profile: %v", err)
+	}
+	profile := make(segmentProfile, len(profiles))
+	for _, ele := range profiles {
+		profile[ele.Sequence] = ele
+	}
+	return profile, nil
+}
+
+// saveSegmentProfile keeps profile of a direction for next extractions
+func (h *Handler) saveSegmentProfile(direction string, profile segmentProfile) error {
+	if len(direction) == 0 || len(profile) == 0 {
+		return nil
+	}
+	profiles := make([]SegmentProfile, 0, len(profile))
+	for _, ele := range profile {
+		profiles = append(profiles, ele)
+	}
+	if err := h.store.UpsertSegmentProfiles(direction, profiles); err != nil {
+		return fmt.Errorf("save segment profile: %v", err)
+	}
+	return nil
+}
+
+// observedProfile is travel between observed stops next to each other
+// and dwell at observed stops of trips, as stop times of the trips are
+// before filled up. Dwell at terminals is layover and left out.
+func observedProfile(direction string, trips [][]StopTimeRaw) segmentProfile {
+	travel := make(map[int][]float64)
+	dwell := make(map[int][]float64)
+	for _, l := range trips {
+		for ind, st := range l {
+			if st == (StopTimeRaw{}) {
+				continue
+			}
+			if ind > 0 && ind < len(l)-1 {
+				dwell[ind] = append(dwell[ind], durationBetween(st.Arrival, st.Departure).Seconds())
+			}
+			if ind < len(l)-1 && l[ind+1] != (StopTimeRaw{}) {
+				if sec := durationBetween(st.Departure, l[ind+1].Arrival).Seconds(); sec >= 0 {
+					travel[ind] = append(travel[ind], sec)
+				}
+			}
+		}
+	}
+	profile := make(segmentProfile)
+	for seq, values := range travel {
+		ele := profile[seq]
+		ele.Travel, ele.TravelSamples = mean(values), len(values)
+		profile[seq] = ele
+	}
+	for seq, values := range dwell {
+		ele := profile[seq]
+		ele.Dwell, ele.DwellSamples = mean(values), len(values)
+		profile[seq] = ele
+	}
+	for seq, ele := range profile {
+		ele.Direction = direction
+		ele.Sequence = seq
+		profile[seq] = ele
+	}
+	return profile
+}
+
+// update gives the profile blended with segments observed in trips,
+// each weighted by its samples, so it keeps history of earlier
+// extractions. History weighs at most profileMaxSamples, so the profile
+// follows when service gets faster or slower.
+func (sp segmentProfile) update(observed segmentProfile) segmentProfile {
+	result := make(segmentProfile, len(sp)+len(observed))
+	for seq, ele := range sp {
+		result[seq] = ele
+	}
+	for seq, ele := range observed {
+		old := result[seq]
+		ele.Travel, ele.TravelSamples = blend(old.Travel, old.TravelSamples, ele.Travel, ele.TravelSamples)
+		ele.Dwell, ele.DwellSamples = blend(old.Dwell, old.DwellSamples, ele.Dwell, ele.DwellSamples)
+		result[seq] = ele
+	}
+	return result
+}
+
+// blend gives mean of 2 means by their samples, history is at most
+// profileMaxSamples
+func blend(old float64, oldSamples int, value float64, samples int) (float64, int) {
+	if oldSamples > profileMaxSamples {
+		oldSamples = profileMaxSamples
+	}
+	if oldSamples+samples == 0 {
+		return 0, 0
+	}
+	blended := (old*float64(oldSamples) + value*float64(samples)) / float64(oldSamples+samples)
+	return blended, oldSamples + samples
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// FillupMissingStopTime fills stops which are not observed in a trip.
+// Between 2 observed stops time is shared by travel and dwell in the
+// profile, a segment without profile by its distance along the path at
+// speed of the trip. Stops before the first and after the last observed
+// one are extrapolated the same way, except for a partial trip which
+// does not serve them.
+func (h *Handler) FillupMissingStopTime(t Trip, l []StopTimeRaw, stops []Stop, path *Shape, profile segmentProfile) []StopTimeRaw {
+	observed := []int{}
+	for ind := range l {
+		if l[ind] == (StopTimeRaw{}) {
+			continue
+		}
+		l[ind].Source = sourceObserved
+		l[ind].Confidence = 1
+		observed = append(observed, ind)
+	}
+	if len(observed) == 0 {
+		return l
+	}
+	dists := alongDistances(stops, path)
+	speed := tripSpeed(l, observed, dists, profile)
+	// travel (s) from stop k to k+1, or its distance if it cannot be told
+	travel := func(k int) (float64, bool) {
+		if ele, ok := profile[k]; ok && ele.TravelSamples > 0 {
+			return ele.Travel, true
+		}
+		if speed > 0 {
+			return (dists[k+1] - dists[k]) / speed, true
+		}
+		return dists[k+1] - dists[k], false
+	}
+	dwell := func(k int) float64 {
+		if ele, ok := profile[k]; ok && ele.DwellSamples > 0 {
+			return ele.Dwell
+		}
+		return 0
+	}
+	estimate := func(k int, arrival time.Time, departure time.Time, source string, away int) StopTimeRaw {
+		factor := interpolatedConfidence
+		if source == sourceExtrapolated {
+			factor = extrapolatedConfidence
+		}
+		return StopTimeRaw{
+			TripID:     t.ID,
+			StopID:     stops[k].ID,
+			Arrival:    arrival.Format(time.RFC3339),
+			Departure:  departure.Format(time.RFC3339),
+			BoxID:      t.BoxID,
+			Sequence:   k,
+			Direction:  l[observed[0]].Direction,
+			Source:     source,
+			Confidence: math.Round(math.Pow(factor, float64(away))*100) / 100,
+		}
+	}
+
+	for n := 1; n < len(observed); n++ {
+		i, j := observed[n-1], observed[n]
+		if j-i < 2 {
+			continue
+		}
+		from, _ := time.Parse(time.RFC3339, l[i].Departure)
+		to, _ := time.Parse(time.RFC3339, l[j].Arrival)
+		// a segment which cannot be told in seconds shares the whole
+		// gap by distance, seconds and meters do not add up
+		byDistance := false
+		for k := i; k < j; k++ {
+			if _, ok := travel(k); !ok {
+				byDistance = true
+			}
+		}
+		span := func(k int) float64 {
+			if byDistance {
+				return dists[k+1] - dists[k]
+			}
+			sec, _ := travel(k)
+			return sec
+		}
+		stand := func(k int) float64 {
+			if byDistance {
+				return 0
+			}
+			return dwell(k)
+		}
+		expected := 0.0
+		for k := i; k < j; k++ {
+			expected += span(k)
+			if k > i {
+				expected += stand(k)
+			}
+		}
+		// expected time is stretched or shrunk to what the trip took
+		scale := 0.0
+		if expected > 0 && to.After(from) {
+			scale = to.Sub(from).Seconds() / expected
+		}
+		at := 0.0
+		for k := i + 1; k < j; k++ {
+			at += span(k - 1)
+			arrival := from.Add(seconds(at * scale))
+			at += stand(k)
+			departure := from.Add(seconds(at * scale))
+			l[k] = estimate(k, arrival, departure, sourceInterpolated, int(math.Min(float64(k-i), float64(j-k))))
+		}
+	}
+
+	if t.Comment == tripPartial {
+		return l
+	}
+	first, last := observed[0], observed[len(observed)-1]
+	at, _ := time.Parse(time.RFC3339, l[first].Arrival)
+	for k := first - 1; k >= 0; k-- {
+		sec, ok := travel(k)
+		if !ok {
+			break
+		}
+		departure := at.Add(-seconds(sec))
+		arrival := departure
+		if k > 0 {
+			arrival = departure.Add(-seconds(dwell(k)))
+		}
+		l[k] = estimate(k, arrival, departure, sourceExtrapolated, first-k)
+		at = arrival
+	}
+	at, _ = time.Parse(time.RFC3339, l[last].Departure)
+	for k := last + 1; k < len(l); k++ {
+		sec, ok := travel(k - 1)
+		if !ok {
+			break
+		}
+		arrival := at.Add(seconds(sec))
+		departure := arrival
+		if k < len(l)-1 {
+			departure = arrival.Add(seconds(dwell(k)))
+		}
+		l[k] = estimate(k, arrival, departure, sourceExtrapolated, k-last)
+		at = departure
+	}
+	return l
+}
+
+// tripSpeed (m/s) is from the first to the last observed stop of a trip,
+// or of the profile if only one stop is observed, 0 if it is unknown
+func tripSpeed(l []StopTimeRaw, observed []int, dists []float64, profile segmentProfile) float64 {
+	first, last := observed[0], observed[len(observed)-1]
+	if first != last {
+		took := durationBetween(l[first].Departure, l[last].Arrival).Seconds()
+		if took > 0 && dists[last] > dists[first] {
+			return (dists[last] - dists[first]) / took
+		}
+	}
+	dist, took := 0.0, 0.0
+	for k, ele := range profile {
+		if ele.TravelSamples > 0 && k+1 < len(dists) {
+			dist += dists[k+1] - dists[k]
+			took += ele.Travel
+		}
+	}
+	if took > 0 && dist > 0 {
+		return dist / took
+	}
+	return 0
+}
+
+// alongDistances (m) of stops along the path, or from stop to stop in
+// a straight line if there is no path
+func alongDistances(stops []Stop, path *Shape) []float64 {
+	if path != nil && len(path.StopDists) == len(stops) {
+		return path.StopDists
+	}
+	dists := make([]float64, len(stops))
+	for ind := 1; ind < len(stops); ind++ {
+		dists[ind] = dists[ind-1] + distanceBetween(stops[ind-1], stops[ind])*1000
+	}
+	return dists
+}
+
+func distanceBetween(a Stop, b Stop) float64 {
+	aPoint := geo.NewPoint(a.Lat, a.Lon)
+	bPoint := geo.NewPoint(b.Lat, b.Lon)
+	return aPoint.GreatCircleDistance(bPoint)
+}
+
+func durationBetween(a string, b string) time.Duration {
+	t2, _ := time.Parse(time.RFC3339, b)
+	t1, _ := time.Parse(time.RFC3339, a)
+	return t2.Sub(t1)
+}
+
+func seconds(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// observedAt gives an observed stop time of R1 at seconds from 08:00
+func observedAt(stops []Stop, ind int, arrival int, departure int) StopTimeRaw {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	return StopTimeRaw{
+		TripID:    "R1__1",
+		StopID:    stops[ind].ID,
+		Arrival:   start.Add(time.Duration(arrival) * time.Second).Format(time.RFC3339),
+		Departure: start.Add(time.Duration(departure) * time.Second).Format(time.RFC3339),
+		BoxID:     "B1",
+		Sequence:  ind,
+		Direction: "R1",
+	}
+}
+
+// secondsFrom8 gives seconds of a timestamp from 08:00
+func secondsFrom8(timestamp string) int {
+	t, _ := time.Parse(time.RFC3339, timestamp)
+	return int(t.Sub(time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)).Seconds())
+}
+
+func TestFillupMissingStopTime(t *testing.T) {
+	h := &Handler{loc: time.UTC}
+	stops := testStops()
+
+	// S2..S4 between observed S1 and S5 by distance, stops are equally apart
+	l := make([]StopTimeRaw, len(stops))
+	l[0] = observedAt(stops, 0, 0, 0)
+	l[4] = observedAt(stops, 4, 400, 400)
+	l = h.FillupMissingStopTime(Trip{ID: "R1__1", BoxID: "B1"}, l, stops, nil, segmentProfile{})
+	wants := []struct {
+		arrival    int
+		source     string
+		confidence float64
+	}{
+		{0, sourceObserved, 1},
+		{100, sourceInterpolated, 0.8},
+		{200, sourceInterpolated, 0.64},
+		{300, sourceInterpolated, 0.8},
+		{400, sourceObserved, 1},
+	}
+	for ind, want := range wants {
+		got := secondsFrom8(l[ind].Arrival)
+		if got < want.arrival-1 || got > want.arrival+1 || l[ind].Source != want.source ||
+			l[ind].Confidence != want.confidence || l[ind].StopID != stops[ind].ID {
+			t.Errorf("stop %d = %d s %s %.2f, want %+v", ind, got, l[ind].Source, l[ind].Confidence, want)
+		}
+	}
+
+	// profile shares time between segments and dwell at stops
+	profile := segmentProfile{
+		0: {Sequence: 0, Travel: 100, TravelSamples: 1},
+		1: {Sequence: 1, Travel: 300, TravelSamples: 1, Dwell: 50, DwellSamples: 1},
+	}
+	l = make([]StopTimeRaw, len(stops))
+	l[0] = observedAt(stops, 0, 0, 0)
+	l[2] = observedAt(stops, 2, 900, 960)
+	l = h.FillupMissingStopTime(Trip{ID: "R1__1", BoxID: "B1"}, l, stops, nil, profile)
+	if arrival, departure := secondsFrom8(l[1].Arrival), secondsFrom8(l[1].Departure); arrival != 200 || departure != 300 {
+		t.Errorf("profile: S2 %d..%d s, want 200..300 s", arrival, departure)
+	}
+
+	// S1 and S5 are extrapolated at speed of the trip except for a partial trip
+	for _, trip := range []Trip{{ID: "R1__1", BoxID: "B1"}, {ID: "R1__p1", BoxID: "B1", Comment: tripPartial}} {
+		l = make([]StopTimeRaw, len(stops))
+		l[1] = observedAt(stops, 1, 100, 100)
+		l[3] = observedAt(stops, 3, 300, 300)
+		l = h.FillupMissingStopTime(trip, l, stops, nil, segmentProfile{})
+		if trip.Comment == tripPartial {
+			if l[0] != (StopTimeRaw{}) || l[4] != (StopTimeRaw{}) {
+				t.Errorf("partial trip is extrapolated: %+v %+v", l[0], l[4])
+			}
+			continue
+		}
+		for _, ind := range []int{0, 4} {
+			got := secondsFrom8(l[ind].Arrival)
+			if got < ind*100-1 || got > ind*100+1 || l[ind].Source != sourceExtrapolated || l[ind].Confidence != 0.5 {
+				t.Errorf("stop %d = %d s %s %.2f, want %d s extrapolated 0.50", ind, got, l[ind].Source, l[ind].Confidence, ind*100)
+			}
+		}
+	}
+}
+
+func TestObservedProfile(t *testing.T) {
+	stops := testStops()
+	// S1 -> S2 took 100 s and 200 s, S2 stood 20 s and 40 s, S3 unseen
+	trip1 := make([]StopTimeRaw, len(stops))
+	trip1[0] = observedAt(stops, 0, 0, 0)
+	trip1[1] = observedAt(stops, 1, 100, 120)
+	trip2 := make([]StopTimeRaw, len(stops))
+	trip2[0] = observedAt(stops, 0, 0, 0)
+	trip2[1] = observedAt(stops, 1, 200, 240)
+	for _, trips := range [][][]StopTimeRaw{{trip1, trip2}, {trip2, trip1}} {
+		profile := observedProfile("R1", trips)
+		if ele := profile[0]; ele.Travel != 150 || ele.TravelSamples != 2 || ele.DwellSamples != 0 {
+			t.Errorf("S1 profile = %+v, want travel 150 s of 2", ele)
+		}
+		if ele := profile[1]; ele.Dwell != 30 || ele.DwellSamples != 2 || ele.TravelSamples != 0 {
+			t.Errorf("S2 profile = %+v, want dwell 30 s of 2", ele)
+		}
+	}
+
+	// observed segments are blended with what was learnt by samples,
+	// history weighs at most profileMaxSamples
+	stored := segmentProfile{
+		0: {Sequence: 0, Travel: 480, TravelSamples: 8},
+		1: {Sequence: 1, Travel: 300, TravelSamples: 9, Dwell: 10, DwellSamples: 500},
+	}
+	profile := stored.update(observedProfile("R1", [][]StopTimeRaw{trip1, trip2}))
+	if ele := profile[0]; ele.Travel != 414 || ele.TravelSamples != 10 {
+		t.Errorf("updated S1 profile = %+v, want travel 414 s of 10", ele)
+	}
+	if ele := profile[1]; ele.Travel != 300 || ele.TravelSamples != 9 || math.Abs(ele.Dwell-1060.0/102) > 1e-9 || ele.DwellSamples != 102 {
+		t.Errorf("updated S2 profile = %+v, want travel 300 s of 9, dwell 10.39 s of 102", ele)
+	}
+}
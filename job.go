@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// jobMaxErrors is max number of errors a job keeps
+const jobMaxErrors = 100
+
+type (
+	// ExtractJobInput is POST /api/jobs/extract
+	ExtractJobInput struct {
+		Route    string `json:"route" validate:"required"`
+		RouteRev string `json:"route_rev"`
+		// Day is Mon, Tue, ... as -day
+		Day string `json:"day"`
+		// Radius (m) for stop detection, range_km_within_stop if not set
+		Radius float64 `json:"radius" validate:"gte=0"`
+	}
+
+	// JobProgress is how far a job has gone
+	JobProgress struct {
+		Boxes     int `json:"boxes"`
+		BoxesDone int `json:"boxes_done"`
+		Trips     int `json:"trips"`
+		TripsDone int `json:"trips_done"`
+	}
+
+	// JobCounts is what a job has produced
+	JobCounts struct {
+		Trips        int `json:"trips"`
+		SkippedTrips int `json:"skipped_trips"`
+		StopTimes    int `json:"stop_times"`
+	}
+
+	// JobStatus is GET /api/jobs/{id}
+	JobStatus struct {
+		ID         string          `json:"id"`
+		Status     string          `json:"status"`
+		Input      ExtractJobInput `json:"input"`
+		Progress   JobProgress     `json:"progress"`
+		Counts     JobCounts       `json:"counts"`
+		Errors     []string        `json:"errors"`
+		GTFS       string          `json:"gtfs,omitempty"`
+		CreatedAt  string          `json:"created_at"`
+		StartedAt  string          `json:"started_at,omitempty"`
+		FinishedAt string          `json:"finished_at,omitempty"`
+	}
+
+	// Job is an extraction running in background, all methods do
+	// nothing on nil so extraction from CLI is not affected
+	Job struct {
+		mu     sync.Mutex
+		status JobStatus
+		dir    string
+		// tripsLeft is number of trips not done yet of each box
+		tripsLeft map[string]int
+	}
+
+	// jobRegistry keeps jobs of the web server, only one job runs
+	// at a time as extraction starts from an empty stop_times
+	jobRegistry struct {
+		mu      sync.Mutex
+		jobs    map[string]*Job
+		running bool
+	}
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*Job)}
+}
+
+// start gives a new job unless one is running
+func (r *jobRegistry) start(input ExtractJobInput, outputDir string) (*Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		return nil, fmt.Errorf("another job is running")
+	}
+	id := RandString(12)
+	for r.jobs[id] != nil {
+		id = RandString(12)
+	}
+	job := &Job{
+		status: JobStatus{
+			ID:        id,
+			Status:    jobQueued,
+			Input:     input,
+			Errors:    []string{},
+			CreatedAt: time.Now().Format(time.RFC3339),
+		},
+		dir:       filepath.Join(outputDir, "jobs", id),
+		tripsLeft: make(map[string]int),
+	}
+	r.jobs[id] = job
+	r.running = true
+	return job, nil
+}
+
+func (r *jobRegistry) get(id string) *Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.jobs[id]
+}
+
+func (r *jobRegistry) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = false
+}
+
+func (j *Job) update(fn func(status *JobStatus)) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.status)
+}
+
+// snapshot is a copy of status safe to give out
+func (j *Job) snapshot() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Errors = append([]string{}, j.status.Errors...)
+	return status
+}
+
+func (j *Job) addError(msg string) {
+	j.update(func(status *JobStatus) {
+		if len(status.Errors) < jobMaxErrors {
+			status.Errors = append(status.Errors, msg)
+		}
+	})
+}
+
+// tripsFound adds trips of a direction to be processed
+func (j *Job) tripsFound(trips []Trip) {
+	j.update(func(status *JobStatus) {
+		for _, trip := range trips {
+			if j.tripsLeft[trip.BoxID] == 0 {
+				status.Progress.Boxes++
+			}
+			j.tripsLeft[trip.BoxID]++
+		}
+		status.Progress.Trips += len(trips)
+	})
+}
+
+// tripDone is called for every trip found, skipped is a trip of
+// another day than asked
+func (j *Job) tripDone(trip Trip, skipped bool) {
+	j.update(func(status *JobStatus) {
+		status.Progress.TripsDone++
+		j.tripsLeft[trip.BoxID]--
+		if j.tripsLeft[trip.BoxID] == 0 {
+			status.Progress.BoxesDone++
+		}
+		if skipped {
+			status.Counts.SkippedTrips++
+		} else {
+			status.Counts.Trips++
+		}
+	})
+}
+
+// stopTimeStored counts stop_times inserted or keeps why it failed
+func (j *Job) stopTimeStored(st StopTimeRaw, err error) {
+	if err != nil {
+		j.addError(fmt.Sprintf("stop_time %s %s: %v", st.TripID, st.StopID, err))
+		return
+	}
+	j.update(func(status *JobStatus) {
+		status.Counts.StopTimes++
+	})
+}
+
+// runExtractJob does what `gtfs` command does with the job input into
+// the job directory, the result is zipped for download. Only stop_times
+// of the route are replaced, the other routes are kept.
+func (h *Handler) runExtractJob(job *Job) {
+	jh := *h
+	input := job.snapshot().Input
+	jh.job = job
+	jh.day = input.Day
+	if input.Radius > 0 {
+		jh.rangeWithinStop = input.Radius / 1000
+	}
+	jh.outputDir = job.dir
+	jh.gtfs.Zip = filepath.Join(job.dir, "gtfs.zip")
+	defer h.jobs.finish()
+	fail := func(msg string) {
+		job.addError(msg)
+		job.update(func(status *JobStatus) {
+			status.Status = jobFailed
+			status.FinishedAt = time.Now().Format(time.RFC3339)
+		})
+	}
+	// a bug should fail the job, not the web server
+	defer func() {
+		if r := recover(); r != nil {
+			fail(fmt.Sprintf("%v", r))
+		}
+	}()
+
+	job.update(func(status *JobStatus) {
+		status.Status = jobRunning
+		status.StartedAt = time.Now().Format(time.RFC3339)
+	})
+	if err := os.MkdirAll(job.dir, 0755); err != nil {
+		fail(err.Error())
+		return
+	}
+	pairs := []routePair{{route: input.Route, routeRev: input.RouteRev}}
+	extracted, err := jh.RouteExtractor(pairs)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if err := jh.exportFeed(pairs, extracted); err != nil {
+		fail(err.Error())
+		return
+	}
+	job.update(func(status *JobStatus) {
+		status.Status = jobDone
+		status.GTFS = fmt.Sprintf("/api/jobs/%s/gtfs", status.ID)
+		status.FinishedAt = time.Now().Format(time.RFC3339)
+	})
+}
+
+// ExtractJobHandler starts trip extraction and GTFS export in background
+func (h *Handler) ExtractJobHandler(c echo.Context) error {
+	input := new(ExtractJobInput)
+	if err := c.Bind(input); err != nil {
+		return err
+	}
+	if err := c.Validate(input); err != nil {
+		return c.JSON(http.StatusBadRequest, Result{Failed: 1, Message: err.Error()})
+	}
+	if len(input.Day) > 0 {
+		if _, err := time.Parse("Mon", input.Day); err != nil {
+			msg := fmt.Sprintf("day: %s is not Mon, Tue, ...", input.Day)
+			return c.JSON(http.StatusBadRequest, Result{Failed: 1, Message: msg})
+		}
+	}
+	// extraction can't go on without both terminals
+	for _, route := range []string{input.Route, input.RouteRev} {
+		if len(route) == 0 {
+			continue
+		}
+		stops, err := h.store.RouteStops(route, "ASC", false)
+		if err != nil {
+			return err
+		}
+		if len(stops) < 2 {
+			msg := fmt.Sprintf("route %s needs at least 2 stops in stop_and_route", route)
+			return c.JSON(http.StatusBadRequest, Result{Failed: 1, Message: msg})
+		}
+	}
+	job, err := h.jobs.start(*input, h.outputDir)
+	if err != nil {
+		return c.JSON(http.StatusConflict, Result{Failed: 1, Message: err.Error()})
+	}
+	go h.runExtractJob(job)
+	return c.JSON(http.StatusAccepted, job.snapshot())
+}
+
+// JobStatusHandler gives status of a job
+func (h *Handler) JobStatusHandler(c echo.Context) error {
+	job := h.jobs.get(c.Param("id"))
+	if job == nil {
+		return c.JSON(http.StatusNotFound, Result{Message: fmt.Sprintf("job %s not found", c.Param("id"))})
+	}
+	return c.JSON(http.StatusOK, job.snapshot())
+}
+
+// JobGTFSHandler gives the GTFS feed (zip) of a job which is done
+func (h *Handler) JobGTFSHandler(c echo.Context) error {
+	job := h.jobs.get(c.Param("id"))
+	if job == nil {
+		return c.JSON(http.StatusNotFound, Result{Message: fmt.Sprintf("job %s not found", c.Param("id"))})
+	}
+	if status := job.snapshot(); status.Status != jobDone {
+		return c.JSON(http.StatusConflict, Result{Message: fmt.Sprintf("job %s is %s", status.ID, status.Status)})
+	}
+	return c.Attachment(filepath.Join(job.dir, "gtfs.zip"), "gtfs.zip")
+}
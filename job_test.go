@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExtractJobFails(t *testing.T) {
+	h := newTestHandler(t)
+	h.outputDir = t.TempDir()
+	h.jobs = newJobRegistry()
+	job, err := h.jobs.start(ExtractJobInput{Route: "R9"}, h.outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.runExtractJob(job)
+	status := job.snapshot()
+	if status.Status != jobFailed || len(status.Errors) != 1 || len(status.FinishedAt) == 0 {
+		t.Errorf("status %s, errors %v, want failed with the error", status.Status, status.Errors)
+	}
+	if _, err := h.jobs.start(ExtractJobInput{Route: "R1"}, h.outputDir); err != nil {
+		t.Errorf("failed job is still running: %v", err)
+	}
+}
+
+func TestExtractJobKeepsOtherRoutes(t *testing.T) {
+	h := newTestHandler(t)
+	h.outputDir = t.TempDir()
+	h.jobs = newJobRegistry()
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	if err := h.store.InsertTraces(testRun("B1", testStops(), start)); err != nil {
+		t.Fatal(err)
+	}
+	other := StopTime{TripID: "R2__1", BoxID: "B2", StopID: "S1", Direction: "R2", Arrival: "2024-01-01T06:00:00Z"}
+	if err := h.store.InsertStopTime(other); err != nil {
+		t.Fatal(err)
+	}
+	job, _ := h.jobs.start(ExtractJobInput{Route: "R1"}, h.outputDir)
+	h.runExtractJob(job)
+	if status := job.snapshot(); status.Status != jobDone || status.Counts.Trips != 1 {
+		t.Fatalf("status %s, %d trips, errors %v", status.Status, status.Counts.Trips, status.Errors)
+	}
+	if stopTimes, _ := h.store.StopTimes(StopTimeFilter{Direction: "R2"}); len(stopTimes) != 1 {
+		t.Errorf("stop_times of R2 = %d, want 1", len(stopTimes))
+	}
+	if stopTimes, _ := h.store.StopTimes(StopTimeFilter{Direction: "R1"}); len(stopTimes) != len(testStops()) {
+		t.Errorf("stop_times of R1 = %d, want %d", len(stopTimes), len(testStops()))
+	}
+}
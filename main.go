@@ -1,11 +1,11 @@
 package main
 
 import (
-	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	ini "gopkg.in/ini.v1"
 )
@@ -16,7 +16,9 @@ var (
 	day       = flag.String("day", "", "Filtered day (Mon, Tue, ...)")
 	route     = flag.String("rt", "", "route_id")
 	routeRev  = flag.String("rtrv", "", "route_id for reverse (use the same route if not specified)")
-	radius    = flag.Int("radius", 50, "Radius in meter for checking stop")
+	radius    = flag.Int("radius", 50, "Radius in meter for checking stop (override range_km_within_stop in my.ini)")
+	timezone  = flag.String("tz", "", "Service timezone (override timezone in my.ini)")
+	mode      = flag.String("mode", "observed", "GTFS trips: observed, timetable or frequency")
 )
 
 var usage = `Usage: trip_extractor [options...] <cmd>
@@ -24,25 +26,51 @@ Options:
   -v        verbosely
   -dir      GTFS output directory
   -day      Filtered day (Mon, Tue, ...) default: no filter
-  -rt       route_id (1)
-  -rtrv     [optional] route_id (2) for reverse
-            (use the same route_id if not specified)
-  -radius   Radius (m) for stop detection
-            (50m as default)
+  -rt       route_id (1), comma-separated route_ids or "all" for
+            every route in stop_and_route (gen, gtfs)
+  -rtrv     [optional] route_id (2) for reverse of a single route
+            (<route_id>-rev or the same route_id if not specified)
+  -radius   Radius (m) for stop detection of stops without their own
+            radius or geofence (range_km_within_stop in my.ini as default)
+  -tz       Service timezone, e.g. Asia/Bangkok
+            (timezone in my.ini or Asia/Bangkok as default)
+  -mode     GTFS trips to export
+              observed:  every observed run is a trip (default)
+              timetable: planned trips from runs of many days
+              frequency: frequencies.txt for periods of regular headway
 
 Command:
 
   initdb      to create all necessary tables
   web         to serve web
   gen         to generate timetable
-  gtfs        to generate GTFS feed: stop_times.txt
+  gtfs        to generate GTFS feed (see [gtfs] in my.ini)
+  schedule    to print timetable synthesized from stop_times (after gen)
+  stats       to print travel time of trips and stop pairs (after gen)
+              of a direction (-rt) and a day (-day) if specified
+  headway     to print headway at each stop (after gen), bunching and gaps
+              with -v, of a direction (-rt) and a day (-day) if specified
+  dwell       to print dwell time at each stop (after gen) and write
+              dwell.csv, long_dwells.csv into -dir
+  duty        to print trips each box ran in a row (blocks) and its duty
+              by day (after gen), of a day (-day) if specified, and write
+              blocks.csv, duties.csv into -dir
   flushdb     to drop all and create new tables
   geom_regen  to update all records with "geom type" from lat, lon fields
+  import-stops <file.csv>
+              to load stops from CSV (stop_id, stop_name, stop_lat, stop_lon)
+  import-traces <file.csv>
+              to load traces from CSV (box_id, timestamp, lat, lon)
+  import-gtfs <feed.zip>
+              to load stops and route patterns from GTFS feed
+  otp <feed.zip>
+              to compare trips of the route (-rt) with planned trips in
+              GTFS feed and write otp.csv into -dir
 `
 
 func usageAndExit(msg string) {
 	if msg != "" {
-		fmt.Fprintf(os.Stderr, msg)
+		fmt.Fprint(os.Stderr, msg)
 		fmt.Fprintf(os.Stderr, "\n\n")
 	}
 	flag.Usage()
@@ -62,22 +90,49 @@ func main() {
 	CheckError("Fail to read my.ini", err)
 
 	port := cfg.Section("app").Key("port").String()
+	dbDriver := cfg.Section("db").Key("driver").MustString("postgres")
 	dbConn := cfg.Section("db").Key("path").String()
 	rangeWithinStop, err := cfg.Section("app").Key("range_km_within_stop").Float64()
 	if err != nil {
 		log.Fatal("range_km_within_stop cannot be casted to float64")
 	}
-	db, err := sql.Open("postgres", dbConn)
-	defer db.Close()
+	// -radius overrides my.ini only when it is given
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "radius" {
+			rangeWithinStop = float64(*radius) / 1000
+		}
+	})
+	tzName := cfg.Section("app").Key("timezone").MustString("Asia/Bangkok")
+	if len(*timezone) > 0 {
+		tzName = *timezone
+	}
+	loc, err := time.LoadLocation(tzName)
+	CheckError(fmt.Sprintf("Unknown timezone %s: ", tzName), err)
+	gtfsConf := defaultGTFSConfig()
+	err = cfg.Section("gtfs").MapTo(&gtfsConf)
+	CheckError("Fail to read [gtfs] in my.ini: ", err)
+	statsConf := defaultStatsConfig()
+	err = cfg.Section("stats").MapTo(&statsConf)
+	CheckError("Fail to read [stats] in my.ini: ", err)
+	tripConf := defaultTripConfig()
+	err = cfg.Section("trip").MapTo(&tripConf)
+	CheckError("Fail to read [trip] in my.ini: ", err)
+	store, err := openStore(dbDriver, dbConn)
 	CheckError("Fail to connect to db server", err)
+	defer store.Close()
 
 	h := &Handler{
-		db:              db,
+		store:           store,
 		port:            port,
 		rangeWithinStop: rangeWithinStop,
 		verbose:         *verbose,
 		outputDir:       *outputDir,
 		day:             *day,
+		loc:             loc,
+		gtfs:            gtfsConf,
+		mode:            *mode,
+		stats:           statsConf,
+		trip:            tripConf,
 	}
 	args := flag.Args()
 
@@ -89,23 +144,57 @@ func main() {
 	case "initdb":
 
 		fmt.Printf("Database Initialization? ")
-		err := h.InitDB()
-		if err != nil {
+		err := h.store.Init()
+		if err == nil {
 			fmt.Print("yes")
 		} else {
 			fmt.Printf("no because %+v", err)
 		}
 
 	case "flushdb":
-		err := h.FlushDatabase()
+		err := h.store.Flush()
 		CheckError("Database flush error: ", err)
 		fmt.Println("Database flushed")
 
 	case "geom_regen":
-		err := h.GeomRegenerate()
+		err := h.store.GeomRegenerate()
 		CheckError("GEOM regeneration error: ", err)
 		fmt.Println("GEOM updated")
 
+	case "import-stops", "import-traces":
+		if len(args) < 2 {
+			usageAndExit("No CSV file specified")
+		}
+		file, err := os.Open(args[1])
+		CheckError("Cannot open file: ", err)
+		defer file.Close()
+		loader := h.StopCSVLoader
+		if args[0] == "import-traces" {
+			loader = h.TraceCSVLoader
+		}
+		result, err := loader(file)
+		CheckError("Import error: ", err)
+		fmt.Printf("success: %d, failed: %d\n", result.Success, result.Failed)
+		if len(result.Message) > 0 {
+			fmt.Println(result.Message)
+		}
+
+	case "import-gtfs":
+		if len(args) < 2 {
+			usageAndExit("No GTFS feed specified")
+		}
+		err := h.GTFSImporter(args[1])
+		CheckError("GTFS import error: ", err)
+
+	case "otp":
+		if len(args) < 2 {
+			usageAndExit("No GTFS feed specified")
+		}
+		if len(*route) == 0 {
+			usageAndExit("No route_id specified")
+		}
+		h.OTPReporter(args[1], *route, *routeRev)
+
 	case "gen":
 		if len(*route) == 0 {
 			usageAndExit("No route_id specified")
@@ -117,9 +206,32 @@ func main() {
 		// 	os.Exit(1)
 		// }
 		// fmt.Printf(" yes\n")
-		h.TripExtractor(*route, *routeRev)
+		pairs, err := h.routePairs(*route, *routeRev)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		_, err = h.TripExtractor(pairs)
+		CheckError("Trip extraction error: ", err)
+
+	case "schedule":
+		h.ScheduleReporter()
+
+	case "stats":
+		h.StatsReporter(*route)
+
+	case "headway":
+		h.HeadwayReporter(*route)
+
+	case "dwell":
+		h.DwellReporter(*route)
+
+	case "duty":
+		h.DutyReporter()
 
 	case "gtfs":
+		if *mode != "observed" && *mode != "timetable" && *mode != "frequency" {
+			usageAndExit(fmt.Sprintf("Unknown mode: %s", *mode))
+		}
 		if len(*route) == 0 {
 			usageAndExit("No route_id specified")
 		}
@@ -131,7 +243,12 @@ func main() {
 		// 	os.Exit(1)
 		// }
 		// fmt.Printf(" yes\n")
-		h.GTFSExporter(*route, *routeRev)
+		pairs, err := h.routePairs(*route, *routeRev)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		err = h.GTFSExporter(pairs)
+		CheckError("GTFS export error: ", err)
 
 	default:
 		usageAndExit("")
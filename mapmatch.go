@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// matchMaxSpeed (m/s) limits how far along the path a fix can be from
+// the previous one, so a fix is not matched to a later part of the
+// path which passes nearby
+const matchMaxSpeed = 30
+
+// matchedFix is a fix with its distance (m) along the path
+type matchedFix struct {
+	at    time.Time
+	along float64
+}
+
+// routePath gives the path of a direction for map-matching, for
+// direction of the route at stops and for distance of stops along it.
+// It is the path in route_paths (e.g. a shape from import-gtfs) or a
+// path through the stops.
+func (h *Handler) routePath(direction string, stops []Stop) (*Shape, error) {
+	if len(stops) < 2 {
+		return nil, nil
+	}
+	points, err := h.store.RoutePath(direction)
+	if err != nil {
+		return nil, fmt.Errorf("route path: %v", err)
+	}
+	if len(points) < 2 {
+		points = make([]ShapePoint, len(stops))
+		for ind, stop := range stops {
+			points[ind] = ShapePoint{Lat: stop.Lat, Lon: stop.Lon}
+		}
+	}
+	path := Shape{ID: direction, Points: withDistance(points)}
+	path.StopDists = path.stopDistances(stops)
+	h.LogPrint(fmt.Sprintf("path %s: %d points, %.0f m\n",
+		direction, len(path.Points), path.Points[len(path.Points)-1].Dist))
+	return &path, nil
+}
+
+// tripTimeTable gives observed stop times of a trip by map-matching on
+// path if [trip] map_matching is on or by radius around each stop, a
+// stop which is not observed is left empty
+func (h *Handler) tripTimeTable(t Trip, stops []Stop, d string, path *Shape) ([]StopTimeRaw, error) {
+	if h.trip.MapMatching && path != nil {
+		return h.MatchTripTimeTable(t, *path, stops, d)
+	}
+	return h.FindTripTimeTable(t, stops, d, path)
+}
+
+// MatchTripTimeTable projects traces of a trip onto the path, then a
+// stop is arrived when the box gets within radius (of the stop) before
+// the stop along the path and departed when it gets beyond radius after it.
+// A stop passed between 2 fixes is arrived at the interpolated time.
+func (h *Handler) MatchTripTimeTable(t Trip, path Shape, stops []Stop, d string) ([]StopTimeRaw, error) {
+	traces, err := h.store.TracesBetween(t.BoxID, t.Start, t.End)
+	if err != nil {
+		return nil, fmt.Errorf("matchTripTimeTable 00: %v", err)
+	}
+	// the trip starts when the box leaves the stop it begins at, the
+	// start of the path if it is not a stop of the path
+	startDist := 0.0
+	for ind, stop := range stops {
+		if stop.ID == t.BeginAt.ID {
+			startDist = path.StopDists[ind] + h.stopRadius(stop)*1000
+			break
+		}
+	}
+	fixes := h.matchFixes(path, traces, startDist)
+
+	results := make([]StopTimeRaw, len(stops))
+	next := 0
+	for ind, stop := range stops {
+		stopDist := path.StopDists[ind]
+		radius := h.stopRadius(stop) * 1000
+		for next < len(fixes) && fixes[next].along < stopDist-radius {
+			next++
+		}
+		if next == len(fixes) {
+			break
+		}
+		var arrival, departure time.Time
+		switch {
+		case fixes[next].along <= stopDist+radius:
+			// at the stop until the box gets beyond radius
+			arrival = fixes[next].at
+			departure = arrival
+			for k := next + 1; k < len(fixes) && fixes[k].along <= stopDist+radius; k++ {
+				departure = fixes[k].at
+			}
+		case next > 0:
+			// passed between 2 fixes
+			prev, cur := fixes[next-1], fixes[next]
+			frac := (stopDist - prev.along) / (cur.along - prev.along)
+			arrival = prev.at.Add(time.Duration(frac * float64(cur.at.Sub(prev.at))))
+			departure = arrival
+		default:
+			// passed before the first fix
+			continue
+		}
+		results[ind] = StopTimeRaw{
+			TripID:    t.ID,
+			StopID:    stop.ID,
+			Arrival:   arrival.Format(time.RFC3339),
+			Departure: departure.Format(time.RFC3339),
+			BoxID:     t.BoxID,
+			Sequence:  ind,
+			Direction: d,
+		}
+	}
+	return results, nil
+}
+
+// matchFixes gives distance along the path of each fix, a fix further
+// than match_max_offset from the path is left out. Distance never goes
+// backward so GPS jitter at a stop does not arrive at it twice. The
+// first fix is within match_max_offset beyond startDist, e.g. not at
+// the end of a loop path which comes back to where it starts.
+func (h *Handler) matchFixes(path Shape, traces []Trace, startDist float64) []matchedFix {
+	fixes := []matchedFix{}
+	along := 0.0
+	for _, trace := range traces {
+		at, err := time.Parse(time.RFC3339, trace.Timestamp)
+		if err != nil {
+			continue
+		}
+		toDist := startDist + h.trip.MatchMaxOffset
+		if len(fixes) > 0 {
+			reach := matchMaxSpeed * at.Sub(fixes[len(fixes)-1].at).Seconds()
+			toDist = along + math.Max(reach, h.trip.MatchMaxOffset)
+		}
+		dist, offset := path.project(ShapePoint{Lat: trace.Lat, Lon: trace.Lon}, along, toDist)
+		if offset > h.trip.MatchMaxOffset {
+			continue
+		}
+		along = dist
+		fixes = append(fixes, matchedFix{at, along})
+	}
+	return fixes
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchFixesLoopStart(t *testing.T) {
+	h := &Handler{trip: defaultTripConfig()}
+	// a loop of about 500 m a side coming back to where it starts
+	path := Shape{Points: withDistance([]ShapePoint{
+		{Lat: 13.75, Lon: 100.50},
+		{Lat: 13.75, Lon: 100.5046},
+		{Lat: 13.7545, Lon: 100.5046},
+		{Lat: 13.7545, Lon: 100.50},
+		{Lat: 13.75, Lon: 100.50},
+	})}
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	// the box waits at the terminal on the last side of the loop
+	traces := []Trace{
+		{Timestamp: start.Format(time.RFC3339), Lat: 13.7501, Lon: 100.50},
+		{Timestamp: start.Add(2 * time.Minute).Format(time.RFC3339), Lat: 13.75, Lon: 100.5046},
+	}
+	fixes := h.matchFixes(path, traces, 0)
+	if len(fixes) != 2 {
+		t.Fatalf("%d fixes, want 2", len(fixes))
+	}
+	if fixes[0].along > h.trip.MatchMaxOffset {
+		t.Errorf("first fix is %.0f m along, want at the start", fixes[0].along)
+	}
+	if fixes[1].along < 450 || fixes[1].along > 550 {
+		t.Errorf("second fix is %.0f m along, want about 500 m", fixes[1].along)
+	}
+}
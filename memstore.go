@@ -0,0 +1,594 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+type (
+	// memStore keeps everything in memory and optionally in a JSON file,
+	// so extraction can be run without postgreSQL + postgis
+	memStore struct {
+		mu   sync.RWMutex
+		path string
+		data memData
+		// keys indexes stop_times to find duplicates
+		keys map[stopTimeKey]bool
+		// dirty is set when data is not written yet, it is written
+		// memFlushDelay after the first change or on Close
+		dirty bool
+		timer *time.Timer
+	}
+
+	// stopTimeKey is what makes a stop_times row unique
+	stopTimeKey struct {
+		BoxID     string
+		StopID    string
+		Direction string
+		Arrival   string
+	}
+
+	// memData is what written to the JSON file
+	memData struct {
+		Stops      map[string]Stop             `json:"stops"`
+		RouteStops map[string][]RouteStopInput `json:"stop_and_route"`
+		Traces     map[string][]Trace          `json:"traces"`
+		StopTimes  []StopTime                  `json:"stop_times"`
+		RoutePaths map[string][]ShapePoint     `json:"route_paths,omitempty"`
+		Profiles   map[string][]SegmentProfile `json:"segment_profiles,omitempty"`
+	}
+)
+
+// memFlushDelay is how long changes are kept in memory before written
+const memFlushDelay = 2 * time.Second
+
+func newMemStore(path string) (*memStore, error) {
+	m := &memStore{path: path}
+	m.reset()
+	if len(path) == 0 {
+		return m, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &m.data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if m.data.Stops == nil || m.data.RouteStops == nil || m.data.Traces == nil {
+		m.reset()
+		return nil, fmt.Errorf("%s: not a trip extractor data file", path)
+	}
+	m.indexStopTimes()
+	return m, nil
+}
+
+func (m *memStore) reset() {
+	m.data = memData{
+		Stops:      make(map[string]Stop),
+		RouteStops: make(map[string][]RouteStopInput),
+		Traces:     make(map[string][]Trace),
+	}
+	m.indexStopTimes()
+}
+
+// indexStopTimes rebuilds keys from stop_times, caller must hold the lock
+func (m *memStore) indexStopTimes() {
+	m.keys = make(map[stopTimeKey]bool, len(m.data.StopTimes))
+	for _, st := range m.data.StopTimes {
+		m.keys[keyOfStopTime(st)] = true
+	}
+}
+
+func keyOfStopTime(st StopTime) stopTimeKey {
+	return stopTimeKey{BoxID: st.BoxID, StopID: st.StopID, Direction: st.Direction, Arrival: st.Arrival}
+}
+
+// save writes data to the file if any, caller must hold the lock
+func (m *memStore) save() error {
+	if len(m.path) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(m.data)
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+// changed marks data to be written later, caller must hold the lock
+func (m *memStore) changed() {
+	if len(m.path) == 0 {
+		return
+	}
+	m.dirty = true
+	if m.timer == nil {
+		m.timer = time.AfterFunc(memFlushDelay, m.flushLater)
+	}
+}
+
+// flushLater writes changes down after memFlushDelay
+func (m *memStore) flushLater() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timer = nil
+	if !m.dirty {
+		return
+	}
+	if err := m.save(); err != nil {
+		log.Println("memory store:", err)
+	}
+}
+
+// Close writes everything down
+func (m *memStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if !m.dirty {
+		return nil
+	}
+	return m.save()
+}
+
+// Init creates the data file
+func (m *memStore) Init() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.save()
+}
+
+// Flush drops everything
+func (m *memStore) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reset()
+	m.changed()
+	return nil
+}
+
+// Truncate removes all stops, traces and stop_times
+func (m *memStore) Truncate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.Stops = make(map[string]Stop)
+	m.data.Traces = make(map[string][]Trace)
+	m.data.StopTimes = nil
+	m.indexStopTimes()
+	m.changed()
+	return nil
+}
+
+// TruncateStopTimes removes all stop_times
+func (m *memStore) TruncateStopTimes() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.StopTimes = nil
+	m.indexStopTimes()
+	m.changed()
+	return nil
+}
+
+// DeleteStopTimes removes stop_times of directions
+func (m *memStore) DeleteStopTimes(directions []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := make(map[string]bool, len(directions))
+	for _, direction := range directions {
+		deleted[direction] = true
+	}
+	kept := m.data.StopTimes[:0]
+	for _, st := range m.data.StopTimes {
+		if !deleted[st.Direction] {
+			kept = append(kept, st)
+		}
+	}
+	m.data.StopTimes = kept
+	m.indexStopTimes()
+	m.changed()
+	return nil
+}
+
+// GeomRegenerate has nothing to do, distance is computed on the fly
+func (m *memStore) GeomRegenerate() error {
+	return nil
+}
+
+// Count returns number of items in asking table
+func (m *memStore) Count(tbl string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	count := 0
+	switch tbl {
+	case "stops":
+		count = len(m.data.Stops)
+	case "stop_and_route":
+		for _, stops := range m.data.RouteStops {
+			count += len(stops)
+		}
+	case "traces":
+		for _, traces := range m.data.Traces {
+			count += len(traces)
+		}
+	case "stop_times":
+		count = len(m.data.StopTimes)
+	default:
+		return 0, errUndefinedTable
+	}
+	return count, nil
+}
+
+// InsertStop adds a stop
+func (m *memStore) InsertStop(stop Stop) error {
+	return m.InsertStops([]Stop{stop})
+}
+
+// InsertStops adds stops at once
+func (m *memStore) InsertStops(stops []Stop) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[string]bool, len(stops))
+	for _, stop := range stops {
+		if _, ok := m.data.Stops[stop.ID]; ok || seen[stop.ID] {
+			return fmt.Errorf("duplicate stop_id: %s", stop.ID)
+		}
+		seen[stop.ID] = true
+	}
+	for _, stop := range stops {
+		stop.Sequence = 0
+		stop.IsTerminal = false
+		m.data.Stops[stop.ID] = stop
+	}
+	m.changed()
+	return nil
+}
+
+// MissingStops returns stop_id(s) which are not in stops
+func (m *memStore) MissingStops(ids []string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	missing := []string{}
+	for _, id := range ids {
+		if _, ok := m.data.Stops[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	return missing, nil
+}
+
+// UpsertRouteStops replaces stop pattern of a route
+func (m *memStore) UpsertRouteStops(route string, stops []RouteStopInput) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !sameRouteStops(m.data.RouteStops[route], stops) {
+		// the reverse is made from the route if it has no stops
+		delete(m.data.Profiles, route)
+		delete(m.data.Profiles, fmt.Sprintf("%s-rev", route))
+	}
+	m.data.RouteStops[route] = append([]RouteStopInput{}, stops...)
+	m.changed()
+	return nil
+}
+
+// RoutePath returns path of a route in order
+func (m *memStore) RoutePath(route string) ([]ShapePoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]ShapePoint{}, m.data.RoutePaths[route]...), nil
+}
+
+// UpsertRoutePath replaces path of a route
+func (m *memStore) UpsertRoutePath(route string, points []ShapePoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data.RoutePaths == nil {
+		m.data.RoutePaths = make(map[string][]ShapePoint)
+	}
+	m.data.RoutePaths[route] = append([]ShapePoint{}, points...)
+	m.changed()
+	return nil
+}
+
+// SegmentProfiles returns profile of a direction ordered by sequence
+func (m *memStore) SegmentProfiles(direction string) ([]SegmentProfile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]SegmentProfile{}, m.data.Profiles[direction]...), nil
+}
+
+// UpsertSegmentProfiles replaces profile of a direction
+func (m *memStore) UpsertSegmentProfiles(direction string, profiles []SegmentProfile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data.Profiles == nil {
+		m.data.Profiles = make(map[string][]SegmentProfile)
+	}
+	sorted := append([]SegmentProfile{}, profiles...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Sequence < sorted[j].Sequence })
+	m.data.Profiles[direction] = sorted
+	m.changed()
+	return nil
+}
+
+// RouteStops returns stops of a route ordered by sequence
+func (m *memStore) RouteStops(route string, order string, onlyTerminal bool) ([]Stop, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	routes := []string{route}
+	if len(route) == 0 {
+		routes = routes[:0]
+		for rt := range m.data.RouteStops {
+			routes = append(routes, rt)
+		}
+		sort.Strings(routes)
+	}
+	var stops []Stop
+	for _, rt := range routes {
+		for ind, ele := range m.data.RouteStops[rt] {
+			if onlyTerminal && !ele.IsTerminal {
+				continue
+			}
+			stop := m.data.Stops[ele.StopID]
+			stop.ID = ele.StopID
+			stop.Sequence = ind + 1
+			stop.IsTerminal = ele.IsTerminal
+			stops = append(stops, stop)
+		}
+	}
+	sort.SliceStable(stops, func(i, j int) bool {
+		if order != "ASC" {
+			return stops[i].Sequence > stops[j].Sequence
+		}
+		return stops[i].Sequence < stops[j].Sequence
+	})
+	return stops, nil
+}
+
+// InsertTrace adds a GPS trace
+func (m *memStore) InsertTrace(trace Trace) error {
+	return m.InsertTraces([]Trace{trace})
+}
+
+// InsertTraces adds traces at once, traces of a box are kept in time order
+func (m *memStore) InsertTraces(traces []Trace) error {
+	added := make(map[string][]Trace)
+	for _, trace := range traces {
+		t, err := time.Parse(time.RFC3339, trace.Timestamp)
+		if err != nil {
+			return err
+		}
+		trace.Timestamp = t.UTC().Format(time.RFC3339)
+		added[trace.BoxID] = append(added[trace.BoxID], trace)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	merged := make(map[string][]Trace, len(added))
+	for boxID, boxTraces := range added {
+		all := append(append([]Trace{}, m.data.Traces[boxID]...), boxTraces...)
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].Timestamp < all[j].Timestamp
+		})
+		for ind := 1; ind < len(all); ind++ {
+			if all[ind].Timestamp == all[ind-1].Timestamp {
+				return fmt.Errorf("duplicate trace: %s at %s", boxID, all[ind].Timestamp)
+			}
+		}
+		merged[boxID] = all
+	}
+	for boxID, all := range merged {
+		m.data.Traces[boxID] = all
+	}
+	m.changed()
+	return nil
+}
+
+// boxIDs returns all box_id in order, caller must hold the lock
+func (m *memStore) boxIDs() []string {
+	boxes := make([]string, 0, len(m.data.Traces))
+	for boxID := range m.data.Traces {
+		boxes = append(boxes, boxID)
+	}
+	sort.Strings(boxes)
+	return boxes
+}
+
+// TracesNear returns traces at any given stop
+func (m *memStore) TracesNear(stops []Stop, radius float64) ([]Trace, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var result []Trace
+	for _, boxID := range m.boxIDs() {
+		for _, trace := range m.data.Traces[boxID] {
+			pnt := geo.NewPoint(trace.Lat, trace.Lon)
+			for _, stop := range stops {
+				if stopContains(stop, radius, pnt) {
+					result = append(result, trace)
+					break
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// TracesBetween returns traces of a box in [start, end]
+func (m *memStore) TracesBetween(boxID string, start string, end string) ([]Trace, error) {
+	t1, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return nil, err
+	}
+	t2, err := time.Parse(time.RFC3339, end)
+	if err != nil {
+		return nil, err
+	}
+	begin := t1.UTC().Format(time.RFC3339)
+	finish := t2.UTC().Format(time.RFC3339)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var result []Trace
+	for _, trace := range m.data.Traces[boxID] {
+		if trace.Timestamp >= begin && trace.Timestamp <= finish {
+			result = append(result, trace)
+		}
+	}
+	return result, nil
+}
+
+// InsertStopTime adds a stop_times row
+func (m *memStore) InsertStopTime(st StopTime) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := keyOfStopTime(st)
+	if m.keys[key] {
+		return fmt.Errorf("duplicate stop_time: %s %s at %s", st.BoxID, st.StopID, st.Arrival)
+	}
+	m.keys[key] = true
+	m.data.StopTimes = append(m.data.StopTimes, st)
+	m.changed()
+	return nil
+}
+
+// StopTimes return stop_times ordered by direction and arrival
+func (m *memStore) StopTimes(filter StopTimeFilter) ([]StopTime, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var trips map[string]bool
+	if filter.byTrip() {
+		page := m.trips(filter)
+		if filter.Offset >= len(page) {
+			page = nil
+		} else {
+			page = page[filter.Offset:]
+		}
+		if filter.Limit > 0 && filter.Limit < len(page) {
+			page = page[:filter.Limit]
+		}
+		trips = make(map[string]bool, len(page))
+		for _, tripID := range page {
+			trips[tripID] = true
+		}
+	}
+	var result []StopTime
+	for _, st := range m.data.StopTimes {
+		if !filter.matchRow(st) {
+			continue
+		}
+		if len(filter.StopID) > 0 && st.StopID != filter.StopID {
+			continue
+		}
+		if len(filter.Source) > 0 && st.Source != filter.Source {
+			continue
+		}
+		if trips != nil && !trips[st.TripID] {
+			continue
+		}
+		result = append(result, st)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Direction != result[j].Direction {
+			return result[i].Direction < result[j].Direction
+		}
+		return arrivalBefore(result[i].Arrival, result[j].Arrival)
+	})
+	return result, nil
+}
+
+// CountTrips returns number of trips in stop_times
+func (m *memStore) CountTrips(filter StopTimeFilter) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.trips(filter)), nil
+}
+
+// trips gives trip_id of trips of the filter ordered by start, caller
+// must hold the lock
+func (m *memStore) trips(filter StopTimeFilter) []string {
+	starts := make(map[string]time.Time)
+	for _, st := range m.data.StopTimes {
+		if len(st.TripID) == 0 || !filter.matchRow(st) {
+			continue
+		}
+		arrival, _ := time.Parse(time.RFC3339, st.Arrival)
+		if start, ok := starts[st.TripID]; !ok || arrival.Before(start) {
+			starts[st.TripID] = arrival
+		}
+	}
+	tripIDs := []string{}
+	for tripID, start := range starts {
+		if !filter.From.IsZero() && start.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !start.Before(filter.To) {
+			continue
+		}
+		if len(filter.Weekday) > 0 && start.In(filter.location()).Format("Mon") != filter.Weekday {
+			continue
+		}
+		tripIDs = append(tripIDs, tripID)
+	}
+	sort.Slice(tripIDs, func(i, j int) bool {
+		a, b := starts[tripIDs[i]], starts[tripIDs[j]]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return tripIDs[i] < tripIDs[j]
+	})
+	return tripIDs
+}
+
+// Routes returns distinct route_id in stop_and_route
+func (m *memStore) Routes() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	routes := make([]string, 0, len(m.data.RouteStops))
+	for route := range m.data.RouteStops {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	return routes, nil
+}
+
+// Directions returns distinct direction in stop_times
+func (m *memStore) Directions() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := make(map[string]bool)
+	directions := []string{}
+	for _, st := range m.data.StopTimes {
+		if !seen[st.Direction] {
+			seen[st.Direction] = true
+			directions = append(directions, st.Direction)
+		}
+	}
+	sort.Strings(directions)
+	return directions, nil
+}
+
+// arrivalBefore compares 2 RFC3339 timestamps which may be in different zones
+func arrivalBefore(a string, b string) bool {
+	t1, _ := time.Parse(time.RFC3339, a)
+	t2, _ := time.Parse(time.RFC3339, b)
+	return t1.Before(t2)
+}
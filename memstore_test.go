@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemStoreDuplicateStopTime(t *testing.T) {
+	store, _ := newMemStore("")
+	st := StopTime{BoxID: "B1", StopID: "S1", Direction: "R1", Arrival: "2024-01-01T08:00:00Z"}
+	if err := store.InsertStopTime(st); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertStopTime(st); err == nil {
+		t.Error("duplicate stop_time is added")
+	}
+	st.Direction = "R1-rev"
+	if err := store.InsertStopTime(st); err != nil {
+		t.Errorf("stop_time of another direction: %v", err)
+	}
+	if err := store.TruncateStopTimes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertStopTime(st); err != nil {
+		t.Errorf("stop_time after truncate: %v", err)
+	}
+}
+
+func TestMemStoreWritesOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store, err := newMemStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"S1", "S2"} {
+		if err := store.InsertStop(Stop{ID: id, Lat: 13.75, Lon: 100.50}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("data file is written on every insert: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newMemStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := reopened.Count("stops"); count != 2 {
+		t.Errorf("stops after reopen = %d, want 2", count)
+	}
+}
+
+func TestMemStoreTripPage(t *testing.T) {
+	store, _ := newMemStore("")
+	// 2024-01-05 is friday, 2024-01-06 saturday
+	rows := []StopTime{
+		{TripID: "R1__2", Direction: "R1", StopID: "S1", Arrival: "2024-01-05T09:00:00Z"},
+		{TripID: "R1__2", Direction: "R1", StopID: "S2", Arrival: "2024-01-05T09:10:00Z"},
+		{TripID: "R1__1", Direction: "R1", StopID: "S1", Arrival: "2024-01-05T08:00:00Z"},
+		{TripID: "R1-rev__1", Direction: "R1-rev", StopID: "S2", Arrival: "2024-01-05T08:30:00Z"},
+		{TripID: "R1__3", Direction: "R1", StopID: "S1", Arrival: "2024-01-06T08:00:00Z"},
+		{Direction: "R1", StopID: "S1", Arrival: "2024-01-05T07:00:00Z"},
+	}
+	for _, st := range rows {
+		if err := store.InsertStopTime(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		filter StopTimeFilter
+		total  int
+		trips  []string
+	}{
+		{StopTimeFilter{Limit: 2}, 4, []string{"R1__1", "R1-rev__1"}},
+		{StopTimeFilter{Limit: 2, Offset: 2}, 4, []string{"R1__2", "R1__3"}},
+		{StopTimeFilter{Direction: "R1", Weekday: "Fri"}, 2, []string{"R1__1", "R1__2"}},
+		{StopTimeFilter{Directions: []string{"R1", "R1-rev"}, To: time.Date(2024, 1, 5, 8, 30, 0, 0, time.UTC)}, 1, []string{"R1__1"}},
+		{StopTimeFilter{From: time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC), Offset: 1}, 1, []string{}},
+	}
+	for _, c := range cases {
+		total, _ := store.CountTrips(c.filter)
+		stopTimes, _ := store.StopTimes(c.filter)
+		seen := make(map[string]bool)
+		for _, st := range stopTimes {
+			seen[st.TripID] = true
+		}
+		if total != c.total || len(seen) != len(c.trips) {
+			t.Errorf("%+v: %d trips of %d, want %v of %d", c.filter, len(seen), total, c.trips, c.total)
+			continue
+		}
+		for _, tripID := range c.trips {
+			if !seen[tripID] {
+				t.Errorf("%+v: %s is not in the page", c.filter, tripID)
+			}
+		}
+	}
+}
+
+func TestMemStoreRouteStopsDropProfile(t *testing.T) {
+	store, _ := newMemStore("")
+	stops := []RouteStopInput{{StopID: "S1", IsTerminal: true}, {StopID: "S2", IsTerminal: true}}
+	if err := store.UpsertRouteStops("R1", stops); err != nil {
+		t.Fatal(err)
+	}
+	for _, direction := range []string{"R1", "R1-rev"} {
+		if err := store.UpsertSegmentProfiles(direction, []SegmentProfile{{Direction: direction, Travel: 60, TravelSamples: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.UpsertRouteStops("R1", stops); err != nil {
+		t.Fatal(err)
+	}
+	if profiles, _ := store.SegmentProfiles("R1"); len(profiles) != 1 {
+		t.Errorf("profile is dropped when stops are the same")
+	}
+	stops = append(stops[:1], RouteStopInput{StopID: "S3", IsTerminal: true})
+	if err := store.UpsertRouteStops("R1", stops); err != nil {
+		t.Fatal(err)
+	}
+	for _, direction := range []string{"R1", "R1-rev"} {
+		if profiles, _ := store.SegmentProfiles(direction); len(profiles) != 0 {
+			t.Errorf("profile of %s is kept when stops change: %+v", direction, profiles)
+		}
+	}
+}
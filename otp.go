@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	s "strings"
+	"time"
+)
+
+const (
+	otpEarly  = "early"
+	otpOnTime = "on_time"
+	otpLate   = "late"
+	// otpMaxMatch (second) is the most a trip can depart apart from the
+	// planned trip it is matched to
+	otpMaxMatch = 1800
+)
+
+type (
+	// plannedStopTime is a row of stop_times.txt of the planned feed,
+	// times are seconds since the service day
+	plannedStopTime struct {
+		StopID    string
+		Sequence  int
+		Arrival   int
+		Departure int
+	}
+
+	// plannedTrip is a trip of the planned feed with its stop_times
+	plannedTrip struct {
+		TripID      string
+		RouteID     string
+		ServiceID   string
+		DirectionID string
+		StopTimes   []plannedStopTime
+	}
+
+	// plannedService is calendar.txt and calendar_dates.txt of a service
+	plannedService struct {
+		Days      [7]bool // by time.Weekday
+		StartDate string
+		EndDate   string
+		Added     map[string]bool
+		Removed   map[string]bool
+	}
+
+	// plannedFeed is what is needed from the planned GTFS to compare with
+	plannedFeed struct {
+		Trips []plannedTrip
+		// Services is nil if the feed has no calendar at all
+		Services map[string]*plannedService
+	}
+
+	// otpDeviation is how much (second) a stop of a trip is off the plan,
+	// positive is late
+	otpDeviation struct {
+		TripID        string
+		PlannedTripID string
+		Direction     string
+		Sequence      int
+		StopID        string
+		Planned       string
+		Actual        string
+		Deviation     int
+		Status        string
+	}
+
+	// otpSummary is on-time performance of a stop or a direction
+	otpSummary struct {
+		StopID   string
+		Sequence int
+		Count    int
+		Early    int
+		OnTime   int
+		Late     int
+		devs     []int
+	}
+)
+
+// weekday flags in calendar.txt from sunday, as time.Weekday
+var calendarDays = [7]string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// parseGTFSTime gives seconds of HH:MM:SS which can be over 24:00:00
+func parseGTFSTime(value string) (int, error) {
+	parts := s.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("%s is not HH:MM:SS", value)
+	}
+	secs := 0
+	for _, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("%s is not HH:MM:SS", value)
+		}
+		secs = secs*60 + num
+	}
+	return secs, nil
+}
+
+// loadPlannedFeed reads trips, stop_times and calendar of routes from a
+// GTFS feed (zip)
+func loadPlannedFeed(feed string, routeIDs map[string]bool) (plannedFeed, error) {
+	planned := plannedFeed{}
+	archive, files, err := openGTFSFiles(feed)
+	if err != nil {
+		return planned, err
+	}
+	defer archive.Close()
+
+	br := &bulkResult{}
+	index := make(map[string]int)
+	err = readGTFSFile(files, "trips.txt", []string{"route_id", "service_id", "trip_id"}, br,
+		func(line int, row csvRow) error {
+			if !routeIDs[row("route_id")] {
+				return nil
+			}
+			index[row("trip_id")] = len(planned.Trips)
+			planned.Trips = append(planned.Trips, plannedTrip{
+				TripID:      row("trip_id"),
+				RouteID:     row("route_id"),
+				ServiceID:   row("service_id"),
+				DirectionID: row("direction_id"),
+			})
+			return nil
+		})
+	if err != nil {
+		return planned, err
+	}
+	required := []string{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence"}
+	err = readGTFSFile(files, "stop_times.txt", required, br,
+		func(line int, row csvRow) error {
+			ind, ok := index[row("trip_id")]
+			if !ok {
+				return nil
+			}
+			// times may be left out between timepoints
+			if len(row("arrival_time")) == 0 && len(row("departure_time")) == 0 {
+				return nil
+			}
+			st := plannedStopTime{StopID: row("stop_id")}
+			var err error
+			if st.Sequence, err = strconv.Atoi(row("stop_sequence")); err != nil {
+				return fmt.Errorf("stop_sequence: %v", err)
+			}
+			arrival, departure := row("arrival_time"), row("departure_time")
+			if len(arrival) == 0 {
+				arrival = departure
+			}
+			if len(departure) == 0 {
+				departure = arrival
+			}
+			if st.Arrival, err = parseGTFSTime(arrival); err != nil {
+				return err
+			}
+			if st.Departure, err = parseGTFSTime(departure); err != nil {
+				return err
+			}
+			planned.Trips[ind].StopTimes = append(planned.Trips[ind].StopTimes, st)
+			return nil
+		})
+	if err != nil {
+		return planned, err
+	}
+	for _, trip := range planned.Trips {
+		sort.Slice(trip.StopTimes, func(i, j int) bool {
+			return trip.StopTimes[i].Sequence < trip.StopTimes[j].Sequence
+		})
+	}
+
+	// calendar is optional, every trip runs every day without it
+	service := func(id string) *plannedService {
+		if planned.Services == nil {
+			planned.Services = make(map[string]*plannedService)
+		}
+		if planned.Services[id] == nil {
+			planned.Services[id] = &plannedService{Added: make(map[string]bool), Removed: make(map[string]bool)}
+		}
+		return planned.Services[id]
+	}
+	if _, ok := files["calendar.txt"]; ok {
+		err = readGTFSFile(files, "calendar.txt", []string{"service_id", "start_date", "end_date"}, br,
+			func(line int, row csvRow) error {
+				srv := service(row("service_id"))
+				for day, name := range calendarDays {
+					srv.Days[day] = row(name) == "1"
+				}
+				srv.StartDate, srv.EndDate = row("start_date"), row("end_date")
+				return nil
+			})
+		if err != nil {
+			return planned, err
+		}
+	}
+	if _, ok := files["calendar_dates.txt"]; ok {
+		err = readGTFSFile(files, "calendar_dates.txt", []string{"service_id", "date", "exception_type"}, br,
+			func(line int, row csvRow) error {
+				srv := service(row("service_id"))
+				switch row("exception_type") {
+				case "1":
+					srv.Added[row("date")] = true
+				case "2":
+					srv.Removed[row("date")] = true
+				}
+				return nil
+			})
+		if err != nil {
+			return planned, err
+		}
+	}
+	if br.Failed > 0 {
+		fmt.Printf("skipped %d line(s): %s\n", br.Failed, br.result().Message)
+	}
+	return planned, nil
+}
+
+// runsOn tells if a service runs on the service day
+func (p plannedFeed) runsOn(serviceID string, day time.Time) bool {
+	if p.Services == nil {
+		return true
+	}
+	srv, ok := p.Services[serviceID]
+	if !ok {
+		return false
+	}
+	date := day.Format(gtfsDate)
+	if srv.Removed[date] {
+		return false
+	}
+	if srv.Added[date] {
+		return true
+	}
+	return srv.Days[day.Weekday()] && date >= srv.StartDate && date <= srv.EndDate
+}
+
+// plannedAt gives index of the first stop_time at the stop from index
+// from on, -1 if none. A loop trip passes its first stop again at the end.
+func (trip plannedTrip) plannedAt(stopID string, from int) int {
+	for ind := from; ind < len(trip.StopTimes); ind++ {
+		if trip.StopTimes[ind].StopID == stopID {
+			return ind
+		}
+	}
+	return -1
+}
+
+// matchPlannedTrip picks the planned trip of the same direction running
+// on the day which departs the first stop of the run closest in time.
+// direction_id is only checked for trips of the route itself as the
+// reverse route (-rtrv) may have its own route_id.
+func (h *Handler) matchPlannedTrip(planned plannedFeed, run FeedTrip, route string) (plannedTrip, bool) {
+	first, last := run.StopTimes[0], run.StopTimes[len(run.StopTimes)-1]
+	directionID := fmt.Sprintf("%d", run.DirectionID)
+	day := h.serviceDay(first.Arrival)
+	departed, _ := time.Parse(time.RFC3339, first.Departure)
+	actual := int(departed.Sub(day).Seconds())
+	best, bestDiff := plannedTrip{}, math.MaxInt32
+	for _, trip := range planned.Trips {
+		if trip.RouteID == route && len(trip.DirectionID) > 0 && trip.DirectionID != directionID {
+			continue
+		}
+		// the planned trip has to go the same way
+		at := trip.plannedAt(first.StopID, 0)
+		if at == -1 || trip.plannedAt(last.StopID, at+1) == -1 || !planned.runsOn(trip.ServiceID, day) {
+			continue
+		}
+		diff := trip.StopTimes[at].Departure - actual
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < bestDiff {
+			best, bestDiff = trip, diff
+		}
+	}
+	return best, bestDiff <= otpMaxMatch
+}
+
+// otpStatus tells early, on_time or late by [stats] on-time window
+func (h *Handler) otpStatus(deviation int) string {
+	switch {
+	case float64(deviation) < -h.stats.OnTimeEarly*60:
+		return otpEarly
+	case float64(deviation) > h.stats.OnTimeLate*60:
+		return otpLate
+	}
+	return otpOnTime
+}
+
+func (sum *otpSummary) add(dev otpDeviation) {
+	sum.Count++
+	sum.devs = append(sum.devs, dev.Deviation)
+	switch dev.Status {
+	case otpEarly:
+		sum.Early++
+	case otpLate:
+		sum.Late++
+	default:
+		sum.OnTime++
+	}
+}
+
+func (sum *otpSummary) percent(count int) float64 {
+	if sum.Count == 0 {
+		return 0
+	}
+	return float64(count) / float64(sum.Count) * 100
+}
+
+// OTPReporter compares extracted trips of the route with planned trips
+// in a GTFS feed and prints deviation and on-time percentage at each
+// stop, every deviation is written to otp.csv in output directory
+func (h *Handler) OTPReporter(feed string, route string, routeRev string) {
+	stopDirection, reverse, err := h.routeDirections(route, routeRev)
+	CheckError("Route error: ", err)
+	routeIDs := map[string]bool{route: true, reverse: true}
+	planned, err := loadPlannedFeed(feed, routeIDs)
+	CheckError("Cannot read planned GTFS: ", err)
+	if len(planned.Trips) == 0 {
+		fmt.Printf("No planned trip of %s in %s\n", route, feed)
+		return
+	}
+	// stop_times and segment profiles are left as they are
+	extracted, err := h.extractTripWithRoute(route, routeRev, false)
+	CheckError("Trip extraction error: ", err)
+	trips := h.buildFeedTrips(extracted, route)
+
+	devs := []otpDeviation{}
+	unmatched := 0
+	for _, run := range trips {
+		match, ok := h.matchPlannedTrip(planned, run, route)
+		if !ok {
+			unmatched++
+			h.LogPrint(fmt.Sprintf("%s: no planned trip\n", run.TripID))
+			continue
+		}
+		day := h.serviceDay(run.StopTimes[0].Arrival)
+		next := 0
+		for ind, st := range run.StopTimes {
+			at := match.plannedAt(st.StopID, next)
+			if at == -1 {
+				continue
+			}
+			next = at + 1
+			// departure from the first stop, arrival at the others
+			actual, plan := st.Arrival, match.StopTimes[at].Arrival
+			if ind == 0 {
+				actual, plan = st.Departure, match.StopTimes[at].Departure
+			}
+			actualAt, _ := time.Parse(time.RFC3339, actual)
+			deviation := int(actualAt.Sub(day).Seconds()) - plan
+			devs = append(devs, otpDeviation{
+				TripID:        run.TripID,
+				PlannedTripID: match.TripID,
+				Direction:     st.Direction,
+				Sequence:      st.Sequence + 1,
+				StopID:        st.StopID,
+				Planned:       secondsToGTFSTime(plan),
+				Actual:        gtfsTime(actual, day),
+				Deviation:     deviation,
+				Status:        h.otpStatus(deviation),
+			})
+		}
+	}
+	fmt.Printf("\n%d trip(s) matched, %d without planned trip within %d min\n",
+		len(trips)-unmatched, unmatched, otpMaxMatch/60)
+	fmt.Printf("on time: %.0f min early to %.0f min late\n", h.stats.OnTimeEarly, h.stats.OnTimeLate)
+
+	for _, direction := range []string{route, reverse} {
+		total := otpSummary{}
+		byStop := make([]otpSummary, len(stopDirection[direction]))
+		for ind, stop := range stopDirection[direction] {
+			byStop[ind] = otpSummary{StopID: stop.ID, Sequence: ind + 1}
+		}
+		for _, dev := range devs {
+			if dev.Direction != direction {
+				continue
+			}
+			total.add(dev)
+			if dev.Sequence-1 < len(byStop) {
+				byStop[dev.Sequence-1].add(dev)
+			}
+		}
+		fmt.Printf("\n%s\n", direction)
+		fmt.Printf("  %-3s %-10s %4s %7s %7s %6s %6s %6s\n",
+			"#", "stop_id", "n", "mean", "median", "early", "ontime", "late")
+		for _, sum := range append(byStop, total) {
+			if sum.Count == 0 {
+				continue
+			}
+			label := fmt.Sprintf("  %-3d %-10.10s", sum.Sequence, sum.StopID)
+			if len(sum.StopID) == 0 {
+				label = fmt.Sprintf("  %-14s", "all")
+			}
+			mean := 0
+			for _, dev := range sum.devs {
+				mean += dev
+			}
+			fmt.Printf("%s %4d %6.1fm %6.1fm %5.0f%% %5.0f%% %5.0f%%\n", label, sum.Count,
+				float64(mean)/float64(sum.Count)/60, float64(medianInt(sum.devs))/60,
+				sum.percent(sum.Early), sum.percent(sum.OnTime), sum.percent(sum.Late))
+		}
+	}
+
+	// make sure we have "output"
+	_ = os.Mkdir(h.outputDir, 0755)
+	h.OTPExporter(devs)
+	fmt.Printf("\ndeviations: %s/otp.csv\n", h.outputDir)
+}
+
+// OTPExporter will give otp.csv
+func (h *Handler) OTPExporter(devs []otpDeviation) {
+	file, err := os.Create(fmt.Sprintf("%s/otp.csv", h.outputDir))
+	CheckError("cannot create file", err)
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+	// header
+	headerRow := []string{
+		"trip_id", "planned_trip_id", "direction", "stop_sequence", "stop_id",
+		"planned_time", "actual_time", "deviation", "status"}
+	err = writer.Write(headerRow)
+	CheckError("Cannot write to file [ote0] ", err)
+	for _, dev := range devs {
+		row := []string{
+			dev.TripID,
+			dev.PlannedTripID,
+			dev.Direction,
+			fmt.Sprintf("%d", dev.Sequence),
+			dev.StopID,
+			dev.Planned,
+			dev.Actual,
+			fmt.Sprintf("%d", dev.Deviation),
+			dev.Status,
+		}
+		err = writer.Write(row)
+		CheckError("Cannot write to file [ote1] ", err)
+	}
+}
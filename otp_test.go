@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGTFSTime(t *testing.T) {
+	cases := []struct {
+		value string
+		want  int
+		fails bool
+	}{
+		{"00:00:00", 0, false},
+		{"08:05:30", 8*3600 + 5*60 + 30, false},
+		{"25:10:00", 25*3600 + 10*60, false},
+		{"8:05", 0, true},
+		{"08:xx:00", 0, true},
+	}
+	for _, c := range cases {
+		got, err := parseGTFSTime(c.value)
+		if (err != nil) != c.fails {
+			t.Errorf("parseGTFSTime(%s) error = %v", c.value, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseGTFSTime(%s) = %d, want %d", c.value, got, c.want)
+		}
+	}
+}
+
+func TestRunsOn(t *testing.T) {
+	weekdays := &plannedService{
+		StartDate: "20240101",
+		EndDate:   "20240131",
+		Added:     map[string]bool{"20240106": true},
+		Removed:   map[string]bool{"20240105": true},
+	}
+	for day := time.Monday; day <= time.Friday; day++ {
+		weekdays.Days[day] = true
+	}
+	planned := plannedFeed{Services: map[string]*plannedService{"WD": weekdays}}
+	cases := []struct {
+		service string
+		date    string
+		want    bool
+	}{
+		{"WD", "20240104", true},  // thursday
+		{"WD", "20240105", false}, // friday, removed
+		{"WD", "20240106", true},  // saturday, added
+		{"WD", "20240107", false}, // sunday
+		{"WD", "20240201", false}, // after end_date
+		{"XX", "20240104", false}, // no such service
+	}
+	for _, c := range cases {
+		day, _ := time.Parse(gtfsDate, c.date)
+		if got := planned.runsOn(c.service, day); got != c.want {
+			t.Errorf("runsOn(%s, %s) = %v, want %v", c.service, c.date, got, c.want)
+		}
+	}
+	day, _ := time.Parse(gtfsDate, "20240107")
+	if !(plannedFeed{}).runsOn("XX", day) {
+		t.Error("every service runs without calendar")
+	}
+}
+
+// plannedAtStops gives a planned trip departing the stops every 5 min
+// from the departure (second)
+func plannedAtStops(tripID string, departure int, stopIDs ...string) plannedTrip {
+	trip := plannedTrip{TripID: tripID, RouteID: "R1", ServiceID: "WD"}
+	for ind, stopID := range stopIDs {
+		at := departure + ind*300
+		trip.StopTimes = append(trip.StopTimes, plannedStopTime{
+			StopID: stopID, Sequence: ind + 1, Arrival: at, Departure: at,
+		})
+	}
+	return trip
+}
+
+func TestMatchPlannedTrip(t *testing.T) {
+	h := newTestHandler(t)
+	planned := plannedFeed{Trips: []plannedTrip{
+		plannedAtStops("T0800", 8*3600, "S1", "S2", "S3"),
+		plannedAtStops("T0830", 8*3600+1800, "S1", "S2", "S3"),
+		plannedAtStops("REV0805", 8*3600+300, "S3", "S2", "S1"),
+		plannedAtStops("LOOP0900", 9*3600, "S1", "S2", "S3", "S1"),
+	}}
+	run := func(depart string, stopIDs ...string) FeedTrip {
+		at, _ := time.Parse(time.RFC3339, "2024-01-04T"+depart+"Z")
+		trip := FeedTrip{TripID: "R1__1", DirectionID: 0}
+		for ind, stopID := range stopIDs {
+			ts := at.Add(time.Duration(ind) * 5 * time.Minute).Format(time.RFC3339)
+			trip.StopTimes = append(trip.StopTimes, StopTimeRaw{StopID: stopID, Arrival: ts, Departure: ts})
+		}
+		return trip
+	}
+	cases := []struct {
+		name  string
+		run   FeedTrip
+		want  string
+		found bool
+	}{
+		{"closest departure", run("08:10:00", "S1", "S2", "S3"), "T0800", true},
+		{"later one", run("08:20:00", "S1", "S2", "S3"), "T0830", true},
+		{"other way", run("08:06:00", "S3", "S2", "S1"), "REV0805", true},
+		{"loop", run("09:02:00", "S1", "S2", "S3", "S1"), "LOOP0900", true},
+		{"too far", run("11:00:00", "S1", "S2", "S3"), "", false},
+	}
+	for _, c := range cases {
+		match, ok := h.matchPlannedTrip(planned, c.run, "R1")
+		if ok != c.found || (ok && match.TripID != c.want) {
+			t.Errorf("%s: matched %s (%v), want %s (%v)", c.name, match.TripID, ok, c.want, c.found)
+		}
+	}
+}
+
+func TestOTPStatus(t *testing.T) {
+	h := &Handler{stats: defaultStatsConfig()}
+	// 1 min early to 5 min late is on time
+	cases := map[int]string{
+		-61: otpEarly,
+		-60: otpOnTime,
+		0:   otpOnTime,
+		300: otpOnTime,
+		301: otpLate,
+	}
+	for deviation, want := range cases {
+		if got := h.otpStatus(deviation); got != want {
+			t.Errorf("otpStatus(%d) = %s, want %s", deviation, got, want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	s "strings"
+	"time"
+)
+
+// ServicePattern is a service_id in calendar.txt, a group of weekdays
+// which have about the same trips
+type ServicePattern struct {
+	ID   string
+	Days [7]bool // by time.Weekday
+	// RemovedDates is YYYYMMDD of the days which no trip was observed
+	RemovedDates []string
+	// Dates is YYYYMMDD of the days a service without Days runs
+	Dates []string
+}
+
+// serviceProfile is average number of trips per direction and hour
+type serviceProfile map[string]float64
+
+// weekdayAbbr is used to name a service of arbitrary days
+var weekdayAbbr = [7]string{"Su", "Mo", "Tu", "We", "Th", "Fr", "Sa"}
+
+// derivePatterns groups weekdays with similar trips into service patterns
+// and sets service_id of each trip by the weekday it was observed.
+// [gtfs] service_id is used for every day if it's set instead.
+func (h *Handler) derivePatterns(trips []FeedTrip, startDate string, endDate string) []ServicePattern {
+	if len(h.gtfs.ServiceID) > 0 {
+		pattern := ServicePattern{ID: h.gtfs.ServiceID}
+		for day := range pattern.Days {
+			pattern.Days[day] = true
+		}
+		for ind := range trips {
+			trips[ind].ServiceID = pattern.ID
+		}
+		return []ServicePattern{pattern}
+	}
+
+	// profile of each weekday
+	dates := make(map[string]bool)
+	datesOfWeekday := make(map[time.Weekday]map[string]bool)
+	counts := make(map[time.Weekday]serviceProfile)
+	for _, trip := range trips {
+		day := h.serviceDay(trip.StopTimes[0].Arrival)
+		t, _ := time.Parse(time.RFC3339, trip.StopTimes[0].Arrival)
+		weekday := day.Weekday()
+		if counts[weekday] == nil {
+			counts[weekday] = make(serviceProfile)
+			datesOfWeekday[weekday] = make(map[string]bool)
+		}
+		key := fmt.Sprintf("%s@%02d", trip.StopTimes[0].Direction, int(t.Sub(day).Hours()))
+		counts[weekday][key]++
+		datesOfWeekday[weekday][day.Format(gtfsDate)] = true
+		dates[day.Format(gtfsDate)] = true
+	}
+	clusters := [][]time.Weekday{}
+	profiles := []serviceProfile{}
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if counts[weekday] == nil {
+			continue
+		}
+		profile := make(serviceProfile, len(counts[weekday]))
+		for key, count := range counts[weekday] {
+			profile[key] = count / float64(len(datesOfWeekday[weekday]))
+		}
+		clusters = append(clusters, []time.Weekday{weekday})
+		profiles = append(profiles, profile)
+	}
+
+	// merge the most similar clusters until nothing is similar enough
+	for len(clusters) > 1 {
+		bestI, bestJ, best := -1, -1, 0.0
+		for i := range clusters {
+			for j := i + 1; j < len(clusters); j++ {
+				if sim := profileSimilarity(profiles[i], profiles[j]); sim > best {
+					bestI, bestJ, best = i, j, sim
+				}
+			}
+		}
+		if best < h.gtfs.ServiceSimilarity {
+			break
+		}
+		profiles[bestI] = mergeProfiles(profiles[bestI], len(clusters[bestI]), profiles[bestJ], len(clusters[bestJ]))
+		clusters[bestI] = append(clusters[bestI], clusters[bestJ]...)
+		clusters = append(clusters[:bestJ], clusters[bestJ+1:]...)
+		profiles = append(profiles[:bestJ], profiles[bestJ+1:]...)
+	}
+
+	patterns := make([]ServicePattern, len(clusters))
+	serviceOf := make(map[time.Weekday]string)
+	for ind, cluster := range clusters {
+		for _, weekday := range cluster {
+			patterns[ind].Days[weekday] = true
+		}
+		patterns[ind].ID = servicePatternID(patterns[ind].Days)
+		for _, weekday := range cluster {
+			serviceOf[weekday] = patterns[ind].ID
+		}
+		if h.gtfs.RemoveUnobservedDates {
+			patterns[ind].RemovedDates = unobservedDates(patterns[ind].Days, dates, startDate, endDate)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		return patterns[i].ID < patterns[j].ID
+	})
+	for ind, trip := range trips {
+		weekday := h.serviceDay(trip.StopTimes[0].Arrival).Weekday()
+		trips[ind].ServiceID = serviceOf[weekday]
+	}
+	for _, pattern := range patterns {
+		h.LogPrint(fmt.Sprintf("service %s: %s\n", pattern.ID, describeDays(pattern.Days)))
+	}
+	return patterns
+}
+
+// observedServices gives a service for each day trips were observed, an
+// observed run happened on its day only and would be multiplied by a
+// service of weekdays. service_id of each trip is its day (YYYYMMDD).
+func (h *Handler) observedServices(trips []FeedTrip) []ServicePattern {
+	seen := make(map[string]bool)
+	patterns := []ServicePattern{}
+	for ind, trip := range trips {
+		date := h.serviceDay(trip.StopTimes[0].Arrival).Format(gtfsDate)
+		trips[ind].ServiceID = date
+		if !seen[date] {
+			seen[date] = true
+			patterns = append(patterns, ServicePattern{ID: date, Dates: []string{date}})
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		return patterns[i].ID < patterns[j].ID
+	})
+	return patterns
+}
+
+// profileSimilarity is weighted Jaccard similarity, 1 if they are the same
+func profileSimilarity(a serviceProfile, b serviceProfile) float64 {
+	sumMin, sumMax := 0.0, 0.0
+	for key, va := range a {
+		vb := b[key]
+		sumMin += math.Min(va, vb)
+		sumMax += math.Max(va, vb)
+	}
+	for key, vb := range b {
+		if _, ok := a[key]; !ok {
+			sumMax += vb
+		}
+	}
+	if sumMax == 0 {
+		return 1
+	}
+	return sumMin / sumMax
+}
+
+// mergeProfiles gives average profile of 2 clusters by their size
+func mergeProfiles(a serviceProfile, na int, b serviceProfile, nb int) serviceProfile {
+	result := make(serviceProfile)
+	for key, va := range a {
+		result[key] += va * float64(na)
+	}
+	for key, vb := range b {
+		result[key] += vb * float64(nb)
+	}
+	for key := range result {
+		result[key] /= float64(na + nb)
+	}
+	return result
+}
+
+// servicePatternID names common patterns, the rest is like "MoWeFr"
+func servicePatternID(days [7]bool) string {
+	name := ""
+	for weekday, on := range days {
+		if on {
+			name += weekdayAbbr[weekday]
+		}
+	}
+	switch name {
+	case "SuMoTuWeThFrSa":
+		return "DAILY"
+	case "MoTuWeThFr":
+		return "WEEKDAY"
+	case "SuSa":
+		return "WEEKEND"
+	case "Sa":
+		return "SATURDAY"
+	case "Su":
+		return "SUNDAY"
+	}
+	return name
+}
+
+// unobservedDates gives dates of the pattern in [startDate, endDate]
+// which no trip was observed at all
+func unobservedDates(days [7]bool, observed map[string]bool, startDate string, endDate string) []string {
+	start, err1 := time.Parse(gtfsDate, startDate)
+	end, err2 := time.Parse(gtfsDate, endDate)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	removed := []string{}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		if days[day.Weekday()] && !observed[day.Format(gtfsDate)] {
+			removed = append(removed, day.Format(gtfsDate))
+		}
+	}
+	return removed
+}
+
+// weekdayFlags gives "1"/"0" from monday to sunday as in calendar.txt
+func weekdayFlags(days [7]bool) []string {
+	flags := make([]string, 7)
+	for ind := range flags {
+		// calendar.txt starts from monday
+		if days[(ind+1)%7] {
+			flags[ind] = "1"
+		} else {
+			flags[ind] = "0"
+		}
+	}
+	return flags
+}
+
+// describeDays is for printing a pattern, e.g. "Mon,Tue"
+func describeDays(days [7]bool) string {
+	names := []string{}
+	for weekday, on := range days {
+		if on {
+			names = append(names, time.Weekday(weekday).String()[:3])
+		}
+	}
+	return s.Join(names, ",")
+}
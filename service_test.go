@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDerivePatterns(t *testing.T) {
+	h := &Handler{loc: time.UTC, gtfs: defaultGTFSConfig()}
+	trips := []FeedTrip{}
+	add := func(day time.Time, hours ...int) {
+		for _, hour := range hours {
+			arrival := day.Add(time.Duration(hour) * time.Hour).Format(time.RFC3339)
+			trips = append(trips, FeedTrip{StopTimes: []StopTimeRaw{{Direction: "R1", Arrival: arrival}}})
+		}
+	}
+	// 2024-01-01 is monday, the same trips from monday to friday
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for weekday := 0; weekday < 5; weekday++ {
+		add(monday.AddDate(0, 0, weekday), 7, 8, 9)
+	}
+	add(monday.AddDate(0, 0, 5), 10)
+
+	patterns := h.derivePatterns(trips, "20240101", "20240106")
+	if len(patterns) != 2 || patterns[0].ID != "SATURDAY" || patterns[1].ID != "WEEKDAY" {
+		t.Fatalf("patterns = %+v, want SATURDAY and WEEKDAY", patterns)
+	}
+	for ind, trip := range trips {
+		want := "WEEKDAY"
+		if ind == len(trips)-1 {
+			want = "SATURDAY"
+		}
+		if trip.ServiceID != want {
+			t.Errorf("trip %d: service_id %s, want %s", ind, trip.ServiceID, want)
+		}
+	}
+
+	h.gtfs.ServiceID = "ALL"
+	patterns = h.derivePatterns(trips, "20240101", "20240106")
+	if len(patterns) != 1 || patterns[0].ID != "ALL" || trips[0].ServiceID != "ALL" {
+		t.Errorf("[gtfs] service_id: patterns = %+v", patterns)
+	}
+}
+
+func TestObservedServices(t *testing.T) {
+	h := &Handler{loc: time.UTC, gtfs: defaultGTFSConfig()}
+	trips := []FeedTrip{}
+	for _, arrival := range []string{"2024-01-02T08:00:00Z", "2024-01-01T08:00:00Z", "2024-01-01T09:00:00Z"} {
+		trips = append(trips, FeedTrip{StopTimes: []StopTimeRaw{{Direction: "R1", Arrival: arrival}}})
+	}
+	patterns := h.observedServices(trips)
+	if len(patterns) != 2 || patterns[0].ID != "20240101" || patterns[1].ID != "20240102" {
+		t.Fatalf("patterns = %+v, want 20240101 and 20240102", patterns)
+	}
+	for _, pattern := range patterns {
+		if len(pattern.Dates) != 1 || pattern.Dates[0] != pattern.ID || pattern.Days != [7]bool{} {
+			t.Errorf("pattern %s runs on %v %v, want its day only", pattern.ID, pattern.Days, pattern.Dates)
+		}
+	}
+	for ind, want := range []string{"20240102", "20240101", "20240101"} {
+		if trips[ind].ServiceID != want {
+			t.Errorf("trip %d: service_id %s, want %s", ind, trips[ind].ServiceID, want)
+		}
+	}
+}
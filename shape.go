@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+type (
+	// ShapePoint is a point of shape with distance (m) from the beginning
+	ShapePoint struct {
+		Lat  float64 `json:"lat"`
+		Lon  float64 `json:"lon"`
+		Dist float64 `json:"-"`
+	}
+
+	// Shape is a path of a route direction built from GPS traces
+	Shape struct {
+		ID     string
+		Points []ShapePoint
+		// StopDists is distance along the shape of each stop by sequence
+		StopDists []float64
+	}
+)
+
+const (
+	// earthRadius in meter for local projection
+	earthRadius = 6371008.8
+	// shapeMaxCandidates is max number of trips considered per direction
+	shapeMaxCandidates = 50
+)
+
+// buildShapes makes a shape for each direction from the trace of its
+// representative trip and sets shape_id to all trips of the direction
+func (h *Handler) buildShapes(trips []FeedTrip, stopDirection map[string][]Stop) ([]Shape, error) {
+	tripsByDirection := make(map[string][]int)
+	directions := []string{}
+	for ind, trip := range trips {
+		direction := trip.StopTimes[0].Direction
+		if _, ok := tripsByDirection[direction]; !ok {
+			directions = append(directions, direction)
+		}
+		tripsByDirection[direction] = append(tripsByDirection[direction], ind)
+	}
+	shapes := []Shape{}
+	for _, direction := range directions {
+		points, err := h.representativeTrace(trips, tripsByDirection[direction])
+		if err != nil {
+			return nil, err
+		}
+		if len(points) < 2 {
+			fmt.Printf("shape %s: not enough traces\n", direction)
+			continue
+		}
+		points = douglasPeucker(points, h.gtfs.ShapeTolerance)
+		shape := Shape{
+			ID:     fmt.Sprintf("shape_%s", direction),
+			Points: withDistance(points),
+		}
+		shape.StopDists = shape.stopDistances(stopDirection[direction])
+		shapes = append(shapes, shape)
+		for _, ind := range tripsByDirection[direction] {
+			trips[ind].ShapeID = shape.ID
+			trips[ind].ShapeDists = shape.StopDists
+		}
+		h.LogPrint(fmt.Sprintf("shape %s: %d points, %.0f m\n",
+			shape.ID, len(shape.Points), shape.Points[len(shape.Points)-1].Dist))
+	}
+	return shapes, nil
+}
+
+// representativeTrace picks the trace of a trip whose length is the
+// median of all candidates, so detours and GPS gaps are left out
+func (h *Handler) representativeTrace(trips []FeedTrip, candidates []int) ([]ShapePoint, error) {
+	if len(candidates) > shapeMaxCandidates {
+		candidates = candidates[:shapeMaxCandidates]
+	}
+	type candidate struct {
+		points []ShapePoint
+		length float64
+	}
+	traced := []candidate{}
+	for _, ind := range candidates {
+		stopTimes := trips[ind].StopTimes
+		first, last := stopTimes[0], stopTimes[len(stopTimes)-1]
+		traces, err := h.store.TracesBetween(first.BoxID, first.Arrival, last.Departure)
+		if err != nil {
+			return nil, fmt.Errorf("shape traces: %v", err)
+		}
+		if len(traces) < 2 {
+			continue
+		}
+		points := make([]ShapePoint, len(traces))
+		for i, trace := range traces {
+			points[i] = ShapePoint{Lat: trace.Lat, Lon: trace.Lon}
+		}
+		points = withDistance(points)
+		traced = append(traced, candidate{points, points[len(points)-1].Dist})
+	}
+	if len(traced) == 0 {
+		return nil, nil
+	}
+	sort.Slice(traced, func(i, j int) bool {
+		return traced[i].length < traced[j].length
+	})
+	return traced[len(traced)/2].points, nil
+}
+
+// withDistance fills Dist as cumulative distance (m) along points
+func withDistance(points []ShapePoint) []ShapePoint {
+	result := make([]ShapePoint, len(points))
+	for ind, pnt := range points {
+		result[ind] = pnt
+		if ind == 0 {
+			result[ind].Dist = 0
+			continue
+		}
+		prev := result[ind-1]
+		d := geo.NewPoint(prev.Lat, prev.Lon).GreatCircleDistance(geo.NewPoint(pnt.Lat, pnt.Lon))
+		result[ind].Dist = prev.Dist + d*1000
+	}
+	return result
+}
+
+// toXY projects a point to meter around the reference latitude
+func toXY(pnt ShapePoint, refLat float64) (float64, float64) {
+	rad := math.Pi / 180
+	return pnt.Lon * rad * earthRadius * math.Cos(refLat*rad), pnt.Lat * rad * earthRadius
+}
+
+// segmentProjection gives how far (0..1) along a-b is the closest
+// point to p and the distance (m) to it
+func segmentProjection(p ShapePoint, a ShapePoint, b ShapePoint) (float64, float64) {
+	px, py := toXY(p, a.Lat)
+	ax, ay := toXY(a, a.Lat)
+	bx, by := toXY(b, a.Lat)
+	dx, dy := bx-ax, by-ay
+	frac := 0.0
+	if lenSq := dx*dx + dy*dy; lenSq > 0 {
+		frac = ((px-ax)*dx + (py-ay)*dy) / lenSq
+		frac = math.Max(0, math.Min(1, frac))
+	}
+	cx, cy := ax+frac*dx, ay+frac*dy
+	return frac, math.Hypot(px-cx, py-cy)
+}
+
+// douglasPeucker simplifies points with tolerance in meter
+func douglasPeucker(points []ShapePoint, tolerance float64) []ShapePoint {
+	if len(points) < 3 || tolerance <= 0 {
+		return points
+	}
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		maxDist, maxInd := 0.0, -1
+		for ind := first + 1; ind < last; ind++ {
+			_, d := segmentProjection(points[ind], points[first], points[last])
+			if d > maxDist {
+				maxDist, maxInd = d, ind
+			}
+		}
+		if maxInd != -1 && maxDist > tolerance {
+			keep[maxInd] = true
+			stack = append(stack, [2]int{first, maxInd}, [2]int{maxInd, last})
+		}
+	}
+	result := []ShapePoint{}
+	for ind, pnt := range points {
+		if keep[ind] {
+			result = append(result, pnt)
+		}
+	}
+	return result
+}
+
+// locate gives distance along the shape of the closest point to p,
+// not before fromDist so stops keep going forward on the shape
+func (sh Shape) locate(p ShapePoint, fromDist float64) float64 {
+	along, _ := sh.project(p, fromDist, math.Inf(1))
+	return along
+}
+
+// project gives distance along the shape of the closest point to p
+// between fromDist and toDist, and how far (m) p is from the shape there
+func (sh Shape) project(p ShapePoint, fromDist float64, toDist float64) (float64, float64) {
+	best, bestDist := math.Inf(1), fromDist
+	for ind := 1; ind < len(sh.Points); ind++ {
+		a, b := sh.Points[ind-1], sh.Points[ind]
+		if b.Dist < fromDist {
+			continue
+		}
+		if a.Dist > toDist {
+			break
+		}
+		frac, d := segmentProjection(p, a, b)
+		along := a.Dist + frac*(b.Dist-a.Dist)
+		along = math.Max(fromDist, math.Min(toDist, along))
+		if d < best {
+			best, bestDist = d, along
+		}
+	}
+	return bestDist, best
+}
+
+// pointAt gives the point at distance (m) along the shape, an end of
+// the shape if dist is beyond it
+func (sh Shape) pointAt(dist float64) ShapePoint {
+	if len(sh.Points) == 0 {
+		return ShapePoint{}
+	}
+	if dist <= sh.Points[0].Dist {
+		return sh.Points[0]
+	}
+	for ind := 1; ind < len(sh.Points); ind++ {
+		a, b := sh.Points[ind-1], sh.Points[ind]
+		if dist > b.Dist {
+			continue
+		}
+		frac := 0.0
+		if b.Dist > a.Dist {
+			frac = (dist - a.Dist) / (b.Dist - a.Dist)
+		}
+		return ShapePoint{Lat: a.Lat + frac*(b.Lat-a.Lat), Lon: a.Lon + frac*(b.Lon-a.Lon), Dist: dist}
+	}
+	return sh.Points[len(sh.Points)-1]
+}
+
+// stopDistances gives distance along the shape of stops in sequence
+func (sh Shape) stopDistances(stops []Stop) []float64 {
+	dists := make([]float64, len(stops))
+	fromDist := 0.0
+	for ind, stop := range stops {
+		fromDist = sh.locate(ShapePoint{Lat: stop.Lat, Lon: stop.Lon}, fromDist)
+		dists[ind] = fromDist
+	}
+	return dists
+}
+
+// ShapeExporter will give shapes.txt
+func (h *Handler) ShapeExporter(shapes []Shape) error {
+	file, err := os.Create(fmt.Sprintf("%s/shapes.txt", h.outputDir))
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	// header
+	headerRow := []string{
+		"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence",
+		"shape_dist_traveled"}
+	err = writer.Write(headerRow)
+	if err != nil {
+		return fmt.Errorf("cannot write to file [she0]: %v", err)
+	}
+
+	for _, shape := range shapes {
+		for ind, pnt := range shape.Points {
+			row := []string{
+				shape.ID,
+				fmt.Sprintf("%f", pnt.Lat),
+				fmt.Sprintf("%f", pnt.Lon),
+				fmt.Sprintf("%d", ind+1),
+				fmt.Sprintf("%.1f", pnt.Dist),
+			}
+			err = writer.Write(row)
+			if err != nil {
+				return fmt.Errorf("cannot write to file [she1]: %v", err)
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
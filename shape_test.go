@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestDouglasPeucker(t *testing.T) {
+	// about 110 m apart eastward, the 3rd point is about 55 m off north
+	points := []ShapePoint{
+		{Lat: 13.75, Lon: 100.500},
+		{Lat: 13.75, Lon: 100.501},
+		{Lat: 13.7505, Lon: 100.502},
+		{Lat: 13.75, Lon: 100.503},
+		{Lat: 13.75, Lon: 100.504},
+	}
+	cases := []struct {
+		tolerance float64
+		want      []int
+	}{
+		{0, []int{0, 1, 2, 3, 4}},
+		{30, []int{0, 2, 4}},
+		{100, []int{0, 4}},
+	}
+	for _, c := range cases {
+		result := douglasPeucker(points, c.tolerance)
+		if len(result) != len(c.want) {
+			t.Errorf("tolerance %.0f: %d points, want %d", c.tolerance, len(result), len(c.want))
+			continue
+		}
+		for ind, pointInd := range c.want {
+			if result[ind] != points[pointInd] {
+				t.Errorf("tolerance %.0f: point %d = %+v, want %+v", c.tolerance, ind, result[ind], points[pointInd])
+			}
+		}
+	}
+	if result := douglasPeucker(points[:2], 10); len(result) != 2 {
+		t.Errorf("2 points: %d points, want 2", len(result))
+	}
+}
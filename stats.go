@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	s "strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type (
+	// StatsConfig is [stats] section in my.ini
+	StatsConfig struct {
+		// HourBand (hour) groups trips by the hour they start
+		HourBand int `ini:"hour_band"`
+		// BunchingFraction of the median headway, a shorter headway
+		// is bunching
+		BunchingFraction float64 `ini:"bunching_fraction"`
+		// GapFactor times of the median headway, a longer headway is a gap
+		GapFactor float64 `ini:"gap_factor"`
+		// LongDwell (second) at a stop other than terminals is flagged
+		LongDwell int `ini:"long_dwell"`
+		// OnTimeEarly and OnTimeLate (minute) is the window around
+		// planned time which is on time
+		OnTimeEarly float64 `ini:"on_time_early"`
+		OnTimeLate  float64 `ini:"on_time_late"`
+		// BlockMaxGap (minute) between trips of a box, a longer one ends
+		// the block as the box is out of service
+		BlockMaxGap float64 `ini:"block_max_gap"`
+	}
+
+	// DurationStats is summary of durations in second
+	DurationStats struct {
+		Count  int     `json:"count"`
+		Mean   float64 `json:"mean"`
+		Median float64 `json:"median"`
+		P85    float64 `json:"p85"`
+		P95    float64 `json:"p95"`
+		Min    float64 `json:"min"`
+		Max    float64 `json:"max"`
+	}
+
+	// SegmentStats is travel time from departure of a stop to arrival
+	// of the next one
+	SegmentStats struct {
+		Sequence   int    `json:"sequence"`
+		FromStopID string `json:"from_stop_id"`
+		ToStopID   string `json:"to_stop_id"`
+		DurationStats
+	}
+
+	// TravelTimeStats is travel time of trips of a direction, weekday
+	// and hour band, empty weekday or band is for all of them
+	TravelTimeStats struct {
+		Direction string         `json:"direction"`
+		Weekday   string         `json:"weekday"`
+		Band      string         `json:"band"`
+		Trip      DurationStats  `json:"trip"`
+		Segments  []SegmentStats `json:"segments"`
+	}
+
+	// travelTimeSamples is durations collected for a TravelTimeStats
+	travelTimeSamples struct {
+		trips    []float64
+		segments map[int][]float64
+		stops    map[int][2]string
+	}
+)
+
+func defaultStatsConfig() StatsConfig {
+	return StatsConfig{
+		HourBand:         1,
+		BunchingFraction: 0.5,
+		GapFactor:        2,
+		LongDwell:        120,
+		OnTimeEarly:      1,
+		OnTimeLate:       5,
+		BlockMaxGap:      60,
+	}
+}
+
+// weekdayOrder sorts weekday names from monday
+var weekdayOrder = map[string]int{
+	"": 0, "Mon": 1, "Tue": 2, "Wed": 3, "Thu": 4, "Fri": 5, "Sat": 6, "Sun": 7,
+}
+
+// travelTimeStats computes travel times of trips in stop_times by
+// direction, by direction and weekday, by direction and hour band and
+// by direction, weekday and hour band. Empty direction or weekday
+// means all.
+func (h *Handler) travelTimeStats(direction string, weekday string) ([]TravelTimeStats, error) {
+	stopTimes, err := h.store.StopTimes(StopTimeFilter{Direction: direction})
+	if err != nil {
+		return nil, err
+	}
+	samples := make(map[[3]string]*travelTimeSamples)
+	add := func(key [3]string, trip []StopTimeRaw) {
+		if samples[key] == nil {
+			samples[key] = &travelTimeSamples{
+				segments: make(map[int][]float64),
+				stops:    make(map[int][2]string),
+			}
+		}
+		sample := samples[key]
+		// estimated times are not travel times, a trip counts if both
+		// of its ends are observed and a segment if both of its stops
+		first, last := trip[0], trip[len(trip)-1]
+		if first.Source == sourceObserved && last.Source == sourceObserved {
+			sample.trips = append(sample.trips, durationBetween(first.Departure, last.Arrival).Seconds())
+		}
+		for ind := 1; ind < len(trip); ind++ {
+			from, to := trip[ind-1], trip[ind]
+			if to.Sequence != from.Sequence+1 || from.Source != sourceObserved || to.Source != sourceObserved {
+				continue
+			}
+			sample.segments[from.Sequence] = append(sample.segments[from.Sequence],
+				durationBetween(from.Departure, to.Arrival).Seconds())
+			sample.stops[from.Sequence] = [2]string{from.StopID, to.StopID}
+		}
+	}
+	for _, run := range observedRuns(stopTimes) {
+		trip := run.StopTimes
+		if len(trip) < 2 {
+			continue
+		}
+		start, _ := time.Parse(time.RFC3339, trip[0].Departure)
+		start = start.In(h.loc)
+		day := start.Format("Mon")
+		if len(weekday) > 0 && day != weekday {
+			continue
+		}
+		band := h.hourBand(start)
+		add([3]string{trip[0].Direction, "", ""}, trip)
+		add([3]string{trip[0].Direction, day, ""}, trip)
+		add([3]string{trip[0].Direction, "", band}, trip)
+		add([3]string{trip[0].Direction, day, band}, trip)
+	}
+
+	keys := make([][3]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		if keys[i][1] != keys[j][1] {
+			return weekdayOrder[keys[i][1]] < weekdayOrder[keys[j][1]]
+		}
+		return keys[i][2] < keys[j][2]
+	})
+	result := make([]TravelTimeStats, len(keys))
+	for ind, key := range keys {
+		sample := samples[key]
+		result[ind] = TravelTimeStats{
+			Direction: key[0],
+			Weekday:   key[1],
+			Band:      key[2],
+			Trip:      durationStats(sample.trips),
+			Segments:  []SegmentStats{},
+		}
+		sequences := make([]int, 0, len(sample.segments))
+		for seq := range sample.segments {
+			sequences = append(sequences, seq)
+		}
+		sort.Ints(sequences)
+		for _, seq := range sequences {
+			result[ind].Segments = append(result[ind].Segments, SegmentStats{
+				Sequence:      seq + 1,
+				FromStopID:    sample.stops[seq][0],
+				ToStopID:      sample.stops[seq][1],
+				DurationStats: durationStats(sample.segments[seq]),
+			})
+		}
+	}
+	return result, nil
+}
+
+// hourBand is label of the hour band t is in, e.g. 08:00-09:00, the
+// last band of a day ends at 24:00
+func (h *Handler) hourBand(t time.Time) string {
+	bandHours := h.stats.HourBand
+	if bandHours < 1 || bandHours > 24 {
+		bandHours = 1
+	}
+	bandStart := t.Hour() / bandHours * bandHours
+	bandEnd := bandStart + bandHours
+	if bandEnd > 24 {
+		bandEnd = 24
+	}
+	return fmt.Sprintf("%02d:00-%02d:00", bandStart, bandEnd)
+}
+
+// durationStats summarizes values
+func durationStats(values []float64) DurationStats {
+	if len(values) == 0 {
+		return DurationStats{}
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	return DurationStats{
+		Count:  len(sorted),
+		Mean:   sum / float64(len(sorted)),
+		Median: percentile(sorted, 50),
+		P85:    percentile(sorted, 85),
+		P95:    percentile(sorted, 95),
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+	}
+}
+
+// percentile of sorted values with linear interpolation, p is 0..100
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// StatsReporter prints travel time of trips and stop pairs in minute
+func (h *Handler) StatsReporter(direction string) {
+	stats, err := h.travelTimeStats(direction, h.day)
+	CheckError("Cannot read stop_times ", err)
+	if len(stats) == 0 {
+		fmt.Println("No stop_times with trip_id, run gen first")
+		return
+	}
+	minutes := func(ds DurationStats) string {
+		return fmt.Sprintf("%4d %6.1f %6.1f %6.1f %6.1f %6.1f %6.1f",
+			ds.Count, ds.Mean/60, ds.Median/60, ds.P85/60, ds.P95/60, ds.Min/60, ds.Max/60)
+	}
+	header := fmt.Sprintf("%-15s %4s %6s %6s %6s %6s %6s %6s",
+		"(minute)", "n", "mean", "median", "p85", "p95", "min", "max")
+	for _, stat := range stats {
+		title := "all trips"
+		switch {
+		case len(stat.Weekday) > 0 && len(stat.Band) > 0:
+			title = fmt.Sprintf("%s %s", stat.Weekday, stat.Band)
+		case len(stat.Weekday) > 0:
+			title = fmt.Sprintf("%s all day", stat.Weekday)
+		case len(stat.Band) > 0:
+			title = fmt.Sprintf("all days %s", stat.Band)
+		}
+		fmt.Printf("\n%s [%s]\n", stat.Direction, title)
+		fmt.Printf("  %s\n", header)
+		fmt.Printf("  %-15s %s\n", "trip", minutes(stat.Trip))
+		for _, seg := range stat.Segments {
+			pair := s.Join([]string{seg.FromStopID, seg.ToStopID}, "-")
+			fmt.Printf("  %-15.15s %s\n", pair, minutes(seg.DurationStats))
+		}
+	}
+}
+
+// TravelTimeStatsHandler gives travel time statistics, filtered by
+// direction and weekday (Mon, Tue, ...)
+func (h *Handler) TravelTimeStatsHandler(c echo.Context) error {
+	weekday := c.QueryParam("weekday")
+	if len(weekday) > 0 {
+		if _, err := time.Parse("Mon", weekday); err != nil {
+			return c.JSON(http.StatusBadRequest, Result{Message: fmt.Sprintf("weekday: %s is not Mon, Tue, ...", weekday)})
+		}
+	}
+	stats, err := h.travelTimeStats(c.QueryParam("direction"), weekday)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, stats)
+}
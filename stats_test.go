@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHourBand(t *testing.T) {
+	h := &Handler{stats: defaultStatsConfig()}
+	h.stats.HourBand = 5
+	cases := map[int]string{
+		0:  "00:00-05:00",
+		9:  "05:00-10:00",
+		22: "20:00-24:00",
+	}
+	for hour, want := range cases {
+		if got := h.hourBand(time.Date(2024, 1, 1, hour, 30, 0, 0, time.UTC)); got != want {
+			t.Errorf("hourBand(%d:30) = %s, want %s", hour, got, want)
+		}
+	}
+}
+
+func TestTravelTimeStatsGroups(t *testing.T) {
+	h := newTestHandler(t)
+	// 2024-01-05 is friday, 2024-01-06 saturday
+	starts := []string{"2024-01-05T08:00:00Z", "2024-01-05T09:00:00Z", "2024-01-06T08:00:00Z"}
+	for ind, start := range starts {
+		at, _ := time.Parse(time.RFC3339, start)
+		for seq, stopID := range []string{"S1", "S2"} {
+			st := StopTime{
+				TripID:    fmt.Sprintf("R1__%d", ind+1),
+				BoxID:     "B1",
+				Direction: "R1",
+				StopID:    stopID,
+				Sequence:  seq,
+				Arrival:   at.Add(time.Duration(seq) * 10 * time.Minute).Format(time.RFC3339),
+				Source:    sourceObserved,
+			}
+			if err := h.store.InsertStopTime(st); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stats, err := h.travelTimeStats("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[[2]string]int)
+	for _, stat := range stats {
+		counts[[2]string{stat.Weekday, stat.Band}] = stat.Trip.Count
+	}
+	want := map[[2]string]int{
+		{"", ""}:               3,
+		{"", "08:00-09:00"}:    2,
+		{"", "09:00-10:00"}:    1,
+		{"Fri", ""}:            2,
+		{"Sat", ""}:            1,
+		{"Fri", "08:00-09:00"}: 1,
+		{"Fri", "09:00-10:00"}: 1,
+		{"Sat", "08:00-09:00"}: 1,
+	}
+	if len(counts) != len(want) {
+		t.Errorf("%d groups, want %d: %v", len(counts), len(want), counts)
+	}
+	for key, count := range want {
+		if counts[key] != count {
+			t.Errorf("trips of %v = %d, want %d", key, counts[key], count)
+		}
+	}
+}
+
+func TestDwellStatsLayover(t *testing.T) {
+	h := newTestHandler(t)
+	rows := []StopTime{
+		{TripID: "R1__1", Direction: "R1", StopID: "S1", Sequence: 0, Arrival: "2024-01-05T08:00:00Z", StopDuration: 60, Source: sourceObserved},
+		{TripID: "R1__1", Direction: "R1", StopID: "S2", Sequence: 1, Arrival: "2024-01-05T08:05:00Z", Source: sourceInterpolated},
+		{TripID: "R1__1", Direction: "R1", StopID: "S3", Sequence: 2, Arrival: "2024-01-05T08:10:00Z", StopDuration: 30, Source: sourceObserved},
+		{TripID: "R1-rev__1", Direction: "R1-rev", StopID: "S3", Sequence: 0, Arrival: "2024-01-05T08:20:00Z", StopDuration: 120, Source: sourceObserved},
+		{TripID: "R1-rev__1", Direction: "R1-rev", StopID: "S2", Sequence: 1, Arrival: "2024-01-05T08:30:00Z", StopDuration: 20, Source: sourceObserved},
+		{TripID: "R1-rev__1", Direction: "R1-rev", StopID: "S1", Sequence: 2, Arrival: "2024-01-05T08:40:00Z", StopDuration: 10, Source: sourceObserved},
+	}
+	for _, st := range rows {
+		st.BoxID = "B1"
+		if err := h.store.InsertStopTime(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := h.dwellStats("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dwells := make(map[string]float64)
+	for _, stop := range report.Stops {
+		dwells[fmt.Sprintf("%s/%d", stop.Direction, stop.Sequence)] = stop.Mean
+	}
+	// layover at S3 is from arrival of R1__1 to departure of R1-rev__1,
+	// the first stop of R1-rev__1 and the interpolated stop are not counted
+	want := map[string]float64{"R1/1": 60, "R1/3": 720, "R1-rev/2": 20, "R1-rev/3": 10}
+	if len(dwells) != len(want) {
+		t.Errorf("dwells = %v, want %v", dwells, want)
+	}
+	for key, dwell := range want {
+		if dwells[key] != dwell {
+			t.Errorf("dwell of %s = %v, want %v", key, dwells[key], dwell)
+		}
+	}
+}
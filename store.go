@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type (
+	// Stop is to store all info about stop we need
+	// to know to create trip
+	Stop struct {
+		ID            string  `json:"stop_id" validate:"required"`
+		Name          string  `json:"stop_name"`
+		Lat           float64 `json:"stop_lat" validate:"required"`
+		Lon           float64 `json:"stop_lon" validate:"required"`
+		Sequence      int     `json:"sequence" validate:"gte=0"`
+		IsTerminal    bool    `json:"is_terminal"`
+		LocationType  int     `json:"location_type"`
+		ParentStation string  `json:"parent_station"`
+		// Radius (m) to detect the stop, range_km_within_stop if 0
+		Radius float64 `json:"radius,omitempty" validate:"gte=0"`
+		// Geofence is a polygon of [lon, lat] to detect the stop instead
+		// of radius, e.g. a depot or a bus terminal
+		Geofence [][2]float64 `json:"geofence,omitempty" validate:"omitempty,min=3"`
+	}
+
+	// Trace is to keep all GPS data
+	Trace struct {
+		BoxID     string  `json:"box_id" db:"box_id" validate:"required"`
+		Timestamp string  `json:"timestamp" db:"timestamp" validate:"required"`
+		Lat       float64 `json:"lat" db:"lat" validate:"required"`
+		Lon       float64 `json:"lon" db:"lon" validate:"required"`
+		// Bearing (degree from north) and Speed (m/s) if the device
+		// gives them, heading is computed from fixes otherwise
+		Bearing *float64 `json:"bearing,omitempty" db:"bearing" validate:"omitempty,gte=0,lt=360"`
+		Speed   *float64 `json:"speed,omitempty" db:"speed" validate:"omitempty,gte=0"`
+	}
+
+	// StopTime is a arrival time for each stopm including stop duration
+	StopTime struct {
+		TripID       string `json:"trip_id" db:"trip_id"`
+		BoxID        string `json:"box_id" db:"box_id" validate:"required"`
+		StopID       string `json:"stop_id" validate:"required"`
+		Direction    string `json:"direction" validate:"required"`
+		Sequence     int    `json:"sequence" validate:"gte=0"`
+		Arrival      string `json:"arrival" db:"arrival" validate:"required"`
+		StopDuration int    `json:"stop_duration" db:"stop_duration" validate:"required"`
+		// Source is observed, interpolated or extrapolated
+		Source     string  `json:"source,omitempty" db:"source"`
+		Confidence float64 `json:"confidence" db:"confidence"`
+	}
+
+	// RouteInput is an ordered stop pattern of a route
+	RouteInput struct {
+		RouteID string           `json:"route_id" validate:"required"`
+		Stops   []RouteStopInput `json:"stops" validate:"required,min=2,dive"`
+	}
+
+	// RouteStopInput is one stop in a route pattern, order is its sequence
+	RouteStopInput struct {
+		StopID     string `json:"stop_id" validate:"required"`
+		IsTerminal bool   `json:"is_terminal"`
+	}
+
+	// SegmentProfile is how long boxes took from a stop (at Sequence) to
+	// the next one and stood at the stop, averaged over extractions
+	// weighted by samples of each
+	SegmentProfile struct {
+		Direction string `json:"direction"`
+		Sequence  int    `json:"sequence"`
+		// Travel (s) from departure of the stop to arrival at the next one
+		Travel        float64 `json:"travel"`
+		TravelSamples int     `json:"travel_samples"`
+		// Dwell (s) at the stop
+		Dwell        float64 `json:"dwell"`
+		DwellSamples int     `json:"dwell_samples"`
+	}
+
+	// StopTimeFilter narrows stop_times down, empty field means no filter
+	StopTimeFilter struct {
+		Direction string
+		// Directions is any of them, e.g. a route and its reverse
+		Directions []string
+		StopID     string
+		BoxID      string
+		TripID     string
+		// Source (observed, ...) is of rows, trips are not filtered by it
+		Source string
+		// From and To are for trips starting in [From, To), Weekday
+		// (Mon, Tue, ...) is of the start in Loc
+		From    time.Time
+		To      time.Time
+		Weekday string
+		Loc     *time.Location
+		// Limit and Offset page trips ordered by start, 0 is no limit
+		Limit  int
+		Offset int
+	}
+)
+
+// Store is where stops, route stops, traces and stop_times are kept.
+// Traces and stop_times are returned in order of box_id and time.
+type Store interface {
+	// Init creates all necessary tables
+	Init() error
+	// Flush drops everything and creates new tables
+	Flush() error
+	// Truncate removes all stops, traces and stop_times
+	Truncate() error
+	TruncateStopTimes() error
+	// DeleteStopTimes removes stop_times of directions
+	DeleteStopTimes(directions []string) error
+	// GeomRegenerate updates geometry from lat, lon if backend needs it
+	GeomRegenerate() error
+	// Count returns number of rows in table, errUndefinedTable if
+	// the table was not there (and is created now)
+	Count(table string) (int, error)
+	Close() error
+
+	InsertStop(stop Stop) error
+	// InsertStops adds stops at once, nothing is added if any fails
+	InsertStops(stops []Stop) error
+	// MissingStops returns stop_id(s) which are not in stops
+	MissingStops(ids []string) ([]string, error)
+	// RouteStops returns stops of a route (all routes if route is empty)
+	// ordered by sequence, order is either "ASC" or "DESC"
+	RouteStops(route string, order string, onlyTerminal bool) ([]Stop, error)
+	// UpsertRouteStops replaces stop pattern of a route, segment
+	// profiles of the route and its reverse are dropped if it changes
+	UpsertRouteStops(route string, stops []RouteStopInput) error
+	// Routes returns distinct route_id in stop_and_route
+	Routes() ([]string, error)
+	// RoutePath returns path of a route in order, empty if it has none
+	RoutePath(route string) ([]ShapePoint, error)
+	// UpsertRoutePath replaces path of a route
+	UpsertRoutePath(route string, points []ShapePoint) error
+
+	// SegmentProfiles returns profile of a direction ordered by sequence,
+	// it is kept when stop_times are truncated
+	SegmentProfiles(direction string) ([]SegmentProfile, error)
+	// UpsertSegmentProfiles replaces profile of a direction
+	UpsertSegmentProfiles(direction string, profiles []SegmentProfile) error
+
+	InsertTrace(trace Trace) error
+	// InsertTraces adds traces at once, nothing is added if any fails
+	InsertTraces(traces []Trace) error
+	// TracesNear returns traces at any given stop, inside its geofence
+	// or within its radius, radius (km) if the stop has none
+	TracesNear(stops []Stop, radius float64) ([]Trace, error)
+	// TracesBetween returns traces of a box in [start, end] (RFC3339)
+	TracesBetween(boxID string, start string, end string) ([]Trace, error)
+
+	InsertStopTime(st StopTime) error
+	// StopTimes returns stop_times ordered by direction and arrival,
+	// only of trips (with trip_id) if any filter of trips is set
+	StopTimes(filter StopTimeFilter) ([]StopTime, error)
+	// CountTrips returns number of trips in stop_times, Limit and
+	// Offset are not counted
+	CountTrips(filter StopTimeFilter) (int, error)
+	// Directions returns distinct direction in stop_times
+	Directions() ([]string, error)
+}
+
+var errUndefinedTable = errors.New("undefined_table")
+
+// byTrip tells if the filter narrows down trips, not only rows
+func (f StopTimeFilter) byTrip() bool {
+	return !f.From.IsZero() || !f.To.IsZero() || len(f.Weekday) > 0 || f.Limit > 0 || f.Offset > 0
+}
+
+// matchRow tells if a row is of a trip the filter is for, stop_id is
+// not checked as a trip has many stops
+func (f StopTimeFilter) matchRow(st StopTime) bool {
+	if len(f.Direction) > 0 && st.Direction != f.Direction {
+		return false
+	}
+	if len(f.BoxID) > 0 && st.BoxID != f.BoxID {
+		return false
+	}
+	if len(f.TripID) > 0 && st.TripID != f.TripID {
+		return false
+	}
+	if len(f.Directions) > 0 {
+		for _, direction := range f.Directions {
+			if st.Direction == direction {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// sameRouteStops tells if 2 stop patterns are the same, a segment
+// profile learnt on one is of no use to the other if not
+func sameRouteStops(a []RouteStopInput, b []RouteStopInput) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ind := range a {
+		if a[ind] != b[ind] {
+			return false
+		}
+	}
+	return true
+}
+
+// location of Weekday, UTC if not set
+func (f StopTimeFilter) location() *time.Location {
+	if f.Loc == nil {
+		return time.UTC
+	}
+	return f.Loc
+}
+
+// openStore returns a store by driver name in [db] section of my.ini
+//   - postgres: path is a connection string (default)
+//   - memory:   path is a JSON file to keep data, nothing is kept if empty
+func openStore(driver string, path string) (Store, error) {
+	switch driver {
+	case "", "postgres":
+		return newPGStore(path)
+	case "memory":
+		return newMemStore(path)
+	}
+	return nil, fmt.Errorf("unknown db driver: %s", driver)
+}
+
+// ItemCount is a shorthand for counting item in asking table
+func (h *Handler) ItemCount(tbl string) (int, string) {
+	count, err := h.store.Count(tbl)
+	if err == errUndefinedTable {
+		return -10, "undefined_table"
+	}
+	if err != nil {
+		return -1, "db error"
+	}
+	return count, "ok"
+}
+
+func (h *Handler) getStops(route string, order string, onlyTerminal bool) []Stop {
+	stops, err := h.store.RouteStops(route, order, onlyTerminal)
+	CheckError("getStop", err)
+	return stops
+}
+
+func (h *Handler) getDistinctDirection() []string {
+	directions, err := h.store.Directions()
+	CheckError("get distinct direction error", err)
+	return directions
+}
+
+func (h *Handler) insertStopTime(st StopTimeRaw) error {
+	t2, _ := time.Parse(time.RFC3339, st.Departure)
+	t1, _ := time.Parse(time.RFC3339, st.Arrival)
+	duration := t2.Sub(t1)
+	return h.store.InsertStopTime(StopTime{
+		TripID:       st.TripID,
+		BoxID:        st.BoxID,
+		StopID:       st.StopID,
+		Direction:    st.Direction,
+		Sequence:     st.Sequence,
+		Arrival:      t1.In(h.loc).Format(time.RFC3339),
+		StopDuration: int(duration.Seconds()),
+		Source:       st.Source,
+		Confidence:   st.Confidence,
+	})
+}
+
+// stopTimeRaws turns stop_times rows back to what extraction gives
+func stopTimeRaws(stopTimes []StopTime) []StopTimeRaw {
+	result := make([]StopTimeRaw, len(stopTimes))
+	for ind, st := range stopTimes {
+		t1, _ := time.Parse(time.RFC3339, st.Arrival)
+		t2 := t1.Add(time.Duration(st.StopDuration) * time.Second)
+		result[ind] = StopTimeRaw{
+			TripID:     st.TripID,
+			StopID:     st.StopID,
+			Arrival:    st.Arrival,
+			Departure:  t2.Format(time.RFC3339),
+			BoxID:      st.BoxID,
+			Sequence:   st.Sequence,
+			Direction:  st.Direction,
+			Source:     st.Source,
+			Confidence: st.Confidence,
+		}
+	}
+	return result
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	s "strings"
+	"time"
+)
+
+// timetableRun is an observed trip with its departure in time of day
+type timetableRun struct {
+	trip       FeedTrip
+	date       string
+	departure  int // seconds since the service day
+	serviceDay time.Time
+}
+
+// synthesizeTimetable turns observed runs into planned trips. Runs of
+// a direction and service are clustered by departure from the first
+// terminal and each cluster becomes a trip with median stop times.
+func (h *Handler) synthesizeTimetable(runs []FeedTrip) []FeedTrip {
+	groupKeys, groups := h.groupRuns(runs)
+	numDates := countServiceDates(groups)
+	planned := []FeedTrip{}
+	seenIDs := make(map[string]int)
+	for _, key := range groupKeys {
+		group := groups[key]
+		planned = append(planned, h.plannedTrips(group, numDates[serviceKey(key)], seenIDs)...)
+	}
+	return planned
+}
+
+// groupRuns groups runs by direction, service, first and last stop,
+// each group is sorted by departure
+func (h *Handler) groupRuns(runs []FeedTrip) ([]string, map[string][]timetableRun) {
+	groups := make(map[string][]timetableRun)
+	groupKeys := []string{}
+	for _, trip := range runs {
+		first := trip.StopTimes[0]
+		day := h.serviceDay(first.Arrival)
+		t, _ := time.Parse(time.RFC3339, first.Departure)
+		run := timetableRun{
+			trip:       trip,
+			date:       day.Format(gtfsDate),
+			departure:  int(t.Sub(day).Seconds()),
+			serviceDay: day,
+		}
+		// partial trips only go with runs between the same stops
+		last := trip.StopTimes[len(trip.StopTimes)-1]
+		key := fmt.Sprintf("%s\n%s\n%03d-%03d", first.Direction, trip.ServiceID, first.Sequence, last.Sequence)
+		if _, ok := groups[key]; !ok {
+			groupKeys = append(groupKeys, key)
+		}
+		groups[key] = append(groups[key], run)
+	}
+	sort.Strings(groupKeys)
+	for _, key := range groupKeys {
+		group := groups[key]
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].departure < group[j].departure
+		})
+	}
+	return groupKeys, groups
+}
+
+// serviceKey is direction and service of a group key
+func serviceKey(groupKey string) string {
+	return groupKey[:s.LastIndex(groupKey, "\n")]
+}
+
+// countServiceDates gives number of days runs of each direction and
+// service were observed, so runs of a partial trip are as many as days
+// the direction runs to be planned
+func countServiceDates(groups map[string][]timetableRun) map[string]int {
+	dates := make(map[string]map[string]bool)
+	for key, group := range groups {
+		service := serviceKey(key)
+		if dates[service] == nil {
+			dates[service] = make(map[string]bool)
+		}
+		for _, run := range group {
+			dates[service][run.date] = true
+		}
+	}
+	numDates := make(map[string]int, len(dates))
+	for service, serviceDates := range dates {
+		numDates[service] = len(serviceDates)
+	}
+	return numDates
+}
+
+// plannedTrips clusters runs of a group observed on numDates days,
+// seenIDs keeps trip_id unique across groups
+func (h *Handler) plannedTrips(group []timetableRun, numDates int, seenIDs map[string]int) []FeedTrip {
+	minRuns := int(h.gtfs.TimetableSupport*float64(numDates) + 0.5)
+	if minRuns < 1 {
+		minRuns = 1
+	}
+	gap := int(h.gtfs.TimetableGap * 60)
+	planned := []FeedTrip{}
+	for _, cluster := range clusterRuns(group, gap) {
+		if len(cluster) < minRuns {
+			h.LogPrint(fmt.Sprintf("timetable: skip %d run(s) at %s\n",
+				len(cluster), secondsToHHMM(cluster[0].departure)))
+			continue
+		}
+		trip := medianTrip(cluster)
+		trip.TripID = uniqueTripID(fmt.Sprintf("%s__%s_%s",
+			trip.StopTimes[0].Direction, trip.ServiceID,
+			s.Replace(secondsToHHMM(cluster[len(cluster)/2].departure), ":", "", 1)), seenIDs)
+		for ind := range trip.StopTimes {
+			trip.StopTimes[ind].TripID = trip.TripID
+		}
+		planned = append(planned, trip)
+	}
+	return planned
+}
+
+// uniqueTripID adds "_2", "_3", ... to a trip_id given again
+func uniqueTripID(tripID string, seenIDs map[string]int) string {
+	seenIDs[tripID]++
+	if cnt := seenIDs[tripID]; cnt > 1 {
+		return fmt.Sprintf("%s_%d", tripID, cnt)
+	}
+	return tripID
+}
+
+// clusterRuns splits runs (sorted by departure) where departures are
+// more than gap apart, then splits a cluster further at its widest gap
+// while it has more than one run on the same date
+func clusterRuns(runs []timetableRun, gap int) [][]timetableRun {
+	clusters := [][]timetableRun{}
+	start := 0
+	for ind := 1; ind <= len(runs); ind++ {
+		if ind == len(runs) || runs[ind].departure-runs[ind-1].departure > gap {
+			clusters = append(clusters, splitSameDate(runs[start:ind])...)
+			start = ind
+		}
+	}
+	return clusters
+}
+
+func splitSameDate(runs []timetableRun) [][]timetableRun {
+	dates := make(map[string]bool, len(runs))
+	duplicated := false
+	for _, run := range runs {
+		if dates[run.date] {
+			duplicated = true
+			break
+		}
+		dates[run.date] = true
+	}
+	if !duplicated || len(runs) < 2 {
+		return [][]timetableRun{runs}
+	}
+	widest, at := -1, 1
+	for ind := 1; ind < len(runs); ind++ {
+		if d := runs[ind].departure - runs[ind-1].departure; d > widest {
+			widest, at = d, ind
+		}
+	}
+	return append(splitSameDate(runs[:at]), splitSameDate(runs[at:])...)
+}
+
+// medianTrip gives a trip of median arrival and departure at each stop,
+// times are put on the service day of the first run. A stop is observed
+// if most runs observed it, its confidence is the mean of the runs.
+func medianTrip(cluster []timetableRun) FeedTrip {
+	arrivals := make(map[int][]int)
+	departures := make(map[int][]int)
+	stopIDs := make(map[int]string)
+	observed := make(map[int]int)
+	confidences := make(map[int]float64)
+	for _, run := range cluster {
+		for _, st := range run.trip.StopTimes {
+			t1, _ := time.Parse(time.RFC3339, st.Arrival)
+			t2, _ := time.Parse(time.RFC3339, st.Departure)
+			arrivals[st.Sequence] = append(arrivals[st.Sequence], int(t1.Sub(run.serviceDay).Seconds()))
+			departures[st.Sequence] = append(departures[st.Sequence], int(t2.Sub(run.serviceDay).Seconds()))
+			stopIDs[st.Sequence] = st.StopID
+			if st.Source == sourceObserved {
+				observed[st.Sequence]++
+			}
+			confidences[st.Sequence] += st.Confidence
+		}
+	}
+	sequences := make([]int, 0, len(stopIDs))
+	for seq := range stopIDs {
+		sequences = append(sequences, seq)
+	}
+	sort.Ints(sequences)
+
+	base := cluster[0]
+	trip := base.trip
+	trip.Runs = len(cluster)
+	// runs of a planned trip are of many boxes
+	trip.BlockID = ""
+	trip.StopTimes = make([]StopTimeRaw, len(sequences))
+	prev := 0
+	for ind, seq := range sequences {
+		arrival := medianInt(arrivals[seq])
+		departure := medianInt(departures[seq])
+		// times can't go backward along the trip
+		if arrival < prev {
+			arrival = prev
+		}
+		if departure < arrival {
+			departure = arrival
+		}
+		prev = departure
+		source := sourceInterpolated
+		if observed[seq]*2 > len(arrivals[seq]) {
+			source = sourceObserved
+		}
+		trip.StopTimes[ind] = StopTimeRaw{
+			StopID:     stopIDs[seq],
+			Arrival:    base.serviceDay.Add(time.Duration(arrival) * time.Second).Format(time.RFC3339),
+			Departure:  base.serviceDay.Add(time.Duration(departure) * time.Second).Format(time.RFC3339),
+			Sequence:   seq,
+			Direction:  base.trip.StopTimes[0].Direction,
+			Source:     source,
+			Confidence: math.Round(confidences[seq]/float64(len(arrivals[seq]))*100) / 100,
+		}
+	}
+	return trip
+}
+
+func medianInt(values []int) int {
+	sorted := append([]int{}, values...)
+	sort.Ints(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func secondsToHHMM(secs int) string {
+	return fmt.Sprintf("%02d:%02d", secs/3600, secs%3600/60)
+}
+
+// observedRuns groups stop_times rows into trips in sequence, rows
+// without trip_id (before trip_id was kept) are left out
+func observedRuns(stopTimes []StopTime) []FeedTrip {
+	runs := []FeedTrip{}
+	index := make(map[string]int)
+	for _, st := range stopTimeRaws(stopTimes) {
+		if len(st.TripID) == 0 {
+			continue
+		}
+		ind, ok := index[st.TripID]
+		if !ok {
+			ind = len(runs)
+			index[st.TripID] = ind
+			runs = append(runs, FeedTrip{TripID: st.TripID, Runs: 1})
+		}
+		runs[ind].StopTimes = append(runs[ind].StopTimes, st)
+	}
+	for ind := range runs {
+		sort.Slice(runs[ind].StopTimes, func(i, j int) bool {
+			return runs[ind].StopTimes[i].Sequence < runs[ind].StopTimes[j].Sequence
+		})
+	}
+	return runs
+}
+
+// ScheduleReporter prints the timetable synthesized from stop_times table
+func (h *Handler) ScheduleReporter() {
+	stopTimes, err := h.store.StopTimes(StopTimeFilter{})
+	CheckError("Cannot read stop_times ", err)
+	directions := h.getDistinctDirection()
+	runs := observedRuns(stopTimes)
+	if len(runs) == 0 {
+		fmt.Println("No stop_times with trip_id, run gen first")
+		return
+	}
+	startDate, endDate := h.serviceDateRange(runs)
+	patterns := h.derivePatterns(runs, startDate, endDate)
+	planned := h.synthesizeTimetable(runs)
+
+	for _, direction := range directions {
+		// stops of the direction as seen in trips
+		stopIDs := []string{}
+		for _, trip := range planned {
+			for _, st := range trip.StopTimes {
+				if st.Direction != direction {
+					break
+				}
+				for len(stopIDs) <= st.Sequence {
+					stopIDs = append(stopIDs, "")
+				}
+				stopIDs[st.Sequence] = st.StopID
+			}
+		}
+		for _, pattern := range patterns {
+			fmt.Printf("\n%s [%s] %s\n", direction, pattern.ID, describeDays(pattern.Days))
+			header := make([]string, len(stopIDs))
+			for ind, stopID := range stopIDs {
+				header[ind] = fmt.Sprintf("%-5.5s", stopID)
+			}
+			fmt.Printf("  %s\n", s.Join(header, " "))
+			for _, trip := range planned {
+				if trip.StopTimes[0].Direction != direction || trip.ServiceID != pattern.ID {
+					continue
+				}
+				serviceDay := h.serviceDay(trip.StopTimes[0].Arrival)
+				cells := make([]string, len(stopIDs))
+				for ind := range cells {
+					cells[ind] = "  -  "
+				}
+				for _, st := range trip.StopTimes {
+					cells[st.Sequence] = gtfsTime(st.Arrival, serviceDay)[:5]
+				}
+				fmt.Printf("  %s  (%d runs)\n", s.Join(cells, " "), trip.Runs)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// observedRun gives a run of service WD observed from S1 to S3 taking
+// 5 min between stops, departing at (2024-01-DDTHH:MM)
+func observedRun(tripID string, departure string) FeedTrip {
+	at, _ := time.Parse(time.RFC3339, "2024-01-"+departure+":00Z")
+	trip := FeedTrip{TripID: tripID, ServiceID: "WD", RouteID: "R1"}
+	for seq := 0; seq < 3; seq++ {
+		ts := at.Add(time.Duration(seq) * 5 * time.Minute).Format(time.RFC3339)
+		trip.StopTimes = append(trip.StopTimes, StopTimeRaw{
+			TripID:     tripID,
+			StopID:     fmt.Sprintf("S%d", seq+1),
+			Arrival:    ts,
+			Departure:  ts,
+			Sequence:   seq,
+			Direction:  "R1",
+			Source:     sourceObserved,
+			Confidence: 1,
+		})
+	}
+	return trip
+}
+
+func TestClusterRuns(t *testing.T) {
+	cases := []struct {
+		name  string
+		runs  []timetableRun
+		sizes []int
+	}{
+		{"apart", []timetableRun{{date: "1", departure: 0}, {date: "2", departure: 100},
+			{date: "3", departure: 500}, {date: "4", departure: 900}}, []int{2, 1, 1}},
+		// a cluster with 2 runs of a date is split at its widest gap
+		{"same date", []timetableRun{{date: "1", departure: 0}, {date: "2", departure: 60},
+			{date: "1", departure: 200}}, []int{2, 1}},
+		{"one", []timetableRun{{date: "1", departure: 0}}, []int{1}},
+	}
+	for _, c := range cases {
+		clusters := clusterRuns(c.runs, 300)
+		sizes := make([]int, len(clusters))
+		for ind, cluster := range clusters {
+			sizes[ind] = len(cluster)
+		}
+		if fmt.Sprint(sizes) != fmt.Sprint(c.sizes) {
+			t.Errorf("%s: clusters of %v, want %v", c.name, sizes, c.sizes)
+		}
+	}
+}
+
+func TestSynthesizeTimetable(t *testing.T) {
+	h := &Handler{loc: time.UTC, gtfs: defaultGTFSConfig()}
+	runs := []FeedTrip{
+		observedRun("R1__1", "05T08:00"),
+		observedRun("R1__2", "06T08:02"),
+		observedRun("R1__3", "07T08:04"),
+		// seen on 1 of 3 days, under timetable_support
+		observedRun("R1__4", "05T09:00"),
+		// 2 runs of a day within timetable_gap are 2 trips
+		observedRun("R1__5", "05T10:00"),
+		observedRun("R1__6", "06T10:01"),
+		observedRun("R1__7", "05T10:03"),
+	}
+	planned := h.synthesizeTimetable(runs)
+	want := []string{"R1__WD_0802", "R1__WD_1001"}
+	if len(planned) != len(want) {
+		t.Fatalf("%d planned trips, want %v", len(planned), want)
+	}
+	for ind, tripID := range want {
+		if planned[ind].TripID != tripID {
+			t.Errorf("trip %d = %s, want %s", ind, planned[ind].TripID, tripID)
+		}
+	}
+	trip := planned[0]
+	last := trip.StopTimes[len(trip.StopTimes)-1]
+	if trip.Runs != 3 || last.Arrival != "2024-01-05T08:12:00Z" || last.Source != sourceObserved || last.TripID != trip.TripID {
+		t.Errorf("median trip: %d runs, last stop %+v, want 3 runs at 08:12 observed", trip.Runs, last)
+	}
+}
@@ -2,169 +2,413 @@ package main
 
 import (
 	"fmt"
+	"math"
 	s "strings"
 	"time"
 
 	"github.com/kellydunn/golang-geo"
-
-	_ "github.com/lib/pq"
 )
 
 // Trip stores concise trip information in order to find stop_times
 type Trip struct {
-	ID      string
-	Start   string
-	End     string
-	BoxID   string
-	BeginAt Stop
-	EndAt   Stop
-	Comment string
+	ID      string `json:"trip_id"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+	BoxID   string `json:"box_id"`
+	BeginAt Stop   `json:"begin_at"`
+	EndAt   Stop   `json:"end_at"`
+	Comment string `json:"comment,omitempty"`
 }
 
 // StopTimeRaw is to keep all schedules
 type StopTimeRaw struct {
-	TripID    string
-	StopID    string
-	Arrival   string
-	Departure string
-	BoxID     string
-	Sequence  int
-	Direction string
+	TripID    string `json:"trip_id"`
+	StopID    string `json:"stop_id"`
+	Arrival   string `json:"arrival"`
+	Departure string `json:"departure"`
+	BoxID     string `json:"box_id"`
+	Sequence  int    `json:"sequence"`
+	Direction string `json:"direction"`
+	// Source tells if it is observed, interpolated or extrapolated
+	Source string `json:"source,omitempty"`
+	// Confidence (0..1) of the times, 1 is observed
+	Confidence float64 `json:"confidence"`
+}
+
+// TripConfig is [trip] section in my.ini
+type TripConfig struct {
+	// LoopMinFraction is the least fraction (0..1) of stops between the
+	// terminal a trip of a loop route has to visit in sequence
+	LoopMinFraction float64 `ini:"loop_min_fraction"`
+	// PartialTrips finds trips which begin or end at any stop as well
+	PartialTrips bool `ini:"partial_trips"`
+	// PartialMinStops is the least number of stops in a row a partial
+	// trip has to serve
+	PartialMinStops int `ini:"partial_min_stops"`
+	// MapMatching finds stop times by traces projected onto the route
+	// path instead of radius around each stop
+	MapMatching bool `ini:"map_matching"`
+	// MatchMaxOffset (m) is the farthest a fix can be from the path
+	MatchMaxOffset float64 `ini:"match_max_offset"`
+	// HeadingTolerance (degree) is how far heading of a box can be from
+	// direction of the route at a stop to match it, 0 is off
+	HeadingTolerance float64 `ini:"heading_tolerance"`
 }
 
-func (h *Handler) getStops(route string, order string, onlyTerminal bool) []Stop {
-	var stops []Stop
-	rows, err := h.queryStops(route, order, onlyTerminal)
-	CheckError("getStop", err)
-	for rows.Next() {
-		var stop Stop
-		rows.Scan(&stop.ID, &stop.Sequence, &stop.Name, &stop.Lat, &stop.Lon, &stop.IsTerminal, &stop.LocationType, &stop.ParentStation)
-		stops = append(stops, stop)
+// tripPartial is Comment of a trip which does not run terminal to terminal
+const tripPartial = "partial"
+
+// partialMaxSkip is how many stops in a row a partial trip can miss,
+// e.g. passed without a fix in radius, they are filled up later
+const partialMaxSkip = 2
+
+// defaultTripConfig is used for whatever not in my.ini
+func defaultTripConfig() TripConfig {
+	return TripConfig{
+		LoopMinFraction: 0.6,
+		PartialMinStops: 3,
+		MatchMaxOffset:  50,
+	}
+}
+
+// routePair is a route with its reverse route, empty reverse is found
+// by routeDirections
+type routePair struct {
+	route    string
+	routeRev string
+}
+
+// routePairs gives routes of -rt which is a route_id, comma-separated
+// route_ids or "all" for every route in stop_and_route. "<route>-rev"
+// goes with "<route>" as its reverse, -rtrv is for a single route only.
+func (h *Handler) routePairs(routes string, routeRev string) ([]routePair, error) {
+	ids := []string{}
+	if routes == "all" {
+		all, err := h.store.Routes()
+		if err != nil {
+			return nil, err
+		}
+		exists := make(map[string]bool, len(all))
+		for _, route := range all {
+			exists[route] = true
+		}
+		for _, route := range all {
+			if s.HasSuffix(route, "-rev") && exists[s.TrimSuffix(route, "-rev")] {
+				continue
+			}
+			ids = append(ids, route)
+		}
+	} else {
+		for _, route := range s.Split(routes, ",") {
+			if route = s.TrimSpace(route); len(route) > 0 {
+				ids = append(ids, route)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no route_id specified")
+	}
+	if len(ids) > 1 && len(routeRev) > 0 {
+		return nil, fmt.Errorf("-rtrv is for a single route only")
+	}
+	pairs := make([]routePair, len(ids))
+	for ind, route := range ids {
+		pairs[ind] = routePair{route: route, routeRev: routeRev}
 	}
-	return stops
+	return pairs, nil
 }
 
 // TripExtractor meant to get info for GTFS's `stop_times.txt`
-func (h *Handler) TripExtractor(route string, routeRev string) []StopTimeRaw {
-	_ = h.truncateStopTimeTable()
+// into one stop_times table for all routes
+func (h *Handler) TripExtractor(pairs []routePair) ([][]StopTimeRaw, error) {
+	if err := h.store.TruncateStopTimes(); err != nil {
+		return nil, err
+	}
 	fmt.Printf("start Trip Extractor\n")
-	return h.ExtractTripWithRoute(route, routeRev)
+	return h.extractRoutes(pairs)
+}
+
+// RouteExtractor is TripExtractor which replaces stop_times of the
+// routes only, stop_times of other routes (e.g. in /api/trips) are kept
+func (h *Handler) RouteExtractor(pairs []routePair) ([][]StopTimeRaw, error) {
+	directions := []string{}
+	for _, pair := range pairs {
+		_, routeRev, err := h.routeDirections(pair.route, pair.routeRev)
+		if err != nil {
+			return nil, err
+		}
+		directions = append(directions, pair.route, routeRev)
+	}
+	if err := h.store.DeleteStopTimes(directions); err != nil {
+		return nil, err
+	}
+	fmt.Printf("start Trip Extractor\n")
+	return h.extractRoutes(pairs)
+}
+
+// extractRoutes gives stop times of each route (with its reverse)
+func (h *Handler) extractRoutes(pairs []routePair) ([][]StopTimeRaw, error) {
+	extracted := make([][]StopTimeRaw, len(pairs))
+	for ind, pair := range pairs {
+		stopTimes, err := h.ExtractTripWithRoute(pair.route, pair.routeRev)
+		if err != nil {
+			return nil, err
+		}
+		extracted[ind] = stopTimes
+	}
+	return extracted, nil
 }
 
 // ExtractTripWithRoute - has a limit that stop at the end has to be
 // the same name otherwise, it would not work
-func (h *Handler) ExtractTripWithRoute(route string, routeRev string) []StopTimeRaw {
-	bkk, _ := time.LoadLocation("Asia/Bangkok")
-	allTrips := []StopTimeRaw{}
+func (h *Handler) ExtractTripWithRoute(route string, routeRev string) ([]StopTimeRaw, error) {
+	return h.extractTripWithRoute(route, routeRev, true)
+}
+
+// extractTripWithRoute gives stop times of trips of the route and its
+// reverse, which are kept in stop_times with the segment profiles if
+// persist, or only given back e.g. for a report
+func (h *Handler) extractTripWithRoute(route string, routeRev string, persist bool) ([]StopTimeRaw, error) {
 	// Route for each direction
-	stopDirection := make(map[string][]Stop, 2)
-	stopDirection[route] = h.getStops(route, "ASC", false)
-	if len(routeRev) > 0 {
-		stopDirection[routeRev] = h.getStops(routeRev, "ASC", false)
-	} else {
-		// make reverse stops/route manually
-		routeRev = fmt.Sprintf("%s-rev", route)
-		stopDirection[routeRev] = h.getStops(route, "DESC", false)
-		for ind, stop := range stopDirection[routeRev] {
-			stop.Sequence = ind + 1
-		}
-	}
-	fwdTrip := h.findOneWayTripPeriod(
-		stopDirection[route][0],
-		stopDirection[route][len(stopDirection[route])-1],
-		route)
-	revTrip := h.findOneWayTripPeriod(
-		stopDirection[routeRev][0],
-		stopDirection[routeRev][len(stopDirection[routeRev])-1],
-		routeRev)
-
-	fmt.Printf("\n%s\n", route)
-	// for _, ele := range stopDirection[route] {
+	stopDirection, routeRev, err := h.routeDirections(route, routeRev)
+	if err != nil {
+		return nil, err
+	}
+	fwdTrip, err := h.findTrips(stopDirection[route], route)
+	if err != nil {
+		return nil, err
+	}
+	revTrip, err := h.findTrips(stopDirection[routeRev], routeRev)
+	if err != nil {
+		return nil, err
+	}
+	h.job.tripsFound(fwdTrip)
+	h.job.tripsFound(revTrip)
+	fwdPath, err := h.routePath(route, stopDirection[route])
+	if err != nil {
+		return nil, err
+	}
+	revPath, err := h.routePath(routeRev, stopDirection[routeRev])
+	if err != nil {
+		return nil, err
+	}
+	fwdStopTimes, err := h.extractDirection(route, stopDirection[route], fwdTrip, fwdPath, persist)
+	if err != nil {
+		return nil, err
+	}
+	revStopTimes, err := h.extractDirection(routeRev, stopDirection[routeRev], revTrip, revPath, persist)
+	if err != nil {
+		return nil, err
+	}
+	return append(fwdStopTimes, revStopTimes...), nil
+}
+
+// extractDirection gives stop times of trips of a direction. Stops
+// observed in all the trips are blended into the segment profile first,
+// then the profile fills up the other stops, so a trip does not depend
+// on the order of trips.
+func (h *Handler) extractDirection(direction string, stops []Stop, trips []Trip, path *Shape, persist bool) ([]StopTimeRaw, error) {
+	allTrips := []StopTimeRaw{}
+	observed := make([][]StopTimeRaw, len(trips))
+	skipped := make([]bool, len(trips))
+	for ind, trip := range trips {
+		tt1, _ := time.Parse(time.RFC3339, trip.Start)
+		if h.day != "" && tt1.In(h.loc).Format("Mon") != h.day {
+			skipped[ind] = true
+			continue
+		}
+		stopTimeRaws, err := h.tripTimeTable(trip, stops, direction, path)
+		if err != nil {
+			return nil, err
+		}
+		observed[ind] = stopTimeRaws
+	}
+	stored, err := h.segmentProfile(direction)
+	if err != nil {
+		return nil, err
+	}
+	profile := stored.update(observedProfile(direction, observed))
+
+	fmt.Printf("\n%s\n", direction)
+	// for _, ele := range stops {
 	// 	fmt.Print(ele.Sequence, ". ", s.TrimSpace(ele.ID), " -> ")
 	// }
 	hhmm := "15:04:05"
-	for ind, trip := range fwdTrip {
-		tt2, _ := time.Parse(time.RFC3339, trip.End)
-		tt1, _ := time.Parse(time.RFC3339, trip.Start)
-		day := tt1.In(bkk).Format("Mon")
-		if h.day != "" && day != h.day {
+	for ind, trip := range trips {
+		if skipped[ind] {
+			h.job.tripDone(trip, true)
 			continue
 		}
-		tripDuration := tt2.Sub(tt1)
-		fmt.Printf("%d. %.0f min: [%s] %s -> %s  /%s/\n",
-			ind+1, tripDuration.Minutes(),
-			day,
-			tt1.In(bkk).Format(hhmm), tt2.In(bkk).Format(hhmm),
-			s.TrimSpace(trip.BoxID))
-		h.LogPrint(fmt.Sprintf("     %s\n", s.TrimSpace(trip.BoxID)))
-		stopTimeRaws := h.FindTripTimeTable(trip, stopDirection[route], route)
-		allTrips = append(allTrips, stopTimeRaws...)
-		h.printAndInsertTimeTable(stopTimeRaws)
-	}
-	fmt.Printf("\n%s\n", routeRev)
-	for ind, trip := range revTrip {
 		tt2, _ := time.Parse(time.RFC3339, trip.End)
 		tt1, _ := time.Parse(time.RFC3339, trip.Start)
-		day := tt1.In(bkk).Format("Mon")
-		if h.day != "" && day != h.day {
-			continue
-		}
 		tripDuration := tt2.Sub(tt1)
 		fmt.Printf("%d. %.0f min: [%s] %s -> %s  /%s/\n",
 			ind+1, tripDuration.Minutes(),
-			tt1.In(bkk).Format("Mon"),
-			tt1.In(bkk).Format(hhmm), tt2.In(bkk).Format(hhmm),
+			tt1.In(h.loc).Format("Mon"),
+			tt1.In(h.loc).Format(hhmm), tt2.In(h.loc).Format(hhmm),
 			s.TrimSpace(trip.BoxID))
 		h.LogPrint(fmt.Sprintf("     %s\n", s.TrimSpace(trip.BoxID)))
-		stopTimeRaws := h.FindTripTimeTable(trip, stopDirection[routeRev], routeRev)
+		if len(trip.Comment) > 0 {
+			fmt.Printf("   %s: %s -> %s\n", trip.Comment, s.TrimSpace(trip.BeginAt.ID), s.TrimSpace(trip.EndAt.ID))
+		}
+		stopTimeRaws := h.FillupMissingStopTime(trip, observed[ind], stops, path, profile)
 		allTrips = append(allTrips, stopTimeRaws...)
-		h.printAndInsertTimeTable(stopTimeRaws)
+		h.printAndInsertTimeTable(stopTimeRaws, persist)
+		h.job.tripDone(trip, false)
+	}
+	if !persist {
+		return allTrips, nil
+	}
+	if err := h.saveSegmentProfile(direction, profile); err != nil {
+		return nil, err
 	}
-	return allTrips
+	return allTrips, nil
 }
 
-func (h *Handler) printAndInsertTimeTable(stt []StopTimeRaw) {
-	bkk, _ := time.LoadLocation("Asia/Bangkok")
+// routeDirections gives stops for each direction and the reverse route.
+// Reverse route is routeRev, "<route>-rev" if it is in stop_and_route
+// (e.g. from import-gtfs) or made from route in reverse order except
+// for a loop route which has no reverse then.
+func (h *Handler) routeDirections(route string, routeRev string) (map[string][]Stop, string, error) {
+	stopDirection := make(map[string][]Stop, 2)
+	stops, err := h.store.RouteStops(route, "ASC", false)
+	if err != nil {
+		return nil, "", err
+	}
+	stopDirection[route] = closeLoop(stops)
+	if len(stopDirection[route]) < 2 {
+		return nil, "", fmt.Errorf("route %s needs at least 2 stops in stop_and_route", route)
+	}
+	if len(routeRev) == 0 {
+		revStops, err := h.store.RouteStops(fmt.Sprintf("%s-rev", route), "ASC", false)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(revStops) >= 2 {
+			routeRev = fmt.Sprintf("%s-rev", route)
+		}
+	}
+	if len(routeRev) > 0 {
+		revStops, err := h.store.RouteStops(routeRev, "ASC", false)
+		if err != nil {
+			return nil, "", err
+		}
+		stopDirection[routeRev] = closeLoop(revStops)
+		if len(stopDirection[routeRev]) < 2 {
+			return nil, "", fmt.Errorf("route %s needs at least 2 stops in stop_and_route", routeRev)
+		}
+	} else if h.isLoop(stopDirection[route]) {
+		// a loop run the other way round is not the same route
+		routeRev = fmt.Sprintf("%s-rev", route)
+		stopDirection[routeRev] = nil
+	} else {
+		// make reverse stops/route manually
+		routeRev = fmt.Sprintf("%s-rev", route)
+		revStops, err := h.store.RouteStops(route, "DESC", false)
+		if err != nil {
+			return nil, "", err
+		}
+		for ind := range revStops {
+			revStops[ind].Sequence = ind + 1
+		}
+		stopDirection[routeRev] = revStops
+	}
+	return stopDirection, routeRev, nil
+}
 
+// printAndInsertTimeTable prints stop times with -v and keeps them in
+// stop_times if insert
+func (h *Handler) printAndInsertTimeTable(stt []StopTimeRaw, insert bool) {
 	for _, stEle := range stt {
+		// stop which cannot be found nor interpolated
+		if len(stEle.StopID) == 0 {
+			continue
+		}
 		t2, _ := time.Parse(time.RFC3339, stEle.Departure)
 		t1, _ := time.Parse(time.RFC3339, stEle.Arrival)
 
 		duration := t2.Sub(t1)
-		h.LogPrint(fmt.Sprintf("   %d /%s/ [%s] %+v -> %0.0f s \n",
+		h.LogPrint(fmt.Sprintf("   %d /%s/ [%s] %+v -> %0.0f s %s\n",
 			stEle.Sequence+1,
 			s.TrimSpace(stEle.Direction),
 			s.TrimSpace(stEle.StopID),
-			t1.In(bkk).Format(time.RFC1123Z),
-			duration.Seconds()))
-		h.insertStopTime(stEle)
+			t1.In(h.loc).Format(time.RFC1123Z),
+			duration.Seconds(), stEle.Source))
+		if !insert {
+			continue
+		}
+		err := h.insertStopTime(stEle)
+		h.job.stopTimeStored(stEle, err)
+	}
+}
+
+// closeLoop adds the terminal again as the last stop of a loop route,
+// which has the first stop as its only terminal in stop_and_route
+func closeLoop(stops []Stop) []Stop {
+	terminals := 0
+	for _, stop := range stops {
+		if stop.IsTerminal {
+			terminals++
+		}
 	}
+	if len(stops) < 3 || terminals != 1 || !stops[0].IsTerminal {
+		return stops
+	}
+	terminal := stops[0]
+	terminal.Sequence = stops[len(stops)-1].Sequence + 1
+	return append(stops, terminal)
 }
 
-func (h *Handler) findOneWayTripPeriod(beginAt Stop, endAt Stop, tripPrefix string) []Trip {
+// isLoop tells if a route starts and ends at the same stop
+func (h *Handler) isLoop(stops []Stop) bool {
+	if len(stops) < 3 {
+		return false
+	}
+	first, last := stops[0], stops[len(stops)-1]
+	return first.ID == last.ID || h.atStop(first, geo.NewPoint(last.Lat, last.Lon))
+}
+
+// findTrips finds trips of a direction of a loop or a one-way route
+// and partial trips of it if [trip] partial_trips is on
+func (h *Handler) findTrips(stops []Stop, direction string) ([]Trip, error) {
+	if len(stops) < 2 {
+		return nil, nil
+	}
+	var (
+		trips []Trip
+		err   error
+	)
+	if h.isLoop(stops) {
+		trips, err = h.findLoopTripPeriod(stops, direction)
+	} else {
+		trips, err = h.findOneWayTripPeriod(stops[0], stops[len(stops)-1], direction)
+	}
+	if err != nil || !h.trip.PartialTrips {
+		return trips, err
+	}
+	partials, err := h.findPartialTrips(stops, direction, trips)
+	if err != nil {
+		return nil, err
+	}
+	return append(trips, partials...), nil
+}
+
+func (h *Handler) findOneWayTripPeriod(beginAt Stop, endAt Stop, tripPrefix string) ([]Trip, error) {
 
-	whereArr := make([]string, 2)
 	// filter trace for only what inside this sphere (50 m radius)
 	// both terminals -- so we don't have to process traces in between
-	distance := int(h.rangeWithinStop * 1000)
-	tmpl := "ST_DistanceSphere(geom, ST_MakePoint(%f,%f)) <= %d"
-	whereArr[0] = fmt.Sprintf(tmpl, beginAt.Lon, beginAt.Lat, distance)
-	whereArr[1] = fmt.Sprintf(tmpl, endAt.Lon, endAt.Lat, distance)
-	whereClause := s.Join(whereArr, " OR ")
-	rows, err := h.queryTraces(whereClause, "ASC")
-	CheckError("Find traces inside terminals", err)
+	traces, err := h.store.TracesNear([]Stop{beginAt, endAt}, h.rangeWithinStop)
+	if err != nil {
+		return nil, fmt.Errorf("find traces inside terminals: %v", err)
+	}
 
 	var (
 		trips []Trip
 		boxID string
 		trip  Trip
-		trace Trace
 	)
-	beginPoint := geo.NewPoint(beginAt.Lat, beginAt.Lon)
-	endPoint := geo.NewPoint(endAt.Lat, endAt.Lon)
 	tripCounter := 1
-	for rows.Next() {
-		rows.Scan(&trace.BoxID, &trace.Timestamp, &trace.Lat, &trace.Lon)
+	for _, trace := range traces {
 		pnt := geo.NewPoint(trace.Lat, trace.Lon)
 
 		// reset anything if BoxID changes
@@ -173,8 +417,7 @@ func (h *Handler) findOneWayTripPeriod(beginAt Stop, endAt Stop, tripPrefix stri
 		}
 
 		// start checking if it's at the first terminal
-		bDistance := beginPoint.GreatCircleDistance(pnt)
-		if bDistance < h.rangeWithinStop {
+		if h.atStop(beginAt, pnt) {
 			if trip.Start == "" {
 				// init this trip
 				boxID = trace.BoxID
@@ -194,8 +437,7 @@ func (h *Handler) findOneWayTripPeriod(beginAt Stop, endAt Stop, tripPrefix stri
 			continue
 		}
 		// checking if it's at the second terminal
-		eDistance := endPoint.GreatCircleDistance(pnt)
-		if eDistance < h.rangeWithinStop {
+		if h.atStop(endAt, pnt) {
 			if trip.Start != "" {
 				t2, _ := time.Parse(time.RFC3339, trace.Timestamp)
 				t1, _ := time.Parse(time.RFC3339, trip.Start)
@@ -215,25 +457,220 @@ func (h *Handler) findOneWayTripPeriod(beginAt Stop, endAt Stop, tripPrefix stri
 			}
 		}
 	}
-	return trips
+	return trips, nil
+}
+
+// findLoopTripPeriod finds trips of a loop route which leave the
+// terminal, visit at least loop_min_fraction of stops in between in
+// sequence and come back. Arriving back starts the next trip.
+func (h *Handler) findLoopTripPeriod(stops []Stop, tripPrefix string) ([]Trip, error) {
+	traces, err := h.store.TracesNear(stops, h.rangeWithinStop)
+	if err != nil {
+		return nil, fmt.Errorf("find traces near stops of loop: %v", err)
+	}
+
+	var (
+		trips []Trip
+		boxID string
+		trip  Trip
+		// visited is number of stops in between visited in sequence,
+		// last is sequence of the latest one
+		visited int
+		last    int
+	)
+	terminal := stops[0]
+	between := stops[1 : len(stops)-1]
+	minVisited := int(math.Ceil(h.trip.LoopMinFraction * float64(len(between))))
+	if minVisited < 1 {
+		minVisited = 1
+	}
+	tripCounter := 1
+	for _, trace := range traces {
+		pnt := geo.NewPoint(trace.Lat, trace.Lon)
+
+		// reset anything if BoxID changes
+		if boxID != trace.BoxID {
+			boxID = trace.BoxID
+			trip = Trip{}
+			visited, last = 0, 0
+		}
+
+		if h.atStop(terminal, pnt) {
+			if trip.Start != "" && visited >= minVisited {
+				t2, _ := time.Parse(time.RFC3339, trace.Timestamp)
+				t1, _ := time.Parse(time.RFC3339, trip.Start)
+				if t2.Sub(t1).Hours() < 3.0 {
+					// end this trip
+					trip.End = trace.Timestamp
+					trip.EndAt = terminal
+					trip.ID = fmt.Sprintf("%s__%d", tripPrefix, tripCounter)
+					trips = append(trips, trip)
+					tripCounter++
+				}
+			}
+			// (re)start from the terminal until it leaves
+			if trip.Start == "" || visited > 0 {
+				trip = Trip{
+					BeginAt: terminal,
+					BoxID:   trace.BoxID,
+				}
+				visited, last = 0, 0
+			}
+			trip.Start = trace.Timestamp
+			continue
+		}
+		if trip.Start == "" {
+			continue
+		}
+		for ind, stop := range between {
+			if ind+1 <= last {
+				continue
+			}
+			if h.atStop(stop, pnt) {
+				visited++
+				last = ind + 1
+				break
+			}
+		}
+	}
+	return trips, nil
+}
+
+// findPartialTrips finds runs serving at least partial_min_stops stops
+// in a row which are not in trips found already, e.g. short turns, trips
+// starting mid-route after a shift change or with GPS lost at terminal.
+// A run may miss up to partialMaxSkip stops in a row. A partial trip
+// begins at the stop it departs and ends at the stop it arrives at last.
+func (h *Handler) findPartialTrips(stops []Stop, tripPrefix string, trips []Trip) ([]Trip, error) {
+	traces, err := h.store.TracesNear(stops, h.rangeWithinStop)
+	if err != nil {
+		return nil, fmt.Errorf("find traces near stops: %v", err)
+	}
+
+	minStops := h.trip.PartialMinStops
+	if minStops < 2 {
+		minStops = 2
+	}
+	var (
+		partials []Trip
+		boxID    string
+		run      Trip
+		// first and last are sequences of the run
+		first int
+		last  int
+	)
+	tripCounter := 1
+	closeRun := func() {
+		if run.Start != "" && last-first+1 >= minStops && !overlapTrips(trips, run) {
+			t2, _ := time.Parse(time.RFC3339, run.End)
+			t1, _ := time.Parse(time.RFC3339, run.Start)
+			if t2.Sub(t1).Hours() < 3.0 {
+				run.BeginAt = stops[first]
+				run.EndAt = stops[last]
+				run.Comment = tripPartial
+				run.ID = fmt.Sprintf("%s__p%d", tripPrefix, tripCounter)
+				partials = append(partials, run)
+				tripCounter++
+			}
+		}
+		run = Trip{}
+	}
+	for _, trace := range traces {
+		pnt := geo.NewPoint(trace.Lat, trace.Lon)
+		if boxID != trace.BoxID {
+			closeRun()
+			boxID = trace.BoxID
+		}
+		// the next stop of the run goes first as stops can be close
+		// to each other, the terminal of a loop at least, then the stop
+		// it is at and the stops after a skip
+		at := -1
+		if run.Start != "" {
+			nearby := []int{last + 1, last}
+			for skip := 1; skip <= partialMaxSkip; skip++ {
+				nearby = append(nearby, last+1+skip)
+			}
+			for _, ind := range nearby {
+				if ind < len(stops) && h.atStop(stops[ind], pnt) {
+					at = ind
+					break
+				}
+			}
+		}
+		if at == -1 {
+			for ind, stop := range stops {
+				if h.atStop(stop, pnt) {
+					at = ind
+					break
+				}
+			}
+		}
+		switch {
+		case at == -1:
+			continue
+		case run.Start != "" && at == last:
+			// still at the stop, departs from the first stop later
+			if last == first {
+				run.Start = trace.Timestamp
+				run.End = trace.Timestamp
+			}
+		case run.Start != "" && at > last && at-last-1 <= partialMaxSkip:
+			last = at
+			run.End = trace.Timestamp
+		default:
+			closeRun()
+			run = Trip{
+				Start: trace.Timestamp,
+				End:   trace.Timestamp,
+				BoxID: trace.BoxID,
+			}
+			first, last = at, at
+		}
+	}
+	closeRun()
+	return partials, nil
+}
+
+// overlapTrips tells if a trip is in the time of any trips of its box
+func overlapTrips(trips []Trip, trip Trip) bool {
+	for _, other := range trips {
+		if other.BoxID == trip.BoxID &&
+			!arrivalBefore(trip.End, other.Start) && !arrivalBefore(other.End, trip.Start) {
+			return true
+		}
+	}
+	return false
 }
 
-// FindTripTimeTable to get detail of trip and stop along the way
-// and interpolate if there is no data stopping at the stop
-func (h *Handler) FindTripTimeTable(t Trip, stops []Stop, d string) []StopTimeRaw {
-	q := fmt.Sprintf("box_id = '%s' AND timestamp >= '%s' AND timestamp <= '%s'",
-		t.BoxID, t.Start, t.End)
-	rows, err := h.queryTraces(q, "ASC")
-	CheckError("findTripTimeTable 00", err)
+// FindTripTimeTable to get detail of trip and stop along the way,
+// a stop without data stopping at it is left empty. Direction of the
+// route at a stop is of the path if it is not nil.
+func (h *Handler) FindTripTimeTable(t Trip, stops []Stop, d string, path *Shape) ([]StopTimeRaw, error) {
+	traces, err := h.store.TracesBetween(t.BoxID, t.Start, t.End)
+	if err != nil {
+		return nil, fmt.Errorf("findTripTimeTable 00: %v", err)
+	}
 	var (
-		trace    Trace
 		boxID    string
 		stopTime StopTimeRaw
 	)
 	results := make([]StopTimeRaw, len(stops))
-	for rows.Next() {
-		rows.Scan(&trace.BoxID, &trace.Timestamp, &trace.Lat, &trace.Lon)
+	// on a loop route the terminal is the first stop until the box
+	// has left it, and the last stop after that
+	loop := h.isLoop(stops)
+	leftTerminal := false
+	// a stop is matched only when the box heads the way of the route
+	// there, a box standing still stays at the stop it is at
+	directional := h.trip.HeadingTolerance > 0
+	headings := traceHeadings(traces)
+	bearings := stopBearings(stops, path)
+	for traceInd, trace := range traces {
 		pnt := geo.NewPoint(trace.Lat, trace.Lon)
+		if directional && math.IsNaN(headings[traceInd]) && stopTime != (StopTimeRaw{}) &&
+			h.atStop(stops[stopTime.Sequence], pnt) {
+			stopTime.Departure = trace.Timestamp
+			continue
+		}
 		// if box changes -> end the old one (or save prev if applicant)
 		if boxID != "" && boxID != trace.BoxID && stopTime != (StopTimeRaw{}) {
 			results[stopTime.Sequence] = stopTime
@@ -243,11 +680,16 @@ func (h *Handler) FindTripTimeTable(t Trip, stops []Stop, d string) []StopTimeRa
 			boxID = trace.BoxID
 		}
 		atTheStop := -1
+		heading := headings[traceInd]
 		for ind, ele := range stops {
-			tGeoPoint := geo.NewPoint(ele.Lat, ele.Lon)
-			distance := pnt.GreatCircleDistance(tGeoPoint)
-			if distance < h.rangeWithinStop {
+			if loop && ((ind == 0 && leftTerminal) || (ind == len(stops)-1 && !leftTerminal)) {
+				continue
+			}
+			if h.atStop(ele, pnt) && h.headingAgrees(heading, bearings[ind]) {
 				atTheStop = ind
+				if ind > 0 {
+					leftTerminal = true
+				}
 				if stopTime == (StopTimeRaw{}) {
 					// init stopTime
 					stopTime.BoxID = trace.BoxID
@@ -292,57 +734,5 @@ func (h *Handler) FindTripTimeTable(t Trip, stops []Stop, d string) []StopTimeRa
 	if results[stopTime.Sequence] == (StopTimeRaw{}) {
 		results[stopTime.Sequence] = stopTime
 	}
-	results = FillupMissingStopTime(results, stops, d)
-	return results
-}
-
-// FillupMissingStopTime by interpolating
-func FillupMissingStopTime(l []StopTimeRaw, stops []Stop, direction string) []StopTimeRaw {
-	i := -1
-	j := -1
-	for ind, ele := range l {
-		if ele == (StopTimeRaw{}) {
-			continue
-		}
-		if i == -1 {
-			i = ind
-			continue
-		}
-		// fill up missing one
-		j = ind
-		orig := l[i]
-		origTime, _ := time.Parse(time.RFC3339, orig.Departure)
-		distanceIJ := distanceBetween(stops[i], stops[j])
-		durationIJ := durationBetween(l[i].Departure, l[j].Arrival)
-		for k := i + 1; k < j; k++ {
-			distanceIK := distanceBetween(stops[i], stops[k])
-			durationIK := distanceIK / distanceIJ * float64(durationIJ)
-
-			arrivedAt := origTime.Add(time.Duration(durationIK))
-			l[k] = StopTimeRaw{
-				TripID:    orig.TripID,
-				StopID:    stops[k].ID,
-				Arrival:   arrivedAt.Format(time.RFC3339),
-				Departure: arrivedAt.Format(time.RFC3339),
-				BoxID:     orig.BoxID,
-				Sequence:  k,
-				Direction: orig.Direction,
-			}
-		}
-		i = ind
-		j = -1
-	}
-	return l
-}
-
-func distanceBetween(a Stop, b Stop) float64 {
-	aPoint := geo.NewPoint(a.Lat, a.Lon)
-	bPoint := geo.NewPoint(b.Lat, b.Lon)
-	return aPoint.GreatCircleDistance(bPoint)
-}
-
-func durationBetween(a string, b string) time.Duration {
-	t2, _ := time.Parse(time.RFC3339, b)
-	t1, _ := time.Parse(time.RFC3339, a)
-	return t2.Sub(t1)
+	return results, nil
 }
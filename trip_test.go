@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testStops are 5 stops about 500 m apart from west to east
+func testStops() []Stop {
+	stops := make([]Stop, 5)
+	for ind := range stops {
+		stops[ind] = Stop{
+			ID:       fmt.Sprintf("S%d", ind+1),
+			Lat:      13.75,
+			Lon:      100.50 + float64(ind)*0.0046,
+			Sequence: ind + 1,
+		}
+	}
+	stops[0].IsTerminal = true
+	stops[len(stops)-1].IsTerminal = true
+	return stops
+}
+
+// newTestHandler gives a handler on a memory store with stops of route
+// R1 and no file to keep it
+func newTestHandler(t *testing.T) *Handler {
+	store, err := newMemStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stops := testStops()
+	if err := store.InsertStops(stops); err != nil {
+		t.Fatal(err)
+	}
+	routeStops := make([]RouteStopInput, len(stops))
+	for ind, stop := range stops {
+		routeStops[ind] = RouteStopInput{StopID: stop.ID, IsTerminal: stop.IsTerminal}
+	}
+	if err := store.UpsertRouteStops("R1", routeStops); err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{
+		store:           store,
+		rangeWithinStop: 0.05,
+		loc:             time.UTC,
+		gtfs:            defaultGTFSConfig(),
+		stats:           defaultStatsConfig(),
+		trip:            defaultTripConfig(),
+	}
+}
+
+// testRun gives traces of a box standing 60 s at each stop and taking
+// 120 s from a stop to the next one from start, with a fix in between
+func testRun(boxID string, stops []Stop, start time.Time) []Trace {
+	traces := []Trace{}
+	at := start
+	add := func(lat float64, lon float64) {
+		traces = append(traces, Trace{BoxID: boxID, Timestamp: at.Format(time.RFC3339), Lat: lat, Lon: lon})
+	}
+	for ind, stop := range stops {
+		add(stop.Lat, stop.Lon)
+		at = at.Add(60 * time.Second)
+		add(stop.Lat, stop.Lon)
+		if ind < len(stops)-1 {
+			at = at.Add(60 * time.Second)
+			add(stop.Lat, (stop.Lon+stops[ind+1].Lon)/2)
+			at = at.Add(60 * time.Second)
+		}
+	}
+	return traces
+}
+
+func TestFindOneWayTripPeriod(t *testing.T) {
+	h := newTestHandler(t)
+	stops := testStops()
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	traces := append(testRun("B1", stops, start), testRun("B2", stops, start.Add(time.Hour))...)
+	if err := h.store.InsertTraces(traces); err != nil {
+		t.Fatal(err)
+	}
+	trips, err := h.findOneWayTripPeriod(stops[0], stops[4], "R1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 2 {
+		t.Fatalf("%d trips, want 2", len(trips))
+	}
+	want := []Trip{
+		{ID: "R1__1", BoxID: "B1", Start: "2024-01-01T08:01:00Z", End: "2024-01-01T08:12:00Z"},
+		{ID: "R1__2", BoxID: "B2", Start: "2024-01-01T09:01:00Z", End: "2024-01-01T09:12:00Z"},
+	}
+	for ind, trip := range trips {
+		if trip.ID != want[ind].ID || trip.BoxID != want[ind].BoxID ||
+			trip.Start != want[ind].Start || trip.End != want[ind].End {
+			t.Errorf("trip %d = %s %s %s..%s, want %+v", ind, trip.ID, trip.BoxID, trip.Start, trip.End, want[ind])
+		}
+	}
+}
+
+func TestFindTripTimeTable(t *testing.T) {
+	h := newTestHandler(t)
+	stops := testStops()
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	if err := h.store.InsertTraces(testRun("B1", stops, start)); err != nil {
+		t.Fatal(err)
+	}
+	trip := Trip{ID: "R1__1", BoxID: "B1", Start: "2024-01-01T08:01:00Z", End: "2024-01-01T08:12:00Z"}
+	results, err := h.FindTripTimeTable(trip, stops, "R1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(stops) {
+		t.Fatalf("%d stop times, want %d", len(results), len(stops))
+	}
+	for ind, st := range results {
+		if st.StopID != stops[ind].ID || st.Sequence != ind || st.TripID != "R1__1" {
+			t.Errorf("stop time %d = %+v", ind, st)
+			continue
+		}
+		// the trip starts when the box leaves the first stop and ends
+		// when it gets to the last one
+		arrival := start.Add(time.Duration(ind*180) * time.Second)
+		departure := arrival.Add(60 * time.Second)
+		if ind == 0 {
+			arrival = departure
+		}
+		if ind == len(stops)-1 {
+			departure = arrival
+		}
+		if st.Arrival != arrival.Format(time.RFC3339) || st.Departure != departure.Format(time.RFC3339) {
+			t.Errorf("stop %s: %s..%s, want %s..%s", st.StopID, st.Arrival, st.Departure,
+				arrival.Format(time.RFC3339), departure.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestFindPartialTripsSkip(t *testing.T) {
+	h := newTestHandler(t)
+	stops := testStops()
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	// the box runs S2..S5 with no fix at S4
+	traces := []Trace{}
+	for _, trace := range testRun("B1", stops[1:], start) {
+		if trace.Lon != stops[3].Lon {
+			traces = append(traces, trace)
+		}
+	}
+	if err := h.store.InsertTraces(traces); err != nil {
+		t.Fatal(err)
+	}
+	partials, err := h.findPartialTrips(stops, "R1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partials) != 1 {
+		t.Fatalf("%d partial trips, want 1: %+v", len(partials), partials)
+	}
+	if trip := partials[0]; trip.ID != "R1__p1" || trip.BeginAt.ID != "S2" || trip.EndAt.ID != "S5" {
+		t.Errorf("partial trip = %s %s -> %s, want R1__p1 S2 -> S5", trip.ID, trip.BeginAt.ID, trip.EndAt.ID)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
 	"math/rand"
@@ -11,12 +10,21 @@ import (
 type (
 	// Handler to handle all route
 	Handler struct {
-		db              *sql.DB
+		store           Store
 		port            string
 		rangeWithinStop float64
 		verbose         bool
 		outputDir       string
 		day             string
+		loc             *time.Location
+		gtfs            GTFSConfig
+		mode            string
+		stats           StatsConfig
+		trip            TripConfig
+		// jobs are background jobs of web server
+		jobs *jobRegistry
+		// job is the background job being run, nil from CLI
+		job *Job
 	}
 
 	// Result for all input handlers
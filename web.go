@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	s "strings"
 	"time"
 
 	"github.com/flosch/pongo2"
 	"github.com/labstack/echo"
-	"github.com/lib/pq"
 	validator "gopkg.in/go-playground/validator.v9"
 )
 
@@ -30,6 +31,7 @@ func (h *Handler) serveWebInterface() {
 	t2, _ := time.Parse(layout, "2014-11-18T06:02:03+0700")
 	fmt.Println("time: ", t, t.Unix())
 	fmt.Println("time: ", t2, t2.Unix())
+	h.jobs = newJobRegistry()
 	e := echo.New()
 	e.Validator = &CustomValidator{validator: validator.New()}
 
@@ -37,7 +39,19 @@ func (h *Handler) serveWebInterface() {
 	e.GET("/", h.IndexHandler)
 	e.POST("/input/reset", h.resetData)
 	e.POST("/input/stop", h.StopInputHandler)
+	e.POST("/input/route", h.RouteInputHandler)
 	e.POST("/input/trace", h.TraceInputHandler)
+	e.POST("/input/stop.csv", h.StopCSVInputHandler)
+	e.POST("/input/trace.csv", h.TraceCSVInputHandler)
+	e.GET("/api/trips", h.TripListHandler)
+	e.GET("/api/trips/:trip_id/stop_times", h.TripStopTimesHandler)
+	e.GET("/api/stats/travel-times", h.TravelTimeStatsHandler)
+	e.GET("/api/stats/headways", h.HeadwayStatsHandler)
+	e.GET("/api/stats/dwell", h.DwellStatsHandler)
+	e.GET("/api/stats/duties", h.DutyHandler)
+	e.POST("/api/jobs/extract", h.ExtractJobHandler)
+	e.GET("/api/jobs/:id", h.JobStatusHandler)
+	e.GET("/api/jobs/:id/gtfs", h.JobGTFSHandler)
 	e.Logger.Fatal(e.Start(fmt.Sprintf(":%s", h.port)))
 }
 
@@ -50,21 +64,27 @@ func (h *Handler) StopInputHandler(c echo.Context) (err error) {
 	result := Result{Success: 0, Failed: 0}
 	var buffer bytes.Buffer
 	for _, ele := range *stops {
-		if err := c.Validate(ele); err != nil {
+		err := c.Validate(ele)
+		if err == nil {
+			if err = checkGeofence(ele.Geofence); err != nil {
+				err = fmt.Errorf("stop %s: %v", ele.ID, err)
+			}
+		}
+		if err == nil {
+			// insert
+			if err = h.store.InsertStop(ele); err != nil {
+				err = fmt.Errorf("insert stop %s: %v", ele.ID, err)
+			}
+		}
+		if err != nil {
 			result.Failed++
 			if buffer.Len() > 0 {
 				buffer.WriteString(",")
 			}
 			buffer.WriteString(err.Error())
-		} else {
-			result.Success++
-			// insert
-			_, err := h.db.Exec(fmt.Sprintf("INSERT INTO stops (stop_id, stop_name, stop_lat, stop_lon, is_terminal, sequence) VALUES ('%s', '%s', %f, %f, %v, %d)", ele.ID, ele.Name, ele.Lat, ele.Lon, ele.IsTerminal, ele.Sequence))
-			if err, ok := err.(*pq.Error); ok {
-				// Here err is of type *pq.Error, you may inspect all its fields, e.g.:
-				fmt.Println("pq error:", err.Code.Name())
-			}
+			continue
 		}
+		result.Success++
 	}
 	if buffer.Len() > 0 {
 		result.Message = buffer.String()
@@ -72,6 +92,50 @@ func (h *Handler) StopInputHandler(c echo.Context) (err error) {
 	return c.JSON(http.StatusOK, result)
 }
 
+// RouteInputHandler to accept stop pattern of a route via REST interface.
+// All stops must already exist and exactly 2 of them are terminals.
+func (h *Handler) RouteInputHandler(c echo.Context) error {
+	input := new(RouteInput)
+	if err := c.Bind(input); err != nil {
+		return err
+	}
+	if err := c.Validate(input); err != nil {
+		return c.JSON(http.StatusBadRequest, Result{Failed: len(input.Stops), Message: err.Error()})
+	}
+	terminalCnt := 0
+	ids := make([]string, len(input.Stops))
+	seen := make(map[string]bool, len(input.Stops))
+	for ind, ele := range input.Stops {
+		if seen[ele.StopID] {
+			msg := fmt.Sprintf("stop %s is listed more than once", ele.StopID)
+			return c.JSON(http.StatusBadRequest, Result{Failed: len(input.Stops), Message: msg})
+		}
+		seen[ele.StopID] = true
+		ids[ind] = ele.StopID
+		if ele.IsTerminal {
+			terminalCnt++
+		}
+	}
+	// a loop route has the first stop as its only terminal
+	loop := terminalCnt == 1 && len(input.Stops) > 2 && input.Stops[0].IsTerminal
+	if terminalCnt != 2 && !loop {
+		msg := fmt.Sprintf("2 terminals (or the first stop of a loop) required, got %d", terminalCnt)
+		return c.JSON(http.StatusBadRequest, Result{Failed: len(input.Stops), Message: msg})
+	}
+	missing, err := h.store.MissingStops(ids)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		msg := fmt.Sprintf("unknown stop: %s", s.Join(missing, ","))
+		return c.JSON(http.StatusBadRequest, Result{Failed: len(missing), Message: msg})
+	}
+	if err := h.store.UpsertRouteStops(input.RouteID, input.Stops); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, Result{Success: len(input.Stops)})
+}
+
 // TraceInputHandler to accept trace via REST interface
 func (h *Handler) TraceInputHandler(c echo.Context) error {
 	traces := new([]Trace)
@@ -81,21 +145,22 @@ func (h *Handler) TraceInputHandler(c echo.Context) error {
 	result := Result{Success: 0, Failed: 0}
 	var buffer bytes.Buffer
 	for _, ele := range *traces {
-		if err := c.Validate(ele); err != nil {
+		err := c.Validate(ele)
+		if err == nil {
+			// insert
+			if err = h.store.InsertTrace(ele); err != nil {
+				err = fmt.Errorf("insert trace %s %s: %v", ele.BoxID, ele.Timestamp, err)
+			}
+		}
+		if err != nil {
 			result.Failed++
 			if buffer.Len() > 0 {
 				buffer.WriteString(",")
 			}
 			buffer.WriteString(err.Error())
-		} else {
-			result.Success++
-			// insert
-			_, err := h.db.Exec(fmt.Sprintf("INSERT INTO traces (box_id, timestamp, lat, lon) VALUES ('%s', '%s', %f, %f)", ele.BoxID, ele.Timestamp, ele.Lat, ele.Lon))
-			if err, ok := err.(*pq.Error); ok {
-				// Here err is of type *pq.Error, you may inspect all its fields, e.g.:
-				fmt.Println("pq error:", err.Error())
-			}
+			continue
 		}
+		result.Success++
 	}
 	if buffer.Len() > 0 {
 		result.Message = buffer.String()
@@ -103,6 +168,26 @@ func (h *Handler) TraceInputHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, result)
 }
 
+// StopCSVInputHandler to accept stops as CSV body via REST interface
+func (h *Handler) StopCSVInputHandler(c echo.Context) error {
+	result, err := h.StopCSVLoader(c.Request().Body)
+	if err != nil {
+		result.Message = err.Error()
+		return c.JSON(http.StatusBadRequest, result)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// TraceCSVInputHandler to accept traces as CSV body via REST interface
+func (h *Handler) TraceCSVInputHandler(c echo.Context) error {
+	result, err := h.TraceCSVLoader(c.Request().Body)
+	if err != nil {
+		result.Message = err.Error()
+		return c.JSON(http.StatusBadRequest, result)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
 // IndexHandler is the front page to check everything
 func (h *Handler) IndexHandler(c echo.Context) error {
 	var indexTmpl = pongo2.Must(pongo2.FromFile("html/index.html"))
@@ -117,30 +202,37 @@ func (h *Handler) IndexHandler(c echo.Context) error {
 		stops := h.getStops(direction, "ASC", false)
 		summary[direction] = make([][]string, len(stops))
 		for ind, stop := range stops {
-			where := fmt.Sprintf("direction='%s' AND stop_id='%s'", direction, stop.ID)
-			fieldOrder := `box_id,stop_id,direction,sequence,to_char(arrival, 'HH24:MI') as hhmm,stop_duration`
-			query := fmt.Sprintf(`SELECT %s from stop_times WHERE %s order by hhmm ASC;`, fieldOrder, where)
-			rows, err := h.db.Query(query)
+			stopTimes, err := h.store.StopTimes(StopTimeFilter{Direction: direction, StopID: stop.ID})
 			if err != nil {
 				log.Fatal("getStopTime err: ", err)
 			}
+			sort.SliceStable(stopTimes, func(i, j int) bool {
+				return h.hhmm(stopTimes[i].Arrival) < h.hhmm(stopTimes[j].Arrival)
+			})
 			summary[direction][ind] = append(summary[direction][ind], stop.ID)
-			for rows.Next() {
-				var stopTime StopTime
-				rows.Scan(&stopTime.BoxID, &stopTime.StopID, &stopTime.Direction,
-					&stopTime.Sequence, &stopTime.Arrival, &stopTime.StopDuration)
-				oneST := fmt.Sprintf("%s (%d s)", stopTime.Arrival, stopTime.StopDuration)
+			for _, stopTime := range stopTimes {
+				oneST := fmt.Sprintf("%s (%d s)", h.hhmm(stopTime.Arrival), stopTime.StopDuration)
+				if len(stopTime.Source) > 0 && stopTime.Source != sourceObserved {
+					// estimated, not seen in traces
+					oneST = fmt.Sprintf("%s ~%.0f%%", oneST, stopTime.Confidence*100)
+				}
 				summary[direction][ind] = append(summary[direction][ind], oneST)
 			}
 		}
 	}
 
+	headways, err := h.headwayStats("", "")
+	if err != nil {
+		return err
+	}
+
 	out, err := indexTmpl.Execute(pongo2.Context{
 		"stops":          stopCnt,
 		"stop_and_route": stopAndRouteCnt,
 		"traces":         traceCnt,
 		"stop_times":     stopTimeCnt,
 		"summary":        summary,
+		"headways":       headways,
 	})
 	if err != nil {
 		return err
@@ -148,8 +240,14 @@ func (h *Handler) IndexHandler(c echo.Context) error {
 	return c.HTML(http.StatusOK, out)
 }
 
+// hhmm gives HH:MM of RFC3339 timestamp in service timezone
+func (h *Handler) hhmm(timestamp string) string {
+	t, _ := time.Parse(time.RFC3339, timestamp)
+	return t.In(h.loc).Format("15:04")
+}
+
 func (h *Handler) resetData(c echo.Context) error {
-	if err := h.truncateTables(); err != nil {
+	if err := h.store.Truncate(); err != nil {
 		return c.HTML(http.StatusBadRequest, fmt.Sprintf("Something went wrong: %v", err))
 	}
 	return c.HTML(http.StatusOK, "Successfuly reset")